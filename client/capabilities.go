@@ -0,0 +1,254 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+
+	sapmpb "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/sapmprotocol"
+)
+
+// capabilityCache holds the capabilities advertised by the endpoints of a client. A nil cache holds nothing.
+type capabilityCache struct {
+	mu         sync.RWMutex
+	byEndpoint map[string]*sapmprotocol.Capabilities
+}
+
+func (c *capabilityCache) get(endpoint string) *sapmprotocol.Capabilities {
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.byEndpoint[endpoint]
+}
+
+// update records the capabilities advertised by a response of endpoint. A successful response advertising nothing
+// forgets the capabilities of the endpoint, which may have been rolled back to a server predating them. Other
+// responses advertising nothing may come from proxies, they are ignored.
+func (c *capabilityCache) update(endpoint string, resp *http.Response) {
+	if c == nil {
+		return
+	}
+	caps := sapmprotocol.ParseCapabilities(resp.Header)
+	if caps == nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if caps == nil {
+		delete(c.byEndpoint, endpoint)
+		return
+	}
+	if c.byEndpoint == nil {
+		c.byEndpoint = map[string]*sapmprotocol.Capabilities{}
+	}
+	c.byEndpoint[endpoint] = caps
+}
+
+// Capabilities returns the capabilities last advertised by endpoint, the endpoint of the client or its shadow
+// endpoint, or nil if it did not advertise any. The capabilities are learned from the responses to the requests
+// sent over HTTP, so they are not known before the first request. They are used to compress the requests with an
+// encoding supported by the endpoint and to split the exports larger than its size limits. The returned
+// capabilities must not be modified.
+func (sa *Client) Capabilities(endpoint string) *sapmprotocol.Capabilities {
+	return sa.capabilities.get(endpoint)
+}
+
+// requestLimit returns the maximum size of the requests sent by the worker before compression, 0 if there is none.
+// The size of a compressed request is only known once it is encoded: the limit on the wire is turned into a limit
+// before compression with the compression ratio observed so far, or taken as is until a request was compressed.
+// Requests compressing worse than the others may still be rejected as too large, exportChunk splits them further.
+func (w *worker) requestLimit() int {
+	caps := w.capabilities.get(w.endpoint)
+	if caps == nil || w.grpcConn != nil {
+		return 0
+	}
+	limit := caps.MaxDecompressedBytes
+	if caps.MaxRequestBytes > 0 {
+		wireLimit := caps.MaxRequestBytes
+		if w.requestEncoding() != CompressionMethodNone {
+			if ratio := w.stats.compressionRatio(); ratio > 1 {
+				wireLimit = int64(float64(wireLimit) * ratio)
+			}
+		}
+		if limit <= 0 || wireLimit < limit {
+			limit = wireLimit
+		}
+	}
+	return int(limit)
+}
+
+// tooLarge returns true if the endpoint rejected a request because of its size while it advertises a size limit, so
+// that a smaller request may be accepted.
+func (w *worker) tooLarge(serr *ErrSend) bool {
+	if serr.StatusCode != http.StatusRequestEntityTooLarge || w.grpcConn != nil {
+		return false
+	}
+	caps := w.capabilities.get(w.endpoint)
+	return caps != nil && (caps.MaxRequestBytes > 0 || caps.MaxDecompressedBytes > 0)
+}
+
+// chunk is a part of the batches of an export, small enough to be sent in a single request.
+type chunk struct {
+	batches []*jaegerpb.Batch
+	// indexes are the indexes of the batches of the chunk in the exported batches.
+	indexes []int
+}
+
+// splitBatches splits the batches into chunks whose PostSpansRequest is at most limit bytes. Batches larger than the
+// limit are split into several batches sharing their process. A single span larger than the limit is sent on its own.
+// It returns nil if the batches fit in a single request, or if limit is 0.
+func splitBatches(batches []*jaegerpb.Batch, limit int) []chunk {
+	if limit <= 0 || requestSize(batches) <= limit {
+		return nil
+	}
+	var chunks []chunk
+	var current chunk
+	size := 0
+	add := func(index int, batch *jaegerpb.Batch) {
+		n := fieldSize(batch.Size())
+		if size+n > limit && len(current.batches) > 0 {
+			chunks = append(chunks, current)
+			current, size = chunk{}, 0
+		}
+		current.batches = append(current.batches, batch)
+		current.indexes = append(current.indexes, index)
+		size += n
+	}
+	for i, batch := range batches {
+		if fieldSize(batch.Size()) <= limit {
+			add(i, batch)
+			continue
+		}
+		for _, part := range splitSpans(batch, limit) {
+			add(i, part)
+		}
+	}
+	if len(current.batches) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// splitSpans splits the spans of a batch into batches sharing its process, each at most limit bytes once encoded in
+// a PostSpansRequest.
+func splitSpans(batch *jaegerpb.Batch, limit int) []*jaegerpb.Batch {
+	var parts []*jaegerpb.Batch
+	part := &jaegerpb.Batch{Process: batch.Process}
+	base := part.Size()
+	size := base
+	for _, span := range batch.Spans {
+		n := fieldSize(span.Size())
+		if fieldSize(size+n) > limit && len(part.Spans) > 0 {
+			parts = append(parts, part)
+			part = &jaegerpb.Batch{Process: batch.Process}
+			size = base
+		}
+		part.Spans = append(part.Spans, span)
+		size += n
+	}
+	return append(parts, part)
+}
+
+// fieldSize returns the size of a length-delimited field holding n bytes.
+func fieldSize(n int) int {
+	return 1 + uvarintSize(uint64(n)) + n
+}
+
+// exportChunks exports the chunks of an export too large for the endpoint, one request per chunk. Each request gets
+// its own idempotency key, derived from the key of the export so that retrying the export reuses the same keys. The
+// export stops at the first failed request: the batches of the chunks that were not accepted are returned along
+// with the error.
+func (w *worker) exportChunks(
+	ctx context.Context, chunks []chunk, accessToken string,
+) (*IngestResponse, *ErrSend, []*jaegerpb.Batch) {
+	key := IdempotencyKeyFromContext(ctx)
+	responses := make([]*IngestResponse, 0, len(chunks))
+	for i, c := range chunks {
+		chunkCtx := ContextWithIdempotencyKey(ctx, fmt.Sprintf("%s-%d", key, i))
+		resp, serr, failed := w.exportChunk(chunkCtx, c.batches, accessToken)
+		if serr != nil {
+			for _, c := range chunks[i+1:] {
+				failed = append(failed, c.batches...)
+			}
+			return resp, serr, failed
+		}
+		responses = append(responses, resp)
+	}
+	return mergeResponses(responses, chunks), nil, nil
+}
+
+// exportChunk exports batches in a single request. If the endpoint rejects the request as too large, which happens
+// when it compresses worse than estimated by requestLimit, the batches are split in two halves exported again with
+// exportChunks. The batches that were not accepted are returned along with the error.
+func (w *worker) exportChunk(
+	ctx context.Context, batches []*jaegerpb.Batch, accessToken string,
+) (*IngestResponse, *ErrSend, []*jaegerpb.Batch) {
+	resp, serr := w.export(ctx, batches, accessToken)
+	if serr == nil || !w.tooLarge(serr) {
+		return resp, serr, batches
+	}
+	chunks := splitBatches(batches, (requestSize(batches)+1)/2)
+	if len(chunks) < 2 {
+		// A single span cannot be split.
+		return resp, serr, batches
+	}
+	return w.exportChunks(ctx, chunks, accessToken)
+}
+
+// mergeResponses merges the responses to the chunks of an export. Body and Err are those of the last response.
+// Response sums the spans of the responses, with the rejected batches mapped back to the exported batches: it is nil
+// unless every response was decoded.
+func mergeResponses(responses []*IngestResponse, chunks []chunk) *IngestResponse {
+	var merged *IngestResponse
+	var messages []string
+	for i, resp := range responses {
+		if resp == nil {
+			// Chunks without spans are not sent.
+			continue
+		}
+		if merged == nil {
+			merged = &IngestResponse{Response: &sapmpb.PostSpansResponse{}}
+		}
+		merged.Body, merged.Err = resp.Body, resp.Err
+		if resp.Response == nil || merged.Response == nil {
+			merged.Response = nil
+			continue
+		}
+		merged.Response.AcceptedSpans += resp.Response.AcceptedSpans
+		merged.Response.RejectedSpans += resp.Response.RejectedSpans
+		if msg := resp.Response.ErrorMessage; msg != "" {
+			messages = append(messages, msg)
+		}
+		for _, rejection := range resp.Response.RejectedBatches {
+			if index := int(rejection.BatchIndex); index >= 0 && index < len(chunks[i].indexes) {
+				rejection.BatchIndex = int32(chunks[i].indexes[index])
+			}
+			merged.Response.RejectedBatches = append(merged.Response.RejectedBatches, rejection)
+		}
+	}
+	if merged != nil && merged.Response != nil {
+		merged.Response.ErrorMessage = strings.Join(messages, "; ")
+	}
+	return merged
+}
@@ -0,0 +1,247 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gen "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/testhelpers"
+	"github.com/signalfx/sapm-proto/sapmprotocol"
+)
+
+// spansOf returns the spans of the batches, in order.
+func spansOf(batches []*jaegerpb.Batch) []*jaegerpb.Span {
+	var spans []*jaegerpb.Span
+	for _, b := range batches {
+		spans = append(spans, b.Spans...)
+	}
+	return spans
+}
+
+func TestSplitBatches(t *testing.T) {
+	small := testhelpers.CreateSapmData(3).Batches[0]
+	large := testhelpers.CreateSapmData(40).Batches[0]
+	batches := []*jaegerpb.Batch{small, large, small}
+	total := requestSize(batches)
+	spanSize := fieldSize(large.Spans[1].Size())
+
+	assert.Nil(t, splitBatches(batches, 0))
+	assert.Nil(t, splitBatches(batches, total))
+
+	for _, limit := range []int{total - 1, total / 3, fieldSize(small.Size()), 3 * spanSize} {
+		chunks := splitBatches(batches, limit)
+		require.Greater(t, len(chunks), 1, limit)
+		var got []*jaegerpb.Batch
+		for _, c := range chunks {
+			assert.LessOrEqual(t, requestSize(c.batches), limit)
+			require.Len(t, c.indexes, len(c.batches))
+			for i, b := range c.batches {
+				assert.Same(t, batches[c.indexes[i]].Process, b.Process)
+			}
+			got = append(got, c.batches...)
+		}
+		assert.Equal(t, spansOf(batches), spansOf(got), limit)
+	}
+
+	// A span larger than the limit is sent on its own.
+	chunks := splitBatches([]*jaegerpb.Batch{large}, 1)
+	require.Len(t, chunks, len(large.Spans))
+	for i, c := range chunks {
+		assert.Equal(t, []*jaegerpb.Span{large.Spans[i]}, spansOf(c.batches))
+	}
+}
+
+func TestMergeResponses(t *testing.T) {
+	chunks := []chunk{{indexes: []int{0, 1}}, {indexes: []int{1, 2}}, {indexes: []int{3}}}
+	merged := mergeResponses([]*IngestResponse{
+		{Body: []byte("first"), Response: &gen.PostSpansResponse{AcceptedSpans: 3}},
+		{Body: []byte("second"), Response: &gen.PostSpansResponse{
+			AcceptedSpans:   1,
+			RejectedSpans:   2,
+			ErrorMessage:    "too old",
+			RejectedBatches: []*gen.BatchRejection{{BatchIndex: 1, RejectedSpans: 2}},
+		}},
+		nil,
+	}, chunks)
+	assert.Equal(t, &IngestResponse{Body: []byte("second"), Response: &gen.PostSpansResponse{
+		AcceptedSpans:   4,
+		RejectedSpans:   2,
+		ErrorMessage:    "too old",
+		RejectedBatches: []*gen.BatchRejection{{BatchIndex: 2, RejectedSpans: 2}},
+	}}, merged)
+
+	merged = mergeResponses([]*IngestResponse{
+		{Response: &gen.PostSpansResponse{AcceptedSpans: 3}},
+		{Body: []byte("OK")},
+	}, chunks)
+	assert.Equal(t, &IngestResponse{Body: []byte("OK")}, merged)
+	assert.Nil(t, mergeResponses([]*IngestResponse{nil}, chunks))
+}
+
+func TestCapabilityCache(t *testing.T) {
+	cache := &capabilityCache{}
+	advertised := http.Header{}
+	(&sapmprotocol.Capabilities{Version: "2.1", MaxRequestBytes: 10}).SetHeaders(advertised)
+
+	cache.update("a", &http.Response{StatusCode: http.StatusOK, Header: advertised})
+	assert.Equal(t, &sapmprotocol.Capabilities{Version: "2.1", MaxRequestBytes: 10}, cache.get("a"))
+	assert.Nil(t, cache.get("b"))
+
+	// Responses from proxies do not advertise capabilities.
+	cache.update("a", &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{}})
+	assert.NotNil(t, cache.get("a"))
+	cache.update("a", &http.Response{StatusCode: http.StatusOK, Header: http.Header{}})
+	assert.Nil(t, cache.get("a"))
+
+	var nilCache *capabilityCache
+	nilCache.update("a", &http.Response{StatusCode: http.StatusOK, Header: advertised})
+	assert.Nil(t, nilCache.get("a"))
+}
+
+func TestCapabilityNegotiation(t *testing.T) {
+	const limit = 2048
+	var mu sync.Mutex
+	var encodings, keys []string
+	var received []*jaegerpb.Batch
+	caps := &sapmprotocol.Capabilities{
+		Version:              sapmprotocol.ProtocolVersion,
+		Encodings:            []string{"gzip"},
+		MaxDecompressedBytes: limit,
+	}
+	var rejectAfter int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, sapmprotocol.ProtocolVersion, req.Header.Get(sapmprotocol.ProtocolVersionHeaderName))
+		caps.SetHeaders(rw.Header())
+		psr, err := sapmprotocol.ParseTraceV2Request(req, sapmprotocol.WithMaxDecompressedSize(limit))
+		if err != nil || (rejectAfter > 0 && len(keys) >= rejectAfter) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		encodings = append(encodings, req.Header.Get(sapmprotocol.ContentEncodingHeaderName))
+		keys = append(keys, req.Header.Get(sapmprotocol.IdempotencyKeyHeaderName))
+		received = append(received, psr.Batches...)
+		body, _ := (&gen.PostSpansResponse{AcceptedSpans: int64(len(spansOf(psr.Batches)))}).Marshal()
+		rw.Header().Set(sapmprotocol.ContentTypeHeaderName, sapmprotocol.ContentTypeHeaderValue)
+		_, _ = rw.Write(body)
+	}))
+	defer server.Close()
+
+	sink := &memoryDeadLetterSink{}
+	c, err := New(WithEndpoint(server.URL), WithCompressionMethod(CompressionMethodZstd), WithDeadLetterSink(sink))
+	require.NoError(t, err)
+	defer c.Stop()
+	assert.Nil(t, c.Capabilities(server.URL))
+
+	// The first request learns the capabilities of the server.
+	small := testhelpers.CreateSapmData(2).Batches
+	require.NoError(t, c.Export(context.Background(), small))
+	assert.Equal(t, []string{"zstd"}, encodings)
+	assert.Equal(t, caps, c.Capabilities(server.URL))
+
+	// The next ones use an encoding supported by the server, and fit its size limit.
+	encodings, keys, received = nil, nil, nil
+	batches := testhelpers.CreateSapmData(100).Batches
+	require.Greater(t, requestSize(batches), limit)
+	resp, err := c.ExportWithAccessTokenAndGetResponse(ContextWithIdempotencyKey(context.Background(), "key"), batches, "")
+	require.NoError(t, err)
+	require.Greater(t, len(keys), 1)
+	for i, key := range keys {
+		assert.Equal(t, "gzip", encodings[i])
+		assert.Equal(t, "key-"+strconv.Itoa(i), key)
+	}
+	assert.Equal(t, spansOf(batches), spansOf(received))
+	assert.Equal(t, &gen.PostSpansResponse{AcceptedSpans: 100}, resp.Response)
+
+	caps.Encodings = []string{"identity"}
+	encodings = nil
+	require.NoError(t, c.Export(context.Background(), small))
+	require.NoError(t, c.Export(context.Background(), small))
+	assert.Equal(t, []string{"gzip", ""}, encodings)
+
+	// The batches that were not accepted are dead-lettered.
+	keys, received, rejectAfter = nil, nil, 1
+	err = c.Export(context.Background(), batches)
+	serr := &ErrSend{}
+	require.True(t, errors.As(err, &serr))
+	assert.True(t, serr.Permanent)
+	require.Len(t, sink.letters, 1)
+	assert.Equal(t, spansOf(batches), append(spansOf(received), spansOf(sink.letters[0].Batches)...))
+}
+
+func TestCompressedRequestLimit(t *testing.T) {
+	const limit = 2048
+	var mu sync.Mutex
+	var received []*jaegerpb.Batch
+	server := httptest.NewServer(sapmprotocol.NewTraceHandler(
+		func(_ context.Context, psr *gen.PostSpansRequest, _ string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, psr.Batches...)
+			return nil
+		},
+		sapmprotocol.WithMaxRequestBytes(limit),
+	))
+	defer server.Close()
+
+	c, err := New(WithEndpoint(server.URL))
+	require.NoError(t, err)
+	defer c.Stop()
+
+	// The first request learns the capabilities of the server.
+	require.NoError(t, c.Export(context.Background(), testhelpers.CreateSapmData(2).Batches))
+	require.Equal(t, int64(limit), c.Capabilities(server.URL).MaxRequestBytes)
+
+	// The gzipped requests fit the limit on the wire, estimated with the compression ratio.
+	mu.Lock()
+	received = nil
+	mu.Unlock()
+	batches := testhelpers.CreateSapmData(100).Batches
+	require.NoError(t, c.Export(context.Background(), batches))
+	mu.Lock()
+	assert.Equal(t, spansOf(batches), spansOf(received))
+	received = nil
+	mu.Unlock()
+
+	// Requests compressing worse than estimated are rejected by the server, then split further.
+	random := make([]byte, 8192)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+	incompressible := &jaegerpb.Batch{Process: &jaegerpb.Process{ServiceName: "svc"}}
+	for i := 0; i < len(random); i += 256 {
+		incompressible.Spans = append(incompressible.Spans, &jaegerpb.Span{
+			Tags: []jaegerpb.KeyValue{jaegerpb.String("random", hex.EncodeToString(random[i:i+256]))},
+		})
+	}
+	require.NoError(t, c.Export(context.Background(), []*jaegerpb.Batch{incompressible}))
+	mu.Lock()
+	assert.Equal(t, incompressible.Spans, spansOf(received))
+	mu.Unlock()
+	assert.Positive(t, c.Stats().FailuresByStatusCode[http.StatusRequestEntityTooLarge])
+}
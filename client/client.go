@@ -15,17 +15,27 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpcencoding "google.golang.org/grpc/encoding"
+
+	"github.com/signalfx/sapm-proto/processor"
+	"github.com/signalfx/sapm-proto/sapmprotocol"
 )
 
 const (
@@ -42,15 +52,35 @@ const (
 
 type sendRequest struct {
 	message []byte
-	spans   int64
-	batches int64
+	// buf is the pooled buffer backing message, nil if message is not owned by the client.
+	buf  *bytes.Buffer
+	refs atomic.Int32
+	// stream encodes the request while it is being sent, for requests too large to be buffered.
+	// message is nil when stream is set.
+	stream   func(io.Writer) error
+	streamed atomic.Int64
+	// encoding is the Content-Encoding of message, empty if it is not compressed.
+	encoding CompressionMethod
+	// uncompressedSize is the size of the marshaled request before compression, 0 if unknown.
+	uncompressedSize int64
+	spans            int64
+	batches          int64
 }
 
 // CompressionMethod strings MUST match the Content-Encoding http header values.
+// Any encoding registered with sapmprotocol.RegisterEncoding can be used, and stacked encodings such as "gzip, zstd"
+// are applied in order.
 type CompressionMethod string
 
 const CompressionMethodGzip CompressionMethod = "gzip"
 const CompressionMethodZstd CompressionMethod = "zstd"
+const CompressionMethodDeflate CompressionMethod = "deflate"
+const CompressionMethodSnappy CompressionMethod = "snappy"
+const CompressionMethodLZ4 CompressionMethod = "lz4"
+const CompressionMethodBrotli CompressionMethod = "br"
+
+// CompressionMethodNone is used with ExportRaw for payloads that are not compressed.
+const CompressionMethodNone CompressionMethod = ""
 
 // Client implements an HTTP sender for the SAPM protocol
 type Client struct {
@@ -60,10 +90,32 @@ type Client struct {
 	endpoint       string
 	accessToken    string
 	httpClient     *http.Client
+	observer       Observer
+	stats          *clientStats
+	deadLetterSink DeadLetterSink
+
+	// streamingThreshold is the uncompressed request size above which requests are streamed, 0 to disable.
+	streamingThreshold int
+
+	processors processor.Chain
+
+	shadow *shadow
+
+	validate         bool
+	validationMode   ValidationMode
+	validationReport ValidationReportFunc
 
 	disableCompression bool
 	// compressionMethod to use for payload. Ignored if disableCompression==true.
 	compressionMethod CompressionMethod
+	jsonEncoding      bool
+
+	useGRPC         bool
+	grpcJaeger      bool
+	grpcDialOptions []grpc.DialOption
+	grpcConn        *grpc.ClientConn
+
+	capabilities *capabilityCache
 
 	closeCh chan struct{}
 
@@ -77,6 +129,7 @@ func New(opts ...Option) (*Client, error) {
 		numWorkers:        defaultNumWorkers,
 		maxIdleCons:       defaultMaxIdleCons,
 		compressionMethod: CompressionMethodGzip,
+		observer:          NopObserver{},
 	}
 
 	for _, opt := range opts {
@@ -120,23 +173,89 @@ func New(opts ...Option) (*Client, error) {
 		}
 	}
 
+	disableCompression, streamingThreshold := c.disableCompression, c.streamingThreshold
+	if c.useGRPC {
+		if err := c.dialGRPC(); err != nil {
+			return nil, err
+		}
+		// gRPC compresses the messages itself, and requests cannot be streamed.
+		disableCompression, streamingThreshold = true, 0
+	}
+
+	c.stats = &clientStats{}
+	c.capabilities = &capabilityCache{}
 	c.closeCh = make(chan struct{})
 	c.workers = make(chan *worker, c.numWorkers)
 	for i := uint(0); i < c.numWorkers; i++ {
 		w, err := newWorker(
-			c.httpClient, c.endpoint, c.accessToken, c.disableCompression, c.compressionMethod, c.tracerProvider,
+			c.httpClient, c.endpoint, c.accessToken, disableCompression, c.compressionMethod, c.tracerProvider,
+			c.observer, c.stats, streamingThreshold,
 		)
 		if err != nil {
 			return nil, err
 		}
+		w.jsonEncoding = c.jsonEncoding
+		w.capabilities = c.capabilities
+		if c.grpcConn != nil {
+			w.grpcConn = c.grpcConn
+			w.grpcJaeger = c.grpcJaeger
+			if !c.disableCompression {
+				w.grpcCompression = c.compressionMethod
+			}
+		}
 		c.workers <- w
 	}
 
+	if c.shadow != nil {
+		// Shadow workers have their own stats and no observer, so mirrored requests do not show up in the
+		// primary metrics. They never stream so that the batches are encoded before Export returns.
+		shadowStats := &clientStats{}
+		c.shadow.workers = make(chan *worker, c.numWorkers)
+		for i := uint(0); i < c.numWorkers; i++ {
+			w, err := newWorker(
+				c.httpClient, c.shadow.endpoint, c.shadow.accessToken, c.disableCompression, c.compressionMethod,
+				c.tracerProvider, nil, shadowStats, 0,
+			)
+			if err != nil {
+				return nil, err
+			}
+			w.jsonEncoding = c.jsonEncoding
+			w.capabilities = c.capabilities
+			c.shadow.workers <- w
+		}
+	}
+
 	return c, nil
 }
 
+// dialGRPC creates the gRPC connection used by the workers. The connection uses TLS unless the dial options set
+// other transport credentials.
+func (c *Client) dialGRPC() error {
+	if c.jsonEncoding {
+		return fmt.Errorf("JSON encoding is not supported with gRPC")
+	}
+	if !c.disableCompression {
+		if stack, _ := sapmprotocol.ParseContentEncoding(string(c.compressionMethod)); len(stack) > 1 {
+			return fmt.Errorf("stacked compression method %q is not supported with gRPC", string(c.compressionMethod))
+		}
+		if grpcencoding.GetCompressor(string(c.compressionMethod)) == nil {
+			return fmt.Errorf("compression method %q is not registered with gRPC", string(c.compressionMethod))
+		}
+	}
+	opts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})),
+	}, c.grpcDialOptions...)
+	conn, err := grpc.NewClient(c.endpoint, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create gRPC client: %w", err)
+	}
+	c.grpcConn = conn
+	return nil
+}
+
 // Export takes a Jaeger batches and uses one of the available workers to export it synchronously.
 // It returns an error in case a request cannot be processed. It's up to the caller to retry.
+// Every request carries an idempotency key, generated unless ctx holds one set by ContextWithIdempotencyKey.
 func (sa *Client) Export(ctx context.Context, batches []*jaegerpb.Batch) error {
 	return sa.ExportWithAccessToken(ctx, batches, "")
 }
@@ -153,24 +272,163 @@ func (sa *Client) ExportWithAccessToken(ctx context.Context, batches []*jaegerpb
 // ExportWithAccessTokenAndGetResponse does everything ExportWithAccessToken does and in addition will
 // return a ResponseBody indicating the response returned from trace ingest. This can be used by consumers
 // to get insights into partial drops of spans/traces from within a batch.
+// Exports larger than the size limits advertised by the endpoint are split into several requests, sent in order
+// until one fails. The response then merges the responses to these requests.
 func (sa *Client) ExportWithAccessTokenAndGetResponse(ctx context.Context, batches []*jaegerpb.Batch, accessToken string) (*IngestResponse, error) {
+	ctx, idempotencyKey := withIdempotencyKey(ctx)
+	if len(sa.processors) > 0 {
+		processed, err := sa.processors.Process(ctx, batches)
+		if err != nil {
+			// The batches are dropped like a request the client failed to encode.
+			sendErr := &ErrSend{
+				Err:            fmt.Errorf("failed to process batches: %w", err),
+				Permanent:      true,
+				Spans:          int64(countSpans(batches)),
+				IdempotencyKey: idempotencyKey,
+			}
+			observeFailure(ctx, sa.observer, sa.stats, sendErr, sendErr.Spans)
+			if sa.deadLetterSink != nil {
+				sa.writeDeadLetter(ctx, batches, nil, sendErr)
+			}
+			return nil, sendErr
+		}
+		if len(processed) == 0 {
+			// Nothing left to send, e.g. every span was sampled out.
+			return nil, nil
+		}
+		batches = processed
+	}
+	if sa.validate {
+		batches = sa.validateBatches(ctx, batches)
+	}
+	if sa.shadow != nil {
+		sa.mirror(ctx, batches, accessToken)
+	}
+
 	w := <-sa.workers
 
-	ingestResponse, sendErr := w.export(ctx, batches, accessToken)
+	var ingestResponse *IngestResponse
+	var sendErr *ErrSend
+	var failed []*jaegerpb.Batch
+	if chunks := splitBatches(batches, w.requestLimit()); chunks != nil {
+		ingestResponse, sendErr, failed = w.exportChunks(ctx, chunks, accessToken)
+	} else {
+		ingestResponse, sendErr, failed = w.exportChunk(ctx, batches, accessToken)
+	}
 	sa.workers <- w
 	if sendErr != nil {
-		if sendErr.RetryDelaySeconds > 0 {
-			go sa.pauseForDuration(time.Duration(sendErr.RetryDelaySeconds) * time.Second)
+		sendErr.IdempotencyKey = idempotencyKey
+		if sendErr.Permanent && sa.deadLetterSink != nil {
+			sa.writeDeadLetter(ctx, failed, ingestResponse, sendErr)
+		}
+		sa.handleSendError(sendErr)
+		return ingestResponse, sendErr
+	}
+	return ingestResponse, nil
+
+}
+
+// validateBatches runs the configured validation and reports the issues found.
+func (sa *Client) validateBatches(ctx context.Context, batches []*jaegerpb.Batch) []*jaegerpb.Batch {
+	spansCount := countSpans(batches)
+	valid, issues := ValidateBatches(batches, sa.validationMode)
+	if len(issues) == 0 {
+		return valid
+	}
+	sa.stats.spansInvalid.Add(int64(spansCount - countSpans(valid)))
+	if sa.validationReport != nil {
+		sa.validationReport(ctx, issues)
+	}
+	return valid
+}
+
+// ExportRaw sends a payload that already holds a marshaled SAPM PostSpansRequest, compressed with the given
+// encoding or not compressed at all if encoding is CompressionMethodNone. The payload must be JSON encoded if the
+// client was configured with WithJSONEncoding. The payload skips marshaling and
+// compression but is otherwise handled like Export: the request uses one of the available workers and a
+// throttled request pauses the client. Requests exported this way are not processed, validated nor passed to the
+// DeadLetterSink.
+func (sa *Client) ExportRaw(
+	ctx context.Context, payload []byte, encoding CompressionMethod, opts ...ExportOption,
+) (*IngestResponse, error) {
+	eo := exportOptions{}
+	for _, opt := range opts {
+		opt(&eo)
+	}
+
+	if !validCompressionMethod(encoding) && encoding != CompressionMethodNone {
+		return nil, &ErrSend{
+			Err:       fmt.Errorf("invalid compression method %q", string(encoding)),
+			Permanent: true,
+			Spans:     eo.spans,
+
+			unsupportedEncoding: true,
 		}
+	}
+
+	sr := &sendRequest{
+		message:  payload,
+		encoding: encoding,
+		batches:  eo.batches,
+		spans:    eo.spans,
+	}
+	if encoding == CompressionMethodNone {
+		sr.uncompressedSize = int64(len(payload))
+	}
+
+	ctx, idempotencyKey := withIdempotencyKey(ctx)
+	w := <-sa.workers
+	ingestResponse, sendErr := w.exportRaw(ctx, sr, eo.accessToken)
+	sa.workers <- w
+	if sendErr != nil {
+		sendErr.IdempotencyKey = idempotencyKey
+		sa.handleSendError(sendErr)
 		return ingestResponse, sendErr
 	}
 	return ingestResponse, nil
+}
+
+// validCompressionMethod returns true if every encoding of the compression method is registered.
+func validCompressionMethod(m CompressionMethod) bool {
+	stack, err := sapmprotocol.ParseContentEncoding(string(m))
+	return err == nil && len(stack) > 0
+}
+
+// handleSendError pauses the client if the server asked to slow down.
+func (sa *Client) handleSendError(sendErr *ErrSend) {
+	if sendErr.RetryDelaySeconds > 0 {
+		go sa.pauseForDuration(time.Duration(sendErr.RetryDelaySeconds) * time.Second)
+	}
+}
+
+// Stats returns a snapshot of the counters accumulated since the client was created.
+// It is cheap enough to be called on every health check.
+func (sa *Client) Stats() Stats {
+	st := sa.stats.snapshot()
+	st.IdleWorkers = len(sa.workers)
+	return st
+}
 
+// writeDeadLetter hands a permanently failed request to the dead letter sink.
+func (sa *Client) writeDeadLetter(ctx context.Context, batches []*jaegerpb.Batch, resp *IngestResponse, sendErr *ErrSend) {
+	letter := &DeadLetter{
+		Time:    time.Now(),
+		Batches: batches,
+		Err:     sendErr,
+	}
+	if resp != nil {
+		letter.ResponseBody = resp.Body
+	}
+	if err := sa.deadLetterSink.Write(ctx, letter); err != nil {
+		sa.stats.deadLettersFailed.Add(1)
+		return
+	}
+	sa.stats.deadLettersWritten.Add(1)
 }
 
 // Stop waits for all inflight requests to finish and then drains the worker pool so no more work can be done.
 // It returns once all workers are drained from the pool. Note that the client can accept new requests while
-// Stop() waits for other requests to finish.
+// Stop() waits for other requests to finish. Inflight requests to the shadow endpoint are waited for as well.
 func (sa *Client) Stop() {
 	wg := sync.WaitGroup{}
 	wg.Add(int(sa.numWorkers))
@@ -181,7 +439,19 @@ func (sa *Client) Stop() {
 			wg.Done()
 		}()
 	}
+	if sa.shadow != nil {
+		wg.Add(int(sa.numWorkers))
+		for i := uint(0); i < sa.numWorkers; i++ {
+			go func() {
+				<-sa.shadow.workers
+				wg.Done()
+			}()
+		}
+	}
 	wg.Wait()
+	if sa.grpcConn != nil {
+		_ = sa.grpcConn.Close()
+	}
 }
 
 // pauseForDuration takes workers all workers from the pool and holds on to them until either the duration passes or
@@ -191,6 +461,11 @@ func (sa *Client) pauseForDuration(d time.Duration) {
 		return
 	}
 
+	sa.stats.activePauses.Add(1)
+	defer sa.stats.activePauses.Add(-1)
+	sa.observer.OnPauseStart(d)
+	defer sa.observer.OnPauseEnd()
+
 	done := make(chan struct{})
 	workers := make([]*worker, 0, sa.numWorkers)
 	ticker := time.NewTicker(d)
@@ -15,18 +15,32 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/jaegertracing/jaeger-idl/proto-gen/api_v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	gen "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/testhelpers"
+	"github.com/signalfx/sapm-proto/processor"
 	"github.com/signalfx/sapm-proto/sapmprotocol"
 )
 
@@ -40,6 +54,17 @@ func assertRequestEqualBatches(t *testing.T, r *http.Request, b []*jaegerpb.Batc
 	}
 }
 
+func compressBytes(t *testing.T, b []byte, m CompressionMethod) []byte {
+	buf := &bytes.Buffer{}
+	w, err := sapmprotocol.NewCompressor(string(m))
+	require.NoError(t, err)
+	w.Reset(buf)
+	_, err = w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
 func TestDefaults(t *testing.T) {
 	c, err := New(defaultEndpointOption)
 	require.NoError(t, err)
@@ -67,6 +92,26 @@ var compressionTests = []struct {
 		name:              "zstd",
 		compressionMethod: CompressionMethodZstd,
 	},
+	{
+		name:              "deflate",
+		compressionMethod: CompressionMethodDeflate,
+	},
+	{
+		name:              "snappy",
+		compressionMethod: CompressionMethodSnappy,
+	},
+	{
+		name:              "lz4",
+		compressionMethod: CompressionMethodLZ4,
+	},
+	{
+		name:              "brotli",
+		compressionMethod: CompressionMethodBrotli,
+	},
+	{
+		name:              "gzip+zstd",
+		compressionMethod: "gzip, zstd",
+	},
 }
 
 func TestClient(t *testing.T) {
@@ -459,3 +504,877 @@ func TestInvalidCompressionMethod(t *testing.T) {
 	)
 	require.Error(t, err)
 }
+
+type recordingObserver struct {
+	NopObserver
+	sync.Mutex
+	started   int64
+	succeeded int64
+	failures  []*ErrSend
+	drops     []DropReason
+	retries   int
+	pauses    []time.Duration
+	pauseEnds int
+}
+
+func (o *recordingObserver) OnSendStart(_ context.Context, _, spans int64) {
+	o.Lock()
+	defer o.Unlock()
+	o.started += spans
+}
+
+func (o *recordingObserver) OnSendSuccess(_ context.Context, _, spans int64) {
+	o.Lock()
+	defer o.Unlock()
+	o.succeeded += spans
+}
+
+func (o *recordingObserver) OnSendFailure(_ context.Context, err *ErrSend) {
+	o.Lock()
+	defer o.Unlock()
+	o.failures = append(o.failures, err)
+}
+
+func (o *recordingObserver) OnDrop(_ context.Context, reason DropReason, _ int64) {
+	o.Lock()
+	defer o.Unlock()
+	o.drops = append(o.drops, reason)
+}
+
+func (o *recordingObserver) OnRetry(context.Context, *ErrSend) {
+	o.Lock()
+	defer o.Unlock()
+	o.retries++
+}
+
+func (o *recordingObserver) OnPauseStart(d time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+	o.pauses = append(o.pauses, d)
+}
+
+func (o *recordingObserver) OnPauseEnd() {
+	o.Lock()
+	defer o.Unlock()
+	o.pauseEnds++
+}
+
+func TestObserver(t *testing.T) {
+	transport := &mockTransport{}
+	observer := &recordingObserver{}
+	c, err := New(
+		defaultEndpointOption,
+		WithHTTPClient(newMockHTTPClient(transport)),
+		WithObserver(observer),
+	)
+	require.NoError(t, err)
+
+	batches := []*jaegerpb.Batch{
+		{
+			Process: &jaegerpb.Process{ServiceName: "test_service"},
+			Spans:   []*jaegerpb.Span{{}, {}},
+		},
+	}
+
+	require.NoError(t, c.Export(context.Background(), batches))
+	assert.EqualValues(t, 2, observer.started)
+	assert.EqualValues(t, 2, observer.succeeded)
+
+	transport.reset(400)
+	require.Error(t, c.Export(context.Background(), batches))
+	assert.Equal(t, []DropReason{DropReasonRejected}, observer.drops)
+
+	transport.reset(500)
+	require.Error(t, c.Export(context.Background(), batches))
+	assert.Equal(t, 1, observer.retries)
+
+	observer.Lock()
+	assert.Len(t, observer.failures, 2)
+	assert.EqualValues(t, 6, observer.started)
+	assert.EqualValues(t, 2, observer.succeeded)
+	observer.Unlock()
+}
+
+func TestObserverPause(t *testing.T) {
+	transport := &mockTransport{
+		statusCode: 429,
+		headers: map[string]string{
+			"Retry-After": "1",
+		},
+	}
+	observer := &recordingObserver{}
+	c, err := New(
+		defaultEndpointOption,
+		WithHTTPClient(newMockHTTPClient(transport)),
+		WithObserver(observer),
+	)
+	require.NoError(t, err)
+
+	batches := []*jaegerpb.Batch{
+		{
+			Process: &jaegerpb.Process{ServiceName: "test_service"},
+			Spans:   []*jaegerpb.Span{{}},
+		},
+	}
+	require.Error(t, c.Export(context.Background(), batches))
+
+	assert.Eventually(t, func() bool {
+		observer.Lock()
+		defer observer.Unlock()
+		return observer.pauseEnds == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	observer.Lock()
+	defer observer.Unlock()
+	assert.Equal(t, 1, observer.retries)
+	assert.Equal(t, []time.Duration{time.Second}, observer.pauses)
+}
+
+func TestNilObserver(t *testing.T) {
+	_, err := New(defaultEndpointOption, WithObserver(nil))
+	require.Error(t, err)
+}
+
+func TestStats(t *testing.T) {
+	transport := &mockTransport{}
+	c, err := New(
+		defaultEndpointOption,
+		WithHTTPClient(newMockHTTPClient(transport)),
+		WithWorkers(2),
+	)
+	require.NoError(t, err)
+
+	st := c.Stats()
+	assert.Zero(t, st.SpansSent)
+	assert.Zero(t, st.CompressionRatio)
+	assert.Equal(t, 2, st.IdleWorkers)
+	assert.False(t, st.Paused)
+
+	batches := []*jaegerpb.Batch{
+		{
+			Process: &jaegerpb.Process{ServiceName: "test_service"},
+			Spans:   []*jaegerpb.Span{{}, {}, {}},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Export(context.Background(), batches))
+	}
+
+	transport.reset(400)
+	require.Error(t, c.Export(context.Background(), batches))
+	transport.reset(503)
+	require.Error(t, c.Export(context.Background(), batches))
+	require.Error(t, c.Export(context.Background(), batches))
+
+	st = c.Stats()
+	assert.EqualValues(t, 9, st.SpansSent)
+	assert.EqualValues(t, 3, st.BatchesSent)
+	assert.Greater(t, st.BytesSent, int64(0))
+	assert.Greater(t, st.CompressionRatio, float64(0))
+	assert.EqualValues(t, 3, st.SpansDropped)
+	assert.Equal(t, map[int]int64{400: 1, 503: 2}, st.FailuresByStatusCode)
+	assert.Equal(t, 2, st.IdleWorkers)
+}
+
+func TestStatsPaused(t *testing.T) {
+	transport := &mockTransport{
+		statusCode: 429,
+		headers: map[string]string{
+			"Retry-After": "100",
+		},
+	}
+	c, err := New(
+		defaultEndpointOption,
+		WithHTTPClient(newMockHTTPClient(transport)),
+		WithDisabledCompression(),
+	)
+	require.NoError(t, err)
+
+	batches := []*jaegerpb.Batch{
+		{
+			Process: &jaegerpb.Process{ServiceName: "test_service"},
+			Spans:   []*jaegerpb.Span{{}},
+		},
+	}
+	require.Error(t, c.Export(context.Background(), batches))
+	assert.Eventually(t, func() bool {
+		st := c.Stats()
+		return st.Paused && st.IdleWorkers == 0
+	}, time.Second, 10*time.Millisecond)
+
+	st := c.Stats()
+	assert.Equal(t, map[int]int64{429: 1}, st.FailuresByStatusCode)
+	assert.Zero(t, st.SpansDropped)
+	c.Stop()
+}
+
+type memoryDeadLetterSink struct {
+	sync.Mutex
+	letters []*DeadLetter
+	err     error
+}
+
+func (s *memoryDeadLetterSink) Write(_ context.Context, letter *DeadLetter) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func TestDeadLetterSink(t *testing.T) {
+	transport := &mockTransport{statusCode: 400, body: "bad spans"}
+	sink := &memoryDeadLetterSink{}
+	c, err := New(
+		defaultEndpointOption,
+		WithHTTPClient(newMockHTTPClient(transport)),
+		WithDeadLetterSink(sink),
+	)
+	require.NoError(t, err)
+
+	batches := []*jaegerpb.Batch{
+		{
+			Process: &jaegerpb.Process{ServiceName: "test_service"},
+			Spans:   []*jaegerpb.Span{{}},
+		},
+	}
+	err = c.Export(context.Background(), batches)
+	require.Error(t, err)
+
+	require.Len(t, sink.letters, 1)
+	assert.Equal(t, batches, sink.letters[0].Batches)
+	assert.Equal(t, "bad spans", string(sink.letters[0].ResponseBody))
+	assert.Equal(t, err, sink.letters[0].Err)
+
+	// retryable failures are not dead letters
+	transport.reset(503)
+	require.Error(t, c.Export(context.Background(), batches))
+	assert.Len(t, sink.letters, 1)
+
+	transport.reset(401)
+	sink.err = errors.New("disk full")
+	require.Error(t, c.Export(context.Background(), batches))
+
+	st := c.Stats()
+	assert.EqualValues(t, 1, st.DeadLettersWritten)
+	assert.EqualValues(t, 1, st.DeadLettersFailed)
+}
+
+func TestExportRaw(t *testing.T) {
+	for _, test := range compressionTests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &mockTransport{}
+			c, err := New(
+				defaultEndpointOption,
+				WithHTTPClient(newMockHTTPClient(transport)),
+				WithAccessToken("ClientToken"),
+			)
+			require.NoError(t, err)
+
+			batches := []*jaegerpb.Batch{
+				{
+					Process: &jaegerpb.Process{ServiceName: "test_service"},
+					Spans:   []*jaegerpb.Span{{}, {}},
+				},
+			}
+			encoding := test.compressionMethod
+			payload, err := (&gen.PostSpansRequest{Batches: batches}).Marshal()
+			require.NoError(t, err)
+			if encoding != CompressionMethodNone {
+				payload = compressBytes(t, payload, encoding)
+			}
+
+			_, err = c.ExportRaw(
+				context.Background(), payload, encoding,
+				WithExportAccessToken("RawToken"), WithExportCounts(1, 2),
+			)
+			require.NoError(t, err)
+
+			requests := transport.requests()
+			require.Len(t, requests, 1)
+			assertRequestEqualBatches(t, requests[0].r, batches)
+			assert.EqualValues(t, encoding, requests[0].r.Header.Get(headerContentEncoding))
+			assert.Equal(t, "RawToken", requests[0].r.Header.Get(headerAccessToken))
+
+			st := c.Stats()
+			assert.EqualValues(t, 2, st.SpansSent)
+			assert.EqualValues(t, len(payload), st.BytesSent)
+		})
+	}
+}
+
+func TestExportRawErrors(t *testing.T) {
+	transport := &mockTransport{
+		statusCode: 429,
+		headers: map[string]string{
+			"Retry-After": "100",
+		},
+	}
+	c, err := New(defaultEndpointOption, WithHTTPClient(newMockHTTPClient(transport)))
+	require.NoError(t, err)
+
+	_, err = c.ExportRaw(context.Background(), []byte{}, "compress")
+	serr := &ErrSend{}
+	require.ErrorAs(t, err, &serr)
+	assert.True(t, serr.Permanent)
+	assert.ErrorIs(t, err, ErrUnsupportedEncoding)
+	assert.NotErrorIs(t, err, ErrMarshal)
+	assert.Equal(t, codes.InvalidArgument, GRPCStatusFromError(err).Code())
+	assert.Empty(t, transport.requests())
+
+	_, err = c.ExportRaw(context.Background(), []byte{}, CompressionMethodNone)
+	require.ErrorAs(t, err, &serr)
+	assert.Equal(t, 100, serr.RetryDelaySeconds)
+	assert.ErrorIs(t, err, ErrThrottled)
+	assert.Eventually(t, func() bool { return c.Stats().Paused }, time.Second, 10*time.Millisecond)
+	c.Stop()
+}
+
+func TestStatusMappings(t *testing.T) {
+	assert.Equal(t, codes.OK, GRPCCodeFromHTTP(204))
+	assert.Equal(t, codes.Unauthenticated, GRPCCodeFromHTTP(401))
+	assert.Equal(t, codes.ResourceExhausted, GRPCCodeFromHTTP(429))
+	assert.Equal(t, codes.InvalidArgument, GRPCCodeFromHTTP(400))
+	assert.Equal(t, codes.Unavailable, GRPCCodeFromHTTP(503))
+	assert.Equal(t, codes.Internal, GRPCCodeFromHTTP(500))
+
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		httpCode := HTTPStatusFromGRPC(code)
+		assert.NotZero(t, httpCode)
+		if code == codes.ResourceExhausted || code == codes.Unauthenticated || code == codes.Unavailable {
+			assert.Equal(t, code, GRPCCodeFromHTTP(httpCode))
+		}
+	}
+	assert.Equal(t, 500, HTTPStatusFromGRPC(codes.Code(100)))
+
+	assert.Equal(t, otelcodes.Unset, SpanStatusFromHTTP(200, trace.SpanKindClient))
+	assert.Equal(t, otelcodes.Error, SpanStatusFromHTTP(404, trace.SpanKindClient))
+	assert.Equal(t, otelcodes.Unset, SpanStatusFromHTTP(404, trace.SpanKindServer))
+	assert.Equal(t, otelcodes.Error, SpanStatusFromHTTP(503, trace.SpanKindServer))
+	assert.Equal(t, otelcodes.Error, SpanStatusFromHTTP(0, trace.SpanKindServer))
+
+	assert.Equal(t, codes.OK, GRPCStatusFromError(nil).Code())
+	assert.Equal(t, codes.ResourceExhausted, GRPCStatusFromError(&ErrSend{Err: errors.New("429"), StatusCode: 429}).Code())
+	assert.Equal(t, codes.Unavailable, GRPCStatusFromError(&ErrSend{Err: errors.New("refused"), network: true}).Code())
+	assert.Equal(
+		t, codes.DeadlineExceeded,
+		GRPCStatusFromError(&ErrSend{Err: context.DeadlineExceeded, network: true}).Code(),
+	)
+	assert.Equal(t, codes.Canceled, GRPCStatusFromError(&ErrSend{Err: context.Canceled, network: true}).Code())
+	assert.Equal(t, codes.InvalidArgument, GRPCStatusFromError(&ErrSend{Err: errors.New("bad"), marshal: true}).Code())
+	assert.Equal(t, codes.Unknown, GRPCStatusFromError(errors.New("other")).Code())
+}
+
+func TestProcessors(t *testing.T) {
+	transport := &mockTransport{}
+	c, err := New(
+		defaultEndpointOption,
+		WithHTTPClient(newMockHTTPClient(transport)),
+		WithProcessors(processor.AddAttributes(processor.TargetProcess, jaegerpb.String("deployment.environment", "prod"))),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Export(context.Background(), []*jaegerpb.Batch{
+		{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{{}}},
+	}))
+	requests := transport.requests()
+	require.Len(t, requests, 1)
+	assertRequestEqualBatches(t, requests[0].r, []*jaegerpb.Batch{
+		{
+			Process: &jaegerpb.Process{
+				ServiceName: "svc",
+				Tags:        []jaegerpb.KeyValue{jaegerpb.String("deployment.environment", "prod")},
+			},
+			Spans: []*jaegerpb.Span{{}},
+		},
+	})
+
+	// Processor failures drop the batches like any other permanent failure.
+	observer := &recordingObserver{}
+	sink := &memoryDeadLetterSink{}
+	c, err = New(
+		defaultEndpointOption,
+		WithHTTPClient(newMockHTTPClient(transport)),
+		WithObserver(observer),
+		WithDeadLetterSink(sink),
+		WithProcessors(processor.Func(func(context.Context, []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+			return nil, errors.New("failed")
+		})),
+	)
+	require.NoError(t, err)
+	batches := []*jaegerpb.Batch{{Spans: []*jaegerpb.Span{{}}}}
+	err = c.Export(context.Background(), batches)
+	serr := &ErrSend{}
+	require.ErrorAs(t, err, &serr)
+	assert.True(t, serr.Permanent)
+	assert.EqualValues(t, 1, serr.Spans)
+	assert.Equal(t, []*ErrSend{serr}, observer.failures)
+	assert.Equal(t, []DropReason{DropReasonInvalidRequest}, observer.drops)
+	assert.EqualValues(t, 1, c.Stats().SpansDropped)
+	require.Len(t, sink.letters, 1)
+	assert.Equal(t, batches, sink.letters[0].Batches)
+	assert.Same(t, serr, sink.letters[0].Err)
+
+	transport = &mockTransport{}
+	c, err = New(
+		defaultEndpointOption,
+		WithHTTPClient(newMockHTTPClient(transport)),
+		WithProcessors(processor.Func(func(context.Context, []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+			return nil, nil
+		})),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Export(context.Background(), []*jaegerpb.Batch{{Spans: []*jaegerpb.Span{{}}}}))
+	assert.Empty(t, transport.requests())
+}
+
+func TestShadowEndpoint(t *testing.T) {
+	primary := &mockTransport{statusCode: http.StatusOK}
+	primaryServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		primary.record(r)
+	}))
+	defer primaryServer.Close()
+
+	release := make(chan struct{})
+	shadowRequests := make(chan *http.Request, 10)
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+		psr, err := sapmprotocol.ParseTraceV2Request(r)
+		if assert.NoError(t, err) {
+			assert.Len(t, psr.Batches, 1)
+		}
+		shadowRequests <- r
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadowServer.Close()
+
+	_, err := New(WithEndpoint(primaryServer.URL), WithShadowEndpoint("", "", 1))
+	require.Error(t, err)
+	_, err = New(WithEndpoint(primaryServer.URL), WithShadowEndpoint(shadowServer.URL, "", 2))
+	require.Error(t, err)
+
+	c, err := New(
+		WithEndpoint(primaryServer.URL),
+		WithAccessToken("primary"),
+		WithWorkers(1),
+		WithShadowEndpoint(shadowServer.URL, "shadow", 1),
+	)
+	require.NoError(t, err)
+
+	batches := []*jaegerpb.Batch{{
+		Process: &jaegerpb.Process{ServiceName: "svc"},
+		Spans:   []*jaegerpb.Span{{TraceID: jaegerpb.TraceID{Low: 1}, SpanID: 1}},
+	}}
+
+	// The shadow endpoint blocks, but the primary requests go through.
+	require.NoError(t, c.Export(context.Background(), batches))
+	require.NoError(t, c.Export(context.Background(), batches))
+	assert.Len(t, primary.requests(), 2)
+	assert.EqualValues(t, 1, c.Stats().ShadowSkipped)
+
+	close(release)
+	r := <-shadowRequests
+	assert.Equal(t, "shadow", r.Header.Get(headerAccessToken))
+	assert.Eventually(t, func() bool { return c.Stats().ShadowFailed == 1 }, time.Second, time.Millisecond)
+
+	st := c.Stats()
+	assert.EqualValues(t, 2, st.SpansSent)
+	assert.Empty(t, st.FailuresByStatusCode)
+	assert.Zero(t, st.ShadowSent)
+	c.Stop()
+
+	// Nothing is mirrored with a ratio of 0.
+	c, err = New(WithEndpoint(primaryServer.URL), WithShadowEndpoint(shadowServer.URL, "", 0))
+	require.NoError(t, err)
+	require.NoError(t, c.Export(context.Background(), batches))
+	c.Stop()
+	assert.Empty(t, shadowRequests)
+	st = c.Stats()
+	assert.Zero(t, st.ShadowSent+st.ShadowFailed+st.ShadowSkipped)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	var keys []string
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/moved", func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, sapmprotocol.TraceEndpointV2, http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc(sapmprotocol.TraceEndpointV2, func(rw http.ResponseWriter, r *http.Request) {
+		_, err := sapmprotocol.ParseTraceV2Request(r)
+		assert.NoError(t, err)
+		mu.Lock()
+		keys = append(keys, r.Header.Get(sapmprotocol.IdempotencyKeyHeaderName))
+		fail := len(keys) == 1
+		mu.Unlock()
+		if fail {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c, err := New(WithEndpoint(server.URL + "/moved"))
+	require.NoError(t, err)
+	batches := []*jaegerpb.Batch{{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{{}}}}
+
+	err = c.Export(context.Background(), batches)
+	serr := &ErrSend{}
+	require.ErrorAs(t, err, &serr)
+	require.NotEmpty(t, serr.IdempotencyKey)
+
+	// Retrying with the key of the failure sends the same key, through the redirect.
+	require.NoError(t, c.Export(ContextWithIdempotencyKey(context.Background(), serr.IdempotencyKey), batches))
+	// A new request gets a new key.
+	require.NoError(t, c.Export(context.Background(), batches))
+
+	_, err = c.ExportRaw(ContextWithIdempotencyKey(context.Background(), "raw"), compressBytes(t, []byte{}, CompressionMethodGzip), CompressionMethodGzip)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, keys, 4)
+	assert.Equal(t, serr.IdempotencyKey, keys[0])
+	assert.Equal(t, serr.IdempotencyKey, keys[1])
+	assert.NotEqual(t, serr.IdempotencyKey, keys[2])
+	assert.NotEmpty(t, keys[2])
+	assert.Equal(t, "raw", keys[3])
+}
+
+func TestTraceHandlerRoundTrip(t *testing.T) {
+	var consumerErr error
+	var received []*jaegerpb.Batch
+	var token string
+	mux := http.NewServeMux()
+	mux.Handle(sapmprotocol.TraceEndpointV2, sapmprotocol.NewTraceHandler(
+		func(_ context.Context, psr *gen.PostSpansRequest, t string) error {
+			received, token = psr.Batches, t
+			return consumerErr
+		},
+	))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c, err := New(WithEndpoint(server.URL+sapmprotocol.TraceEndpointV2), WithAccessToken("token"))
+	require.NoError(t, err)
+	batches := []*jaegerpb.Batch{{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{{}}}}
+
+	resp, err := c.ExportWithAccessTokenAndGetResponse(context.Background(), batches, "")
+	require.NoError(t, err)
+	require.NoError(t, resp.Err)
+	require.NoError(t, (&gen.PostSpansResponse{}).Unmarshal(resp.Body))
+	assert.Equal(t, &gen.PostSpansResponse{AcceptedSpans: 1}, resp.Response)
+	assert.Equal(t, batches, received)
+	assert.Equal(t, "token", token)
+
+	consumerErr = sapmprotocol.PermanentError(errors.New("invalid"))
+	err = c.Export(context.Background(), batches)
+	assert.ErrorIs(t, err, ErrBadRequest)
+	serr := &ErrSend{}
+	require.ErrorAs(t, err, &serr)
+	assert.True(t, serr.Permanent)
+	assert.Contains(t, serr.ResponseExcerpt, "invalid")
+
+	consumerErr = sapmprotocol.UnavailableError(errors.New("down"), time.Second)
+	err = c.Export(context.Background(), batches)
+	require.ErrorAs(t, err, &serr)
+	assert.ErrorIs(t, err, ErrServer)
+	assert.False(t, serr.Permanent)
+
+	consumerErr = sapmprotocol.ThrottledError(errors.New("slow down"), time.Second)
+	err = c.Export(context.Background(), batches)
+	require.ErrorAs(t, err, &serr)
+	assert.ErrorIs(t, err, ErrThrottled)
+	assert.False(t, serr.Permanent)
+	assert.Equal(t, 1, serr.RetryDelaySeconds)
+}
+
+func TestJSONEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "uncompressed", opts: []Option{WithDisabledCompression()}},
+		{name: "gzip", opts: []Option{WithCompressionMethod(CompressionMethodGzip)}},
+		{name: "stacked", opts: []Option{WithCompressionMethod("gzip, zstd")}},
+		{name: "not streamed", opts: []Option{WithStreamingThreshold(1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received []*jaegerpb.Batch
+			var contentType string
+			handler := sapmprotocol.NewTraceHandler(func(_ context.Context, psr *gen.PostSpansRequest, _ string) error {
+				received = psr.Batches
+				return nil
+			})
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				contentType = req.Header.Get("Content-Type")
+				assert.NotEqual(t, int64(-1), req.ContentLength)
+				handler.ServeHTTP(rw, req)
+			}))
+			defer server.Close()
+
+			c, err := New(append(tt.opts, WithEndpoint(server.URL), WithJSONEncoding())...)
+			require.NoError(t, err)
+			batches := testhelpers.CreateSapmData(10).Batches
+
+			resp, err := c.ExportWithAccessTokenAndGetResponse(context.Background(), batches, "")
+			require.NoError(t, err)
+			assert.Equal(t, sapmprotocol.ContentTypeJSONHeaderValue, contentType)
+			assert.Equal(t, batches, received)
+			require.NoError(t, sapmprotocol.UnmarshalJSON(resp.Body, &gen.PostSpansResponse{}))
+			assert.Equal(t, &gen.PostSpansResponse{AcceptedSpans: 10}, resp.Response)
+		})
+	}
+}
+
+// newGRPCServer serves a SapmService passing the requests to consumer on an in-memory listener and returns the
+// options connecting a client to it.
+func newGRPCServer(t *testing.T, consumer sapmprotocol.ConsumerFunc) []Option {
+	return serveGRPC(t, WithGRPC, func(s *grpc.Server) {
+		gen.RegisterSapmServiceServer(s, sapmprotocol.NewGRPCServer(consumer))
+	})
+}
+
+// serveGRPC serves the services registered by register on an in-memory listener and returns the options connecting
+// a client to it with the gRPC mode option.
+func serveGRPC(
+	t *testing.T, mode func(...grpc.DialOption) Option, register func(*grpc.Server), opts ...grpc.ServerOption,
+) []Option {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(opts...)
+	register(server)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+	return []Option{
+		WithEndpoint("passthrough:///bufnet"),
+		mode(
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		),
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	var received []*jaegerpb.Batch
+	var token, idempotencyKey string
+	var consumerErr error
+	opts := newGRPCServer(t, func(ctx context.Context, psr *gen.PostSpansRequest, tok string) error {
+		received, token = psr.Batches, tok
+		if keys := metadata.ValueFromIncomingContext(ctx, sapmprotocol.IdempotencyKeyMetadataKey); len(keys) > 0 {
+			idempotencyKey = keys[0]
+		}
+		return consumerErr
+	})
+	batches := testhelpers.CreateSapmData(5).Batches
+
+	for _, compression := range []Option{
+		WithDisabledCompression(),
+		WithCompressionMethod(CompressionMethodGzip),
+		WithCompressionMethod(CompressionMethodZstd),
+		WithCompressionMethod(CompressionMethodSnappy),
+		WithStreamingThreshold(1),
+	} {
+		c, err := New(append([]Option{WithAccessToken("token"), compression}, opts...)...)
+		require.NoError(t, err)
+		resp, err := c.ExportWithAccessTokenAndGetResponse(
+			ContextWithIdempotencyKey(context.Background(), "key"), batches, "",
+		)
+		require.NoError(t, err)
+		require.NoError(t, (&gen.PostSpansResponse{}).Unmarshal(resp.Body))
+		assert.Equal(t, &gen.PostSpansResponse{AcceptedSpans: 5}, resp.Response)
+		assert.Equal(t, batches, received)
+		assert.Equal(t, "token", token)
+		assert.Equal(t, "key", idempotencyKey)
+		c.Stop()
+	}
+
+	c, err := New(opts...)
+	require.NoError(t, err)
+	defer c.Stop()
+
+	// Raw payloads are decompressed before being sent.
+	payload, err := (&gen.PostSpansRequest{Batches: batches}).Marshal()
+	require.NoError(t, err)
+	_, err = c.ExportRaw(context.Background(), compressBytes(t, payload, CompressionMethodZstd), CompressionMethodZstd,
+		WithExportAccessToken("raw"))
+	require.NoError(t, err)
+	assert.Equal(t, batches, received)
+	assert.Equal(t, "raw", token)
+
+	_, err = c.ExportRaw(context.Background(), []byte("not zstd"), CompressionMethodZstd)
+	assert.ErrorIs(t, err, ErrMarshal)
+
+	consumerErr = sapmprotocol.PermanentError(errors.New("invalid"))
+	err = c.Export(context.Background(), batches)
+	assert.ErrorIs(t, err, ErrBadRequest)
+	serr := &ErrSend{}
+	require.ErrorAs(t, err, &serr)
+	assert.True(t, serr.Permanent)
+	assert.Equal(t, "invalid", serr.ResponseExcerpt)
+
+	consumerErr = sapmprotocol.UnavailableError(errors.New("down"), time.Second)
+	err = c.Export(context.Background(), batches)
+	require.ErrorAs(t, err, &serr)
+	assert.ErrorIs(t, err, ErrServer)
+	assert.False(t, serr.Permanent)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	err = c.Export(ctx, batches)
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	consumerErr = sapmprotocol.ThrottledError(errors.New("slow down"), 1500*time.Millisecond)
+	err = c.Export(context.Background(), batches)
+	require.ErrorAs(t, err, &serr)
+	assert.ErrorIs(t, err, ErrThrottled)
+	assert.False(t, serr.Permanent)
+	assert.Equal(t, 2, serr.RetryDelaySeconds)
+}
+
+func TestIngestResponse(t *testing.T) {
+	partial := &sapmprotocol.PartialSuccessError{
+		Message:         "invalid spans",
+		RejectedBatches: []*gen.BatchRejection{{BatchIndex: 0, RejectedSpans: 2, Reason: "too old"}},
+	}
+	want := &gen.PostSpansResponse{
+		AcceptedSpans:   3,
+		RejectedSpans:   2,
+		ErrorMessage:    "invalid spans",
+		RejectedBatches: partial.RejectedBatches,
+	}
+	consumer := func(context.Context, *gen.PostSpansRequest, string) error { return partial }
+	server := httptest.NewServer(sapmprotocol.NewTraceHandler(consumer))
+	defer server.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		_, _ = rw.Write([]byte("OK"))
+	}))
+	defer plain.Close()
+
+	tests := []struct {
+		name string
+		opts []Option
+		want *gen.PostSpansResponse
+	}{
+		{name: "protobuf", opts: []Option{WithEndpoint(server.URL)}, want: want},
+		{name: "json", opts: []Option{WithEndpoint(server.URL), WithJSONEncoding()}, want: want},
+		{name: "grpc", opts: newGRPCServer(t, consumer), want: want},
+		{name: "not a response", opts: []Option{WithEndpoint(plain.URL)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(tt.opts...)
+			require.NoError(t, err)
+			defer c.Stop()
+
+			// Partially accepted requests are not failures.
+			resp, err := c.ExportWithAccessTokenAndGetResponse(context.Background(), testhelpers.CreateSapmData(5).Batches, "")
+			require.NoError(t, err)
+			require.NoError(t, resp.Err)
+			assert.Equal(t, tt.want, resp.Response)
+		})
+	}
+}
+
+func TestJaegerGRPC(t *testing.T) {
+	var mu sync.Mutex
+	var received []*jaegerpb.Batch
+	var tokens []string
+	opts := serveGRPC(t, WithJaegerGRPC, func(s *grpc.Server) {
+		api_v2.RegisterCollectorServiceServer(s, sapmprotocol.NewJaegerCollectorServer(
+			func(_ context.Context, psr *gen.PostSpansRequest, token string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received = append(received, psr.Batches...)
+				tokens = append(tokens, token)
+				if len(received) > 3 {
+					return sapmprotocol.PermanentError(errors.New("invalid"))
+				}
+				return nil
+			},
+		))
+	})
+	c, err := New(append(opts, WithAccessToken("token"))...)
+	require.NoError(t, err)
+	defer c.Stop()
+
+	batches := []*jaegerpb.Batch{
+		testhelpers.CreateSapmData(3).Batches[0],
+		{Process: &jaegerpb.Process{ServiceName: "other"}, Spans: []*jaegerpb.Span{{OperationName: "op"}}},
+		{Spans: []*jaegerpb.Span{{}}},
+	}
+	require.NoError(t, c.Export(context.Background(), batches))
+	mu.Lock()
+	assert.Equal(t, batches, received)
+	assert.Equal(t, []string{"token", "token", "token"}, tokens)
+	mu.Unlock()
+
+	// The export stops at the first batch rejected.
+	err = c.Export(context.Background(), batches)
+	assert.ErrorIs(t, err, ErrBadRequest)
+	mu.Lock()
+	assert.Len(t, received, 4)
+	mu.Unlock()
+}
+
+func TestJaegerGRPCIdempotency(t *testing.T) {
+	var mu sync.Mutex
+	var received []*jaegerpb.Batch
+	var keys []string
+	cache := sapmprotocol.NewIdempotencyCache(time.Minute, 10)
+	opts := serveGRPC(t, WithJaegerGRPC, func(s *grpc.Server) {
+		api_v2.RegisterCollectorServiceServer(s, sapmprotocol.NewJaegerCollectorServer(
+			func(ctx context.Context, psr *gen.PostSpansRequest, _ string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received = append(received, psr.Batches...)
+				keys = append(keys, metadata.ValueFromIncomingContext(ctx, sapmprotocol.IdempotencyKeyMetadataKey)...)
+				return nil
+			},
+		))
+	}, grpc.UnaryInterceptor(cache.UnaryServerInterceptor()))
+	c, err := New(opts...)
+	require.NoError(t, err)
+	defer c.Stop()
+
+	batches := []*jaegerpb.Batch{
+		testhelpers.CreateSapmData(3).Batches[0],
+		{Process: &jaegerpb.Process{ServiceName: "other"}, Spans: []*jaegerpb.Span{{OperationName: "op"}}},
+		{Spans: []*jaegerpb.Span{{}}},
+	}
+	ctx := ContextWithIdempotencyKey(context.Background(), "key")
+	require.NoError(t, c.Export(ctx, batches))
+	mu.Lock()
+	assert.Equal(t, batches, received)
+	assert.Equal(t, []string{"key-0", "key-1", "key-2"}, keys)
+	mu.Unlock()
+
+	// A retry of the export is answered from the cache.
+	require.NoError(t, c.Export(ctx, batches))
+	mu.Lock()
+	assert.Len(t, received, 3)
+	mu.Unlock()
+}
+
+func TestGRPCInvalidOptions(t *testing.T) {
+	_, err := New(WithEndpoint("localhost:443"), WithGRPC(), WithJSONEncoding())
+	assert.Error(t, err)
+	_, err = New(WithEndpoint("localhost:443"), WithGRPC(), WithCompressionMethod("gzip, zstd"))
+	assert.Error(t, err)
+	// Encodings registered after init are not gRPC compressors.
+	sapmprotocol.RegisterEncoding("x-grpc-test", func() sapmprotocol.Decompressor { return nil },
+		func() (sapmprotocol.Compressor, error) { return nil, errors.New("unused") })
+	_, err = New(WithEndpoint("localhost:443"), WithGRPC(), WithCompressionMethod("x-grpc-test"))
+	assert.Error(t, err)
+	c, err := New(WithEndpoint("localhost:443"), WithGRPC(), WithCompressionMethod(CompressionMethodBrotli))
+	require.NoError(t, err)
+	c.Stop()
+
+	c, err = New(WithEndpoint("localhost:443"), WithGRPC(), WithDisabledCompression())
+	require.NoError(t, err)
+	c.Stop()
+}
@@ -0,0 +1,155 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+
+	sapmpb "github.com/signalfx/sapm-proto/gen"
+)
+
+const (
+	deadLetterPayloadExt  = ".pb"
+	deadLetterMetadataExt = ".json"
+)
+
+// DeadLetter is a request the client dropped because it failed permanently.
+type DeadLetter struct {
+	// Time is when the request was dropped.
+	Time time.Time
+	// Batches are the batches that were not delivered. They are the batches passed to Export once run through the
+	// processors and the validation of the client, and only those of the requests that were not accepted when the export
+	// was split to fit the size limits of the endpoint. They are the batches passed to Export if the processors
+	// failed.
+	Batches []*jaegerpb.Batch
+	// ResponseBody is the body returned by the server, if a response was received.
+	ResponseBody []byte
+	// Err is the error returned to the caller of Export.
+	Err *ErrSend
+}
+
+// DeadLetterSink receives the requests the client permanently dropped so they can be inspected and replayed later.
+// Write is called synchronously from Export and must be safe for concurrent use.
+type DeadLetterSink interface {
+	Write(ctx context.Context, letter *DeadLetter) error
+}
+
+// FileDeadLetterSink is a DeadLetterSink that stores every dead letter in a directory as a pair of files:
+// the batches of the letter encoded as an uncompressed SAPM PostSpansRequest (.pb) and the failure details (.json).
+type FileDeadLetterSink struct {
+	dir string
+	seq atomic.Uint64
+}
+
+var _ DeadLetterSink = (*FileDeadLetterSink)(nil)
+
+type deadLetterMetadata struct {
+	Time         time.Time `json:"time"`
+	StatusCode   int       `json:"status_code"`
+	Error        string    `json:"error"`
+	ResponseBody []byte    `json:"response_body,omitempty"`
+}
+
+// NewFileDeadLetterSink creates a FileDeadLetterSink writing to dir. The directory is created if it does not exist.
+func NewFileDeadLetterSink(dir string) (*FileDeadLetterSink, error) {
+	if dir == "" {
+		return nil, errors.New("dead letter directory cannot be empty")
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create dead letter directory: %w", err)
+	}
+	return &FileDeadLetterSink{dir: dir}, nil
+}
+
+// Write stores the letter in the sink directory. The payload file is written last so that readers only see complete
+// dead letters when they look for payload files.
+func (s *FileDeadLetterSink) Write(_ context.Context, letter *DeadLetter) error {
+	payload, err := (&sapmpb.PostSpansRequest{Batches: letter.Batches}).Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+
+	md := deadLetterMetadata{
+		Time:         letter.Time,
+		ResponseBody: letter.ResponseBody,
+	}
+	if letter.Err != nil {
+		md.StatusCode = letter.Err.StatusCode
+		md.Error = letter.Err.Error()
+	}
+	metadata, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter metadata: %w", err)
+	}
+
+	base := filepath.Join(
+		s.dir,
+		"dead-letter-"+strconv.FormatInt(letter.Time.UnixNano(), 10)+"-"+strconv.FormatUint(s.seq.Add(1), 10),
+	)
+	if err := os.WriteFile(base+deadLetterMetadataExt, metadata, 0o600); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := os.WriteFile(base+deadLetterPayloadExt, payload, 0o600); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	return nil
+}
+
+// ReadFileDeadLetter reads a dead letter written by FileDeadLetterSink. The path may point to either of its files.
+func ReadFileDeadLetter(path string) (*DeadLetter, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(path, deadLetterPayloadExt), deadLetterMetadataExt)
+
+	payload, err := os.ReadFile(base + deadLetterPayloadExt)
+	if err != nil {
+		return nil, err
+	}
+	psr := &sapmpb.PostSpansRequest{}
+	if err = psr.Unmarshal(payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dead letter: %w", err)
+	}
+
+	metadata, err := os.ReadFile(base + deadLetterMetadataExt)
+	if err != nil {
+		return nil, err
+	}
+	md := deadLetterMetadata{}
+	if err = json.Unmarshal(metadata, &md); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dead letter metadata: %w", err)
+	}
+
+	return &DeadLetter{
+		Time:         md.Time,
+		Batches:      psr.Batches,
+		ResponseBody: md.ResponseBody,
+		Err: &ErrSend{
+			Err:             errors.New(md.Error),
+			StatusCode:      md.StatusCode,
+			Permanent:       true,
+			ResponseExcerpt: responseExcerpt(md.ResponseBody),
+			Spans:           int64(countSpans(psr.Batches)),
+		},
+	}, nil
+}
@@ -14,14 +14,120 @@
 
 package client
 
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"unicode/utf8"
+)
+
+// maxResponseExcerpt is the maximum number of bytes of the response body kept in ErrSend.ResponseExcerpt.
+const maxResponseExcerpt = 512
+
+// Sentinel errors that can be matched against the errors returned by the client with errors.Is.
+// The returned error is always an *ErrSend holding the details of the failure.
+var (
+	// ErrBadRequest matches requests the server rejected as malformed (400).
+	ErrBadRequest = errors.New("sapm: bad request")
+	// ErrUnauthorized matches requests the server rejected because of the access token (401).
+	ErrUnauthorized = errors.New("sapm: unauthorized")
+	// ErrForbidden matches requests the server refused to accept from the access token (403). Unlike ErrUnauthorized,
+	// they are retried: the permissions of the token may be granted later.
+	ErrForbidden = errors.New("sapm: forbidden")
+	// ErrPayloadTooLarge matches requests the server rejected because of their size (413).
+	ErrPayloadTooLarge = errors.New("sapm: payload too large")
+	// ErrThrottled matches requests the server asked to retry later (429).
+	ErrThrottled = errors.New("sapm: throttled")
+	// ErrServer matches requests the server failed to process (5xx).
+	ErrServer = errors.New("sapm: server error")
+	// ErrMarshal matches requests the client failed to encode.
+	ErrMarshal = errors.New("sapm: failed to encode request")
+	// ErrUnsupportedEncoding matches requests exported with a Content-Encoding that is not registered.
+	ErrUnsupportedEncoding = errors.New("sapm: unsupported content encoding")
+	// ErrNetwork matches requests that did not get a response from the server, including timeouts.
+	ErrNetwork = errors.New("sapm: network error")
+	// ErrTimeout matches requests that did not get a response from the server in time.
+	ErrTimeout = errors.New("sapm: timeout")
+)
+
 // ErrSend is returned by the HTTP sender when it fails to complete a request for any reason.
+// It matches the sentinel errors of this package according to the failure, and unwraps to the underlying error.
 type ErrSend struct {
-	Err               error
-	StatusCode        int
+	Err error
+	// StatusCode is the HTTP status code returned by the server, 0 if no response was received.
+	StatusCode int
+	// Permanent is true if the request must not be retried.
 	Permanent         bool
 	RetryDelaySeconds int
+	// ResponseExcerpt holds the beginning of the response body, if any.
+	ResponseExcerpt string
+	// Spans is the number of spans in the failed request, if known.
+	Spans int64
+	// IdempotencyKey is the idempotency key of the failed request. Pass it to ContextWithIdempotencyKey when
+	// retrying the request.
+	IdempotencyKey string
+
+	// marshal is set when the request could not be encoded.
+	marshal bool
+	// unsupportedEncoding is set when the Content-Encoding of the request is not registered.
+	unsupportedEncoding bool
+	// network is set when the request failed before a response was received.
+	network bool
 }
 
 func (e *ErrSend) Error() string {
 	return e.Err.Error()
 }
+
+// Unwrap returns the underlying error.
+func (e *ErrSend) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error matches one of the sentinel errors of this package.
+func (e *ErrSend) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrPayloadTooLarge:
+		return e.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrThrottled:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500 && e.StatusCode <= 599
+	case ErrMarshal:
+		return e.marshal
+	case ErrUnsupportedEncoding:
+		return e.unsupportedEncoding
+	case ErrNetwork:
+		return e.network
+	case ErrTimeout:
+		return e.network && isTimeout(e.Err)
+	}
+	return false
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// responseExcerpt returns at most maxResponseExcerpt bytes of body, cut at a valid UTF-8 boundary.
+func responseExcerpt(body []byte) string {
+	if len(body) <= maxResponseExcerpt {
+		return string(body)
+	}
+	body = body[:maxResponseExcerpt]
+	for len(body) > 0 && !utf8.Valid(body) {
+		body = body[:len(body)-1]
+	}
+	return string(body)
+}
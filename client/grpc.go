@@ -0,0 +1,174 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/signalfx/sapm-proto/sapmprotocol"
+)
+
+// jaegerBatchKey is the key of the batch field of the Jaeger PostSpansRequest: field 1, length-delimited.
+const jaegerBatchKey = 1<<3 | 2
+
+// rawMessage is a request or response that is already encoded.
+type rawMessage []byte
+
+// rawCodec sends the requests encoded by the workers as is, instead of marshaling them again.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(rawMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return m, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(*rawMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// Name is the name of the default gRPC codec, so that servers decode the requests with their protobuf codec.
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// sendGRPC sends a prepared request with the SapmService.PostSpans gRPC method. The compression of the request is
+// left to gRPC, requests exported with ExportRaw are decompressed first.
+func (w *worker) sendGRPC(ctx context.Context, r *sendRequest, accessToken string) (*IngestResponse, *ErrSend) {
+	message := r.message
+	if r.encoding != "" {
+		var err error
+		if message, err = decodeMessage(r); err != nil {
+			return nil, &ErrSend{Err: err, Permanent: true, Spans: r.spans, marshal: true}
+		}
+	}
+
+	if accessToken == "" {
+		accessToken = w.accessToken
+	}
+	if accessToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, sapmprotocol.TokenMetadataKey, accessToken)
+	}
+
+	opts := []grpc.CallOption{grpc.ForceCodec(rawCodec{})}
+	if w.grpcCompression != "" {
+		opts = append(opts, grpc.UseCompressor(string(w.grpcCompression)))
+	}
+	if w.grpcJaeger {
+		return w.sendJaeger(ctx, message, r.spans, opts)
+	}
+	if key := IdempotencyKeyFromContext(ctx); key != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, sapmprotocol.IdempotencyKeyMetadataKey, key)
+	}
+	var resp rawMessage
+	err := w.grpcConn.Invoke(ctx, sapmprotocol.GRPCPostSpansMethod, rawMessage(message), &resp, opts...)
+	if err != nil {
+		return nil, grpcSendError(err, r.spans)
+	}
+	return &IngestResponse{Body: resp, Response: decodeResponse(resp, sapmprotocol.ContentTypeProtobufHeaderValue)}, nil
+}
+
+// sendJaeger sends the batches of an encoded PostSpansRequest with the Jaeger CollectorService.PostSpans gRPC
+// method, one call per batch. The batches are not decoded: the Jaeger request holding a batch is encoded like a
+// PostSpansRequest holding only that batch. Each call gets its own idempotency key, derived from the key of the
+// export like the keys of the requests of a split export. The calls stop at the first failure, the batches sent before
+// it are not rolled back.
+func (w *worker) sendJaeger(ctx context.Context, message []byte, spans int64, opts []grpc.CallOption) (*IngestResponse, *ErrSend) {
+	summary, err := sapmprotocol.Inspect(message)
+	if err != nil {
+		return nil, &ErrSend{Err: err, Permanent: true, Spans: spans, marshal: true}
+	}
+	key := IdempotencyKeyFromContext(ctx)
+	var req []byte
+	var resp rawMessage
+	for i, batch := range summary.Batches {
+		req = binary.AppendUvarint(append(req[:0], jaegerBatchKey), uint64(batch.Length))
+		req = append(req, message[batch.Offset:batch.Offset+batch.Length]...)
+		callCtx := ctx
+		if key != "" {
+			callCtx = metadata.AppendToOutgoingContext(ctx, sapmprotocol.IdempotencyKeyMetadataKey, fmt.Sprintf("%s-%d", key, i))
+		}
+		if err = w.grpcConn.Invoke(callCtx, sapmprotocol.JaegerPostSpansMethod, rawMessage(req), &resp, opts...); err != nil {
+			return nil, grpcSendError(err, spans)
+		}
+	}
+	return &IngestResponse{Body: resp}, nil
+}
+
+// grpcSendError converts a gRPC error to an ErrSend with the semantics of the matching HTTP status code.
+func grpcSendError(err error, spans int64) *ErrSend {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() == codes.Canceled || st.Code() == codes.DeadlineExceeded {
+		if ok && st.Code() == codes.DeadlineExceeded {
+			err = fmt.Errorf("%w: %s", context.DeadlineExceeded, st.Message())
+		}
+		return &ErrSend{Err: err, Spans: spans, network: true}
+	}
+
+	statusCode := sapmprotocol.HTTPStatusFromGRPC(st.Code())
+	serr := &ErrSend{
+		Err:             fmt.Errorf("server responded with %s: %s", st.Code(), st.Message()),
+		StatusCode:      statusCode,
+		ResponseExcerpt: responseExcerpt([]byte(st.Message())),
+		Spans:           spans,
+	}
+	switch {
+	case permanentStatus(statusCode):
+		serr.Err = fmt.Errorf("dropping request: %w", serr.Err)
+		serr.Permanent = true
+	case statusCode == http.StatusTooManyRequests:
+		serr.RetryDelaySeconds = defaultRateLimitingBackoffSeconds
+		if delay := sapmprotocol.GRPCRetryDelay(st); delay > 0 {
+			serr.RetryDelaySeconds = int((delay + time.Second - 1) / time.Second)
+		}
+	}
+	return serr
+}
+
+// decodeMessage returns the uncompressed content of a request sent with ExportRaw.
+func decodeMessage(r *sendRequest) ([]byte, error) {
+	stack, err := sapmprotocol.ParseContentEncoding(string(r.encoding))
+	if err != nil {
+		return nil, err
+	}
+	reader, release, err := sapmprotocol.NewDecodingReader(bytes.NewReader(r.message), stack)
+	defer release()
+	if err != nil {
+		return nil, err
+	}
+	message, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress request: %w", err)
+	}
+	return message, nil
+}
@@ -0,0 +1,44 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/rand"
+)
+
+type idempotencyKeyContextKey struct{}
+
+// ContextWithIdempotencyKey returns a context making the client send key as the idempotency key of the requests
+// exported with it. Callers retrying a failed export should pass the ErrSend.IdempotencyKey of the failure, so that
+// receivers can detect the requests they already accepted.
+func ContextWithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+// IdempotencyKeyFromContext returns the idempotency key set by ContextWithIdempotencyKey, or an empty string.
+func IdempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	return key
+}
+
+// withIdempotencyKey returns a context holding an idempotency key, generating a new one if ctx has none.
+func withIdempotencyKey(ctx context.Context) (context.Context, string) {
+	if key := IdempotencyKeyFromContext(ctx); key != "" {
+		return ctx, key
+	}
+	key := rand.Text()
+	return ContextWithIdempotencyKey(ctx, key), key
+}
@@ -0,0 +1,65 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// DropReason describes why the client permanently dropped a request.
+type DropReason string
+
+const (
+	// DropReasonInvalidRequest is used when the request could not be processed, encoded or built by the client.
+	DropReasonInvalidRequest DropReason = "invalid_request"
+	// DropReasonRejected is used when the server rejected the request as malformed or unauthorized.
+	DropReasonRejected DropReason = "rejected"
+)
+
+// Observer receives notifications about the decisions the client makes while exporting spans.
+// Callbacks are invoked synchronously from the exporting goroutines, so implementations must be
+// safe for concurrent use and should return quickly.
+type Observer interface {
+	// OnSendStart is called before a request is prepared and sent.
+	OnSendStart(ctx context.Context, batches, spans int64)
+	// OnSendSuccess is called when the server accepted the request.
+	OnSendSuccess(ctx context.Context, batches, spans int64)
+	// OnSendFailure is called for every request that failed, permanently or not.
+	OnSendFailure(ctx context.Context, err *ErrSend)
+	// OnDrop is called when a failed request is permanently dropped and must not be retried.
+	OnDrop(ctx context.Context, reason DropReason, spans int64)
+	// OnRetry is called when a failed request can be retried by the caller,
+	// after err.RetryDelaySeconds if it is set.
+	OnRetry(ctx context.Context, err *ErrSend)
+	// OnPauseStart is called when the client stops handing out workers because the server asked it to back off.
+	OnPauseStart(d time.Duration)
+	// OnPauseEnd is called when a pause is over and the workers are returned to the pool.
+	OnPauseEnd()
+}
+
+// NopObserver is an Observer that ignores all notifications. It can be embedded by implementations
+// that are only interested in some of the callbacks.
+type NopObserver struct{}
+
+var _ Observer = NopObserver{}
+
+func (NopObserver) OnSendStart(context.Context, int64, int64)   {}
+func (NopObserver) OnSendSuccess(context.Context, int64, int64) {}
+func (NopObserver) OnSendFailure(context.Context, *ErrSend)     {}
+func (NopObserver) OnDrop(context.Context, DropReason, int64)   {}
+func (NopObserver) OnRetry(context.Context, *ErrSend)           {}
+func (NopObserver) OnPauseStart(time.Duration)                  {}
+func (NopObserver) OnPauseEnd()                                 {}
@@ -14,6 +14,8 @@
 
 package client
 
+import "github.com/signalfx/sapm-proto/sapmprotocol"
+
 // This code is taken from OpenTelemetry project in order to avoid adding the whole project as a dependency.
 
 // https://github.com/googleapis/googleapis/blob/bee79fbe03254a35db125dc6d2f1e9b752b390fe/google/rpc/code.proto#L33-L186
@@ -41,36 +43,17 @@ const (
 	defaultRateLimitingBackoffSeconds = 8
 	headerAccessToken                 = "X-SF-Token" // nolint:gosec
 	headerRetryAfter                  = "Retry-After"
+	headerIdempotencyKey              = "Idempotency-Key"
 	headerContentEncoding             = "Content-Encoding"
 	headerContentType                 = "Content-Type"
 	headerValueXProtobuf              = "application/x-protobuf"
+	headerValueJSON                   = "application/json"
+	headerProtocolVersion             = "X-SAPM-Version"
 )
 
-var httpToOCCodeMap = map[int32]int32{
-	401: OCUnauthenticated,
-	403: OCPermissionDenied,
-	404: OCNotFound,
-	429: OCResourceExhausted,
-	499: OCCancelled,
-	501: OCUnimplemented,
-	503: OCUnavailable,
-	504: OCDeadlineExceeded,
-}
-
 // OCStatusCodeFromHTTP takes an HTTP status code and return the appropriate OpenTelemetry status code
 // See: https://github.com/open-telemetry/opentelemetry-specification/blob/master/specification/data-http.md
+// The OpenTelemetry status codes share their values with the gRPC status codes returned by GRPCCodeFromHTTP.
 func OCStatusCodeFromHTTP(code int32) int32 {
-	if code >= 100 && code < 400 {
-		return OCOK
-	}
-	if rvCode, ok := httpToOCCodeMap[code]; ok {
-		return rvCode
-	}
-	if code >= 400 && code < 500 {
-		return OCInvalidArgument
-	}
-	if code >= 500 && code < 600 {
-		return OCInternal
-	}
-	return OCUnknown
+	return int32(sapmprotocol.GRPCCodeFromHTTP(int(code)))
 }
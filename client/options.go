@@ -15,17 +15,22 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+
+	"github.com/signalfx/sapm-proto/processor"
+	"github.com/signalfx/sapm-proto/sampling"
 )
 
 // Option takes a reference to a Client and sets relevant config fields on it.
 type Option func(*Client) error
 
 // WithEndpoint takes an HTTP endpoint as a string in the format scheme://address:port/path and configures the
-// client to export all requests to this endpoint.
+// client to export all requests to this endpoint. With WithGRPC, the endpoint is a gRPC target instead.
 func WithEndpoint(endpoint string) Option {
 	return func(a *Client) error {
 		a.endpoint = endpoint
@@ -78,17 +83,47 @@ func WithDisabledCompression() Option {
 // This option is ignored if WithDisabledCompression() is used.
 func WithCompressionMethod(compressionMethod CompressionMethod) Option {
 	return func(a *Client) error {
-		switch compressionMethod {
-		case CompressionMethodGzip, CompressionMethodZstd:
-			a.compressionMethod = compressionMethod
-		default:
+		if !validCompressionMethod(compressionMethod) {
 			return fmt.Errorf("invalid compression method %q", string(compressionMethod))
 		}
+		a.compressionMethod = compressionMethod
+		return nil
+	}
+}
 
+// WithJSONEncoding configures the client to encode the outgoing requests with JSON instead of protobuf, with the
+// application/json content type. JSON requests are larger and slower to encode, they are meant for debugging and
+// for environments where only JSON can be inspected. JSON requests are never streamed.
+func WithJSONEncoding() Option {
+	return func(a *Client) error {
+		a.jsonEncoding = true
 		return nil
 	}
 }
 
+// WithGRPC configures the client to send the requests with the SapmService gRPC service instead of HTTP. The endpoint
+// is used as the gRPC target, such as "ingest.example.com:443". The connection uses TLS unless opts set other
+// transport credentials. The access token is sent in the x-sf-token metadata and the requests are compressed by gRPC
+// with the compression method of the client, which cannot be a stacked encoding. Requests are never streamed, and
+// the shadow endpoint, if any, is still sent over HTTP. JSON encoding is not supported with gRPC.
+func WithGRPC(opts ...grpc.DialOption) Option {
+	return func(a *Client) error {
+		a.useGRPC = true
+		a.grpcDialOptions = append(a.grpcDialOptions, opts...)
+		return nil
+	}
+}
+
+// WithJaegerGRPC configures the client to send the requests to a Jaeger collector, with the api_v2 CollectorService
+// gRPC service. It works like WithGRPC, except that a Jaeger request holds a single batch: the batches of a request
+// are sent one at a time, and the export stops at the first batch that fails.
+func WithJaegerGRPC(opts ...grpc.DialOption) Option {
+	return func(a *Client) error {
+		a.grpcJaeger = true
+		return WithGRPC(opts...)(a)
+	}
+}
+
 // WithTracerProvider returns an Option to use the TracerProvider when
 // creating a Tracer.
 func WithTracerProvider(tracerProvider trace.TracerProvider) Option {
@@ -97,3 +132,103 @@ func WithTracerProvider(tracerProvider trace.TracerProvider) Option {
 		return nil
 	}
 }
+
+// WithObserver configures an Observer that is notified about sends, failures, drops and pauses.
+func WithObserver(observer Observer) Option {
+	return func(a *Client) error {
+		if observer == nil {
+			return fmt.Errorf("observer cannot be nil")
+		}
+		a.observer = observer
+		return nil
+	}
+}
+
+// WithDeadLetterSink configures a DeadLetterSink that receives every request the client permanently drops.
+func WithDeadLetterSink(sink DeadLetterSink) Option {
+	return func(a *Client) error {
+		a.deadLetterSink = sink
+		return nil
+	}
+}
+
+// WithStreamingThreshold configures the client to stream requests whose uncompressed size is larger than n bytes
+// instead of encoding them in memory before sending. Streamed requests are sent with chunked transfer encoding and
+// cannot be replayed by the HTTP client on redirects. Streaming is disabled by default.
+func WithStreamingThreshold(n uint) Option {
+	return func(a *Client) error {
+		a.streamingThreshold = int(n)
+		return nil
+	}
+}
+
+// WithProcessors adds processors that run, in order, on the batches passed to Export before they are validated and
+// sent. Processors may modify the batches in place. An error returned by a processor fails the export, and nothing
+// is sent if the processors leave no batches, so samplers from the sampling package can be used as processors.
+func WithProcessors(processors ...processor.Processor) Option {
+	return func(a *Client) error {
+		a.processors = append(a.processors, processors...)
+		return nil
+	}
+}
+
+// WithShadowEndpoint configures the client to mirror requests to a secondary endpoint, for instance to dual-write
+// while migrating to another ingest cluster. The shadow endpoint receives the traces selected by a probabilistic
+// sampler keeping ratio of them, authenticated with accessToken or with the token of the original request if
+// accessToken is empty. Mirrored requests are sent in the background by a separate pool of workers: they never change
+// the result of Export, never block it and never pause the client. Their outcome is only counted in Stats.
+func WithShadowEndpoint(endpoint, accessToken string, ratio float64) Option {
+	return func(a *Client) error {
+		if endpoint == "" {
+			return errors.New("shadow endpoint cannot be empty")
+		}
+		sampler, err := sampling.NewProbabilistic(ratio)
+		if err != nil {
+			return err
+		}
+		a.shadow = &shadow{endpoint: endpoint, accessToken: accessToken, sampler: sampler}
+		return nil
+	}
+}
+
+// WithValidation configures the client to validate batches before sending them, so that a few invalid spans do not
+// cause the server to reject the whole request. Invalid spans are dropped or repaired according to mode, see
+// ValidateBatches. The issues found in each Export call are passed to report, which may be nil.
+func WithValidation(mode ValidationMode, report ValidationReportFunc) Option {
+	return func(a *Client) error {
+		switch mode {
+		case ValidationModeDrop, ValidationModeRepair:
+		default:
+			return fmt.Errorf("invalid validation mode %d", mode)
+		}
+		a.validate = true
+		a.validationMode = mode
+		a.validationReport = report
+		return nil
+	}
+}
+
+// ExportOption configures a single call to ExportRaw.
+type ExportOption func(*exportOptions)
+
+type exportOptions struct {
+	accessToken string
+	batches     int64
+	spans       int64
+}
+
+// WithExportAccessToken sets the access token used for the request instead of the client's token.
+func WithExportAccessToken(accessToken string) ExportOption {
+	return func(o *exportOptions) {
+		o.accessToken = accessToken
+	}
+}
+
+// WithExportCounts sets the number of batches and spans held by a raw payload. The counts are only used for
+// Stats and Observer notifications, they are zero if the option is not used.
+func WithExportCounts(batches, spans int64) ExportOption {
+	return func(o *exportOptions) {
+		o.batches = batches
+		o.spans = spans
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+
+	"github.com/signalfx/sapm-proto/internal/pool"
+)
+
+const (
+	// batchesFieldKey is the protobuf key of the repeated batches field of PostSpansRequest (field 1, bytes).
+	batchesFieldKey = 0xa
+)
+
+var (
+	errStreamAborted = errors.New("request body stream aborted")
+
+	// Pool of buffers holding encoded requests until the HTTP transport is done with them.
+	payloadPool = &sync.Pool{
+		New: func() interface{} {
+			return &bytes.Buffer{}
+		},
+	}
+)
+
+func getPayloadBuffer() *bytes.Buffer {
+	buf := payloadPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putPayloadBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > pool.MaxBufferSize {
+		return
+	}
+	payloadPool.Put(buf)
+}
+
+// release gives up the reference held by the creator of the request. The pooled buffer backing message is
+// returned to the pool once every request body created from it has been closed by the HTTP transport as well,
+// which may happen after the response was received.
+func (r *sendRequest) release() {
+	if r.buf == nil {
+		return
+	}
+	if r.refs.Add(-1) == 0 {
+		putPayloadBuffer(r.buf)
+	}
+}
+
+// newMessageBody returns a request body reading message that keeps the pooled buffer alive until it is closed.
+func (r *sendRequest) newMessageBody() io.ReadCloser {
+	if r.buf != nil {
+		r.refs.Add(1)
+	}
+	return &messageBody{Reader: bytes.NewReader(r.message), r: r}
+}
+
+// size returns the number of bytes sent on the wire for the request.
+func (r *sendRequest) size() int64 {
+	if r.stream != nil {
+		return r.streamed.Load()
+	}
+	return int64(len(r.message))
+}
+
+type messageBody struct {
+	*bytes.Reader
+	r    *sendRequest
+	once sync.Once
+}
+
+func (b *messageBody) Close() error {
+	b.once.Do(b.r.release)
+	return nil
+}
+
+// streamBody writes the output of a streamed request into a pipe read by the HTTP transport.
+type streamBody struct {
+	*io.PipeReader
+	done chan struct{}
+	// encodeErr is set if the request could not be encoded, as opposed to the body not being read to the end.
+	// It must only be read after finish returned.
+	encodeErr error
+}
+
+func newStreamBody(r *sendRequest) *streamBody {
+	pr, pw := io.Pipe()
+	b := &streamBody{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(b.done)
+		cw := &countingWriter{w: pw, n: &r.streamed}
+		err := r.stream(cw)
+		if err != nil && cw.err == nil {
+			b.encodeErr = err
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return b
+}
+
+// finish stops the stream if the transport did not consume all of it and waits for the writer to exit,
+// so that the worker state used by the stream can be reused safely.
+func (b *streamBody) finish() {
+	_ = b.CloseWithError(errStreamAborted)
+	<-b.done
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   *atomic.Int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// requestSize returns the size of the PostSpansRequest holding the batches, as computed by PostSpansRequest.Size.
+func requestSize(batches []*jaegerpb.Batch) int {
+	n := 0
+	for _, b := range batches {
+		l := b.Size()
+		n += 1 + l + uvarintSize(uint64(l))
+	}
+	return n
+}
+
+// writeBatches encodes the batches as a PostSpansRequest one batch at a time, so that the whole uncompressed
+// request never needs to be held in memory. scratch is reused between batches and the grown slice is returned
+// along with the number of bytes written.
+func writeBatches(dst io.Writer, batches []*jaegerpb.Batch, scratch []byte) ([]byte, int, error) {
+	written := 0
+	for _, b := range batches {
+		size := b.Size()
+		n := 1 + uvarintSize(uint64(size)) + size
+		if cap(scratch) < n {
+			scratch = make([]byte, n)
+		}
+		buf := scratch[:n]
+		buf[0] = batchesFieldKey
+		offset := 1 + binary.PutUvarint(buf[1:], uint64(size))
+		if _, err := b.MarshalToSizedBuffer(buf[offset:]); err != nil {
+			return scratch, written, err
+		}
+		if _, err := dst.Write(buf); err != nil {
+			return scratch, written, err
+		}
+		written += n
+	}
+	if cap(scratch) > pool.MaxBufferSize {
+		scratch = nil
+	}
+	return scratch, written, nil
+}
+
+func uvarintSize(x uint64) int {
+	return (bits.Len64(x|1) + 6) / 7
+}
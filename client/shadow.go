@@ -0,0 +1,76 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+
+	"github.com/signalfx/sapm-proto/sampling"
+)
+
+// shadow mirrors exported requests to a secondary endpoint. It has its own pool of workers so that a slow or failing
+// shadow endpoint never holds the workers of the client, and its requests are never retried, paused nor dead-lettered.
+type shadow struct {
+	endpoint    string
+	accessToken string
+	sampler     *sampling.Probabilistic
+	workers     chan *worker
+}
+
+// mirror sends a copy of the batches to the shadow endpoint in the background. The request is encoded before mirror
+// returns so the caller is free to reuse the batches. The mirror is skipped if every shadow worker is busy.
+func (sa *Client) mirror(ctx context.Context, batches []*jaegerpb.Batch, accessToken string) {
+	s := sa.shadow
+	// The sampler only fails on errors it never returns.
+	batches, _ = s.sampler.Process(ctx, batches)
+	spansCount := countSpans(batches)
+	if spansCount == 0 {
+		return
+	}
+
+	var w *worker
+	select {
+	case w = <-s.workers:
+	default:
+		sa.stats.shadowSkipped.Add(1)
+		return
+	}
+
+	sr, err := w.prepare(batches, spansCount)
+	if err != nil {
+		s.workers <- w
+		sa.stats.shadowFailed.Add(1)
+		return
+	}
+	if s.accessToken != "" {
+		accessToken = s.accessToken
+	}
+
+	// The shadow request must outlive the Export call it was made from.
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer func() { s.workers <- w }()
+		defer sr.release()
+		ctx, span := w.tracer.Start(ctx, "shadowExport")
+		defer span.End()
+		if _, serr := w.sendAndObserve(ctx, sr, accessToken); serr != nil {
+			sa.stats.shadowFailed.Add(1)
+			return
+		}
+		sa.stats.shadowSent.Add(1)
+	}()
+}
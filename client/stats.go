@@ -0,0 +1,136 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the client counters. All totals are accumulated since the client was created.
+type Stats struct {
+	// SpansSent is the number of spans accepted by the server.
+	SpansSent int64
+	// BatchesSent is the number of batches accepted by the server.
+	BatchesSent int64
+	// BytesSent is the number of payload bytes accepted by the server, after compression.
+	BytesSent int64
+	// FailuresByStatusCode counts failed requests by the HTTP status code returned by the server.
+	// Failures that happened before a response was received are counted under 0.
+	FailuresByStatusCode map[int]int64
+	// SpansDropped is the number of spans in requests that failed permanently.
+	SpansDropped int64
+	// SpansInvalid is the number of spans dropped by validation before being sent.
+	SpansInvalid int64
+	// DeadLettersWritten is the number of dropped requests stored by the DeadLetterSink.
+	DeadLettersWritten int64
+	// DeadLettersFailed is the number of dropped requests the DeadLetterSink failed to store.
+	DeadLettersFailed int64
+	// ShadowSent is the number of requests mirrored to the shadow endpoint and accepted by it.
+	ShadowSent int64
+	// ShadowFailed is the number of requests that could not be mirrored to the shadow endpoint.
+	ShadowFailed int64
+	// ShadowSkipped is the number of requests not mirrored because every shadow worker was busy.
+	ShadowSkipped int64
+	// Paused reports whether the client is currently holding its workers because the server asked it to back off.
+	Paused bool
+	// IdleWorkers is the number of workers currently available to export a request.
+	IdleWorkers int
+	// CompressionRatio is the average ratio of uncompressed to compressed size of the accepted payloads.
+	// It is 1 when compression is disabled and 0 when nothing was sent yet.
+	CompressionRatio float64
+}
+
+// clientStats holds the running totals behind Stats. It is shared by all the workers of a client.
+type clientStats struct {
+	spansSent   atomic.Int64
+	batchesSent atomic.Int64
+	bytesSent   atomic.Int64
+	// uncompressedSent and compressedSent only account for requests with a known uncompressed size.
+	uncompressedSent atomic.Int64
+	compressedSent   atomic.Int64
+	spansDropped     atomic.Int64
+	spansInvalid     atomic.Int64
+	activePauses     atomic.Int64
+
+	deadLettersWritten atomic.Int64
+	deadLettersFailed  atomic.Int64
+
+	shadowSent    atomic.Int64
+	shadowFailed  atomic.Int64
+	shadowSkipped atomic.Int64
+
+	failuresMu sync.Mutex
+	failures   map[int]int64
+}
+
+func (s *clientStats) recordSuccess(r *sendRequest) {
+	s.spansSent.Add(r.spans)
+	s.batchesSent.Add(r.batches)
+	s.bytesSent.Add(r.size())
+	if r.uncompressedSize > 0 {
+		s.uncompressedSent.Add(r.uncompressedSize)
+		s.compressedSent.Add(r.size())
+	}
+}
+
+func (s *clientStats) recordFailure(serr *ErrSend, spans int64) {
+	s.failuresMu.Lock()
+	if s.failures == nil {
+		s.failures = make(map[int]int64)
+	}
+	s.failures[serr.StatusCode]++
+	s.failuresMu.Unlock()
+
+	if serr.Permanent {
+		s.spansDropped.Add(spans)
+	}
+}
+
+// compressionRatio returns the ratio of the uncompressed to the compressed size of the requests sent, 0 if no
+// compressed request was sent.
+func (s *clientStats) compressionRatio() float64 {
+	if compressed := s.compressedSent.Load(); compressed > 0 {
+		return float64(s.uncompressedSent.Load()) / float64(compressed)
+	}
+	return 0
+}
+
+func (s *clientStats) snapshot() Stats {
+	st := Stats{
+		SpansSent:    s.spansSent.Load(),
+		BatchesSent:  s.batchesSent.Load(),
+		BytesSent:    s.bytesSent.Load(),
+		SpansDropped: s.spansDropped.Load(),
+		SpansInvalid: s.spansInvalid.Load(),
+		Paused:       s.activePauses.Load() > 0,
+
+		DeadLettersWritten: s.deadLettersWritten.Load(),
+		DeadLettersFailed:  s.deadLettersFailed.Load(),
+
+		ShadowSent:    s.shadowSent.Load(),
+		ShadowFailed:  s.shadowFailed.Load(),
+		ShadowSkipped: s.shadowSkipped.Load(),
+	}
+	st.CompressionRatio = s.compressionRatio()
+
+	s.failuresMu.Lock()
+	st.FailuresByStatusCode = make(map[int]int64, len(s.failures))
+	for code, n := range s.failures {
+		st.FailuresByStatusCode[code] = n
+	}
+	s.failuresMu.Unlock()
+	return st
+}
@@ -0,0 +1,77 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/signalfx/sapm-proto/sapmprotocol"
+)
+
+// GRPCCodeFromHTTP takes an HTTP status code and returns the matching gRPC status code.
+// It uses the same mapping as OCStatusCodeFromHTTP and the gRPC receivers of sapmprotocol.
+func GRPCCodeFromHTTP(code int) codes.Code {
+	return sapmprotocol.GRPCCodeFromHTTP(code)
+}
+
+// HTTPStatusFromGRPC takes a gRPC status code and returns the matching HTTP status code.
+func HTTPStatusFromGRPC(code codes.Code) int {
+	return sapmprotocol.HTTPStatusFromGRPC(code)
+}
+
+// SpanStatusFromHTTP takes an HTTP status code and returns the OpenTelemetry span status for a span of the given kind.
+// See: https://opentelemetry.io/docs/specs/semconv/http/http-spans/#status
+func SpanStatusFromHTTP(code int, kind trace.SpanKind) otelcodes.Code {
+	// Invalid codes and 5xx responses are always errors.
+	if code < 100 || code >= 500 {
+		return otelcodes.Error
+	}
+	// 4xx responses are caused by the client, they are only errors from the client's point of view.
+	if code >= 400 && kind != trace.SpanKindServer {
+		return otelcodes.Error
+	}
+	return otelcodes.Unset
+}
+
+// GRPCStatusFromError returns the gRPC status matching an error returned by the client.
+// A nil error returns an OK status.
+func GRPCStatusFromError(err error) *status.Status {
+	if err == nil {
+		return status.New(codes.OK, "")
+	}
+
+	var serr *ErrSend
+	if errors.As(err, &serr) && serr.StatusCode != 0 {
+		return status.New(GRPCCodeFromHTTP(serr.StatusCode), err.Error())
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.New(codes.Canceled, err.Error())
+	case errors.Is(err, ErrTimeout):
+		return status.New(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, ErrNetwork):
+		return status.New(codes.Unavailable, err.Error())
+	case errors.Is(err, ErrMarshal), errors.Is(err, ErrUnsupportedEncoding):
+		return status.New(codes.InvalidArgument, err.Error())
+	}
+	return status.New(codes.Unknown, err.Error())
+}
@@ -0,0 +1,265 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+)
+
+// ValidationMode defines what happens to the spans that fail validation.
+type ValidationMode int
+
+const (
+	// ValidationModeDrop drops every invalid span, and whole batches when their process is invalid.
+	ValidationModeDrop ValidationMode = iota
+	// ValidationModeRepair fixes the problems that can be fixed and only drops the spans that cannot be repaired.
+	ValidationModeRepair
+)
+
+// UnknownServiceName is the service name set on batches without one in ValidationModeRepair.
+const UnknownServiceName = "unknown_service"
+
+// Problems reported in ValidationIssue.Problem.
+const (
+	ProblemMissingProcess     = "missing process"
+	ProblemMissingServiceName = "missing service name"
+	ProblemNilSpan            = "nil span"
+	ProblemZeroTraceID        = "zero trace ID"
+	ProblemZeroSpanID         = "zero span ID"
+	ProblemNegativeDuration   = "negative duration"
+	ProblemTagTypeMismatch    = "tag value does not match its type"
+)
+
+// ValidationIssue describes a problem found in a batch.
+type ValidationIssue struct {
+	// BatchIndex is the index of the batch in the validated slice.
+	BatchIndex int
+	// SpanIndex is the index of the span in the batch, -1 if the problem is with the batch process.
+	SpanIndex int
+	TraceID   jaegerpb.TraceID
+	SpanID    jaegerpb.SpanID
+	// Problem is one of the Problem constants.
+	Problem string
+	// Key is the key of the offending tag, if any.
+	Key string
+	// Repaired is true if the problem was fixed, false if the span or batch was dropped.
+	Repaired bool
+}
+
+// ValidationReportFunc receives the issues found in the batches of an Export call.
+type ValidationReportFunc func(ctx context.Context, issues []ValidationIssue)
+
+// ValidateBatches checks the batches for problems that make the server reject the whole request, and drops or
+// repairs the invalid spans according to mode. Repairs are made in place, but the slices passed in are not modified
+// when spans or batches are dropped. It returns the batches left to send and the problems found.
+func ValidateBatches(batches []*jaegerpb.Batch, mode ValidationMode) ([]*jaegerpb.Batch, []ValidationIssue) {
+	var issues []ValidationIssue
+	var valid []*jaegerpb.Batch
+	copied := false
+	for bi, batch := range batches {
+		out, keep := validateBatch(batch, bi, mode, &issues)
+		// Only copy the batches slice once it diverges from the input.
+		if !copied && (!keep || out != batch) {
+			valid = append(make([]*jaegerpb.Batch, 0, len(batches)), batches[:bi]...)
+			copied = true
+		}
+		if copied && keep {
+			valid = append(valid, out)
+		}
+	}
+	if !copied {
+		return batches, issues
+	}
+	return valid, issues
+}
+
+// validateBatch returns the batch to send, a copy if spans were dropped, and false if nothing is left to send.
+func validateBatch(batch *jaegerpb.Batch, bi int, mode ValidationMode, issues *[]ValidationIssue) (*jaegerpb.Batch, bool) {
+	if batch == nil || !validateProcess(batch, bi, mode, issues) {
+		return nil, false
+	}
+	spans := validateSpans(batch.Spans, bi, mode, issues)
+	if len(spans) == len(batch.Spans) {
+		return batch, len(spans) > 0
+	}
+	b := *batch
+	b.Spans = spans
+	return &b, len(spans) > 0
+}
+
+// validateProcess returns false if the batch must be dropped because of its process.
+func validateProcess(batch *jaegerpb.Batch, bi int, mode ValidationMode, issues *[]ValidationIssue) bool {
+	if batch.Process == nil {
+		if mode != ValidationModeRepair {
+			*issues = append(*issues, ValidationIssue{BatchIndex: bi, SpanIndex: -1, Problem: ProblemMissingProcess})
+			return false
+		}
+		batch.Process = &jaegerpb.Process{}
+		*issues = append(*issues, ValidationIssue{
+			BatchIndex: bi, SpanIndex: -1, Problem: ProblemMissingProcess, Repaired: true,
+		})
+	}
+	if batch.Process.ServiceName == "" {
+		if mode != ValidationModeRepair {
+			*issues = append(*issues, ValidationIssue{BatchIndex: bi, SpanIndex: -1, Problem: ProblemMissingServiceName})
+			return false
+		}
+		batch.Process.ServiceName = UnknownServiceName
+		*issues = append(*issues, ValidationIssue{
+			BatchIndex: bi, SpanIndex: -1, Problem: ProblemMissingServiceName, Repaired: true,
+		})
+	}
+
+	tags, ok := validateTags(batch.Process.Tags, mode, func(key string, repaired bool) {
+		*issues = append(*issues, ValidationIssue{
+			BatchIndex: bi, SpanIndex: -1, Problem: ProblemTagTypeMismatch, Key: key, Repaired: repaired,
+		})
+	})
+	if !ok {
+		return false
+	}
+	batch.Process.Tags = tags
+	return true
+}
+
+// validateSpans returns the spans to keep. The input slice is never modified.
+func validateSpans(spans []*jaegerpb.Span, bi int, mode ValidationMode, issues *[]ValidationIssue) []*jaegerpb.Span {
+	var kept []*jaegerpb.Span
+	for si, span := range spans {
+		ok := validateSpan(span, bi, si, mode, issues)
+		if !ok && kept == nil {
+			kept = append(make([]*jaegerpb.Span, 0, len(spans)), spans[:si]...)
+		}
+		if ok && kept != nil {
+			kept = append(kept, span)
+		}
+	}
+	if kept == nil {
+		return spans
+	}
+	return kept
+}
+
+func validateSpan(span *jaegerpb.Span, bi, si int, mode ValidationMode, issues *[]ValidationIssue) bool {
+	if span == nil {
+		*issues = append(*issues, ValidationIssue{BatchIndex: bi, SpanIndex: si, Problem: ProblemNilSpan})
+		return false
+	}
+	issue := func(problem, key string, repaired bool) {
+		*issues = append(*issues, ValidationIssue{
+			BatchIndex: bi, SpanIndex: si, TraceID: span.TraceID, SpanID: span.SpanID,
+			Problem: problem, Key: key, Repaired: repaired,
+		})
+	}
+
+	if span.TraceID.Low == 0 && span.TraceID.High == 0 {
+		issue(ProblemZeroTraceID, "", false)
+		return false
+	}
+	if span.SpanID == 0 {
+		issue(ProblemZeroSpanID, "", false)
+		return false
+	}
+	if span.Duration < 0 {
+		if mode != ValidationModeRepair {
+			issue(ProblemNegativeDuration, "", false)
+			return false
+		}
+		span.Duration = 0
+		issue(ProblemNegativeDuration, "", true)
+	}
+
+	tags, ok := validateTags(span.Tags, mode, func(key string, repaired bool) {
+		issue(ProblemTagTypeMismatch, key, repaired)
+	})
+	if !ok {
+		return false
+	}
+	span.Tags = tags
+	return true
+}
+
+// validateTags checks that each tag value matches its type. In ValidationModeRepair the type of a mismatched tag is
+// corrected when only one value is set, otherwise the tag is removed; the input slice is never modified. It returns
+// false if the tags are invalid and cannot be repaired.
+func validateTags(
+	tags []jaegerpb.KeyValue, mode ValidationMode, report func(key string, repaired bool),
+) ([]jaegerpb.KeyValue, bool) {
+	var repaired []jaegerpb.KeyValue
+	for i := range tags {
+		kv := tags[i]
+		if tagMatchesType(&kv) {
+			if repaired != nil {
+				repaired = append(repaired, kv)
+			}
+			continue
+		}
+		if mode != ValidationModeRepair {
+			report(kv.Key, false)
+			return tags, false
+		}
+		if repaired == nil {
+			repaired = append(make([]jaegerpb.KeyValue, 0, len(tags)), tags[:i]...)
+		}
+		if vType, ok := inferTagType(&kv); ok {
+			kv.VType = vType
+			repaired = append(repaired, kv)
+		}
+		report(kv.Key, true)
+	}
+	if repaired == nil {
+		return tags, true
+	}
+	return repaired, true
+}
+
+// tagMatchesType returns true if no value other than the one selected by VType is set.
+func tagMatchesType(kv *jaegerpb.KeyValue) bool {
+	vType, ok := inferTagType(kv)
+	return ok && vType == kv.VType
+}
+
+// inferTagType returns the type of the single value set on the tag. It returns the declared type when no value
+// is set, and false when several values are set or the declared type is unknown.
+func inferTagType(kv *jaegerpb.KeyValue) (jaegerpb.ValueType, bool) {
+	if _, known := jaegerpb.ValueType_name[int32(kv.VType)]; !known {
+		return kv.VType, false
+	}
+	vType := kv.VType
+	set := 0
+	if kv.VStr != "" {
+		vType = jaegerpb.ValueType_STRING
+		set++
+	}
+	if kv.VBool {
+		vType = jaegerpb.ValueType_BOOL
+		set++
+	}
+	if kv.VInt64 != 0 {
+		vType = jaegerpb.ValueType_INT64
+		set++
+	}
+	if kv.VFloat64 != 0 {
+		vType = jaegerpb.ValueType_FLOAT64
+		set++
+	}
+	if len(kv.VBinary) > 0 {
+		vType = jaegerpb.ValueType_BINARY
+		set++
+	}
+	return vType, set <= 1
+}
@@ -0,0 +1,207 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"testing"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validSpan(id uint64) *jaegerpb.Span {
+	return &jaegerpb.Span{
+		TraceID:       jaegerpb.NewTraceID(1, id),
+		SpanID:        jaegerpb.NewSpanID(id),
+		OperationName: "op",
+		Tags:          []jaegerpb.KeyValue{{Key: "k", VStr: "v", VType: jaegerpb.ValueType_STRING}},
+	}
+}
+
+func TestValidateBatches(t *testing.T) {
+	tests := []struct {
+		name       string
+		batch      func() *jaegerpb.Batch
+		wantDrop   []int
+		wantRepair []int
+		problem    string
+	}{
+		{
+			name: "valid",
+			batch: func() *jaegerpb.Batch {
+				return &jaegerpb.Batch{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{validSpan(1)}}
+			},
+			wantDrop:   []int{1},
+			wantRepair: []int{1},
+		},
+		{
+			name: "missing service name",
+			batch: func() *jaegerpb.Batch {
+				return &jaegerpb.Batch{Process: &jaegerpb.Process{}, Spans: []*jaegerpb.Span{validSpan(1)}}
+			},
+			wantDrop:   []int{},
+			wantRepair: []int{1},
+			problem:    ProblemMissingServiceName,
+		},
+		{
+			name: "missing process",
+			batch: func() *jaegerpb.Batch {
+				return &jaegerpb.Batch{Spans: []*jaegerpb.Span{validSpan(1)}}
+			},
+			wantDrop:   []int{},
+			wantRepair: []int{1},
+			problem:    ProblemMissingProcess,
+		},
+		{
+			name: "zero trace ID",
+			batch: func() *jaegerpb.Batch {
+				span := validSpan(2)
+				span.TraceID = jaegerpb.TraceID{}
+				return &jaegerpb.Batch{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{validSpan(1), span}}
+			},
+			wantDrop:   []int{1},
+			wantRepair: []int{1},
+			problem:    ProblemZeroTraceID,
+		},
+		{
+			name: "zero span ID",
+			batch: func() *jaegerpb.Batch {
+				span := validSpan(2)
+				span.SpanID = 0
+				return &jaegerpb.Batch{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{span, validSpan(1)}}
+			},
+			wantDrop:   []int{1},
+			wantRepair: []int{1},
+			problem:    ProblemZeroSpanID,
+		},
+		{
+			name: "nil span",
+			batch: func() *jaegerpb.Batch {
+				return &jaegerpb.Batch{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{nil, validSpan(1)}}
+			},
+			wantDrop:   []int{1},
+			wantRepair: []int{1},
+			problem:    ProblemNilSpan,
+		},
+		{
+			name: "negative duration",
+			batch: func() *jaegerpb.Batch {
+				span := validSpan(2)
+				span.Duration = -1
+				return &jaegerpb.Batch{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{validSpan(1), span}}
+			},
+			wantDrop:   []int{1},
+			wantRepair: []int{1, 2},
+			problem:    ProblemNegativeDuration,
+		},
+		{
+			name: "tag type mismatch",
+			batch: func() *jaegerpb.Batch {
+				span := validSpan(2)
+				span.Tags = append(span.Tags, jaegerpb.KeyValue{Key: "n", VInt64: 3, VType: jaegerpb.ValueType_STRING})
+				return &jaegerpb.Batch{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{validSpan(1), span}}
+			},
+			wantDrop:   []int{1},
+			wantRepair: []int{1, 2},
+			problem:    ProblemTagTypeMismatch,
+		},
+	}
+	for _, tt := range tests {
+		for _, mode := range []ValidationMode{ValidationModeDrop, ValidationModeRepair} {
+			want := tt.wantDrop
+			if mode == ValidationModeRepair {
+				want = tt.wantRepair
+			}
+			t.Run(tt.name, func(t *testing.T) {
+				batches := []*jaegerpb.Batch{tt.batch()}
+				original := batches[0].Spans
+
+				valid, issues := ValidateBatches(batches, mode)
+
+				var ids []int
+				for _, b := range valid {
+					for _, span := range b.Spans {
+						ids = append(ids, int(span.SpanID))
+					}
+				}
+				if len(want) == 0 {
+					assert.Empty(t, valid)
+				} else {
+					assert.Equal(t, want, ids)
+				}
+				if tt.problem == "" {
+					assert.Empty(t, issues)
+					return
+				}
+				require.NotEmpty(t, issues)
+				assert.Equal(t, tt.problem, issues[0].Problem)
+				assert.Len(t, batches[0].Spans, len(original), "input batch must not be modified")
+			})
+		}
+	}
+}
+
+func TestValidateTagsRepair(t *testing.T) {
+	tags := []jaegerpb.KeyValue{
+		{Key: "ok", VStr: "v", VType: jaegerpb.ValueType_STRING},
+		{Key: "zero", VType: jaegerpb.ValueType_INT64},
+		{Key: "fixable", VFloat64: 1.5, VType: jaegerpb.ValueType_BOOL},
+		{Key: "ambiguous", VStr: "v", VBool: true, VType: jaegerpb.ValueType_STRING},
+		{Key: "unknown", VStr: "v", VType: jaegerpb.ValueType(42)},
+	}
+	var reported []string
+	repaired, ok := validateTags(tags, ValidationModeRepair, func(key string, repaired bool) {
+		assert.True(t, repaired)
+		reported = append(reported, key)
+	})
+	require.True(t, ok)
+	assert.Equal(t, []string{"fixable", "ambiguous", "unknown"}, reported)
+	require.Len(t, repaired, 3)
+	assert.Equal(t, "fixable", repaired[2].Key)
+	assert.Equal(t, jaegerpb.ValueType_FLOAT64, repaired[2].VType)
+	assert.Equal(t, jaegerpb.ValueType_BOOL, tags[2].VType, "input tags must not be modified")
+}
+
+func TestClientValidation(t *testing.T) {
+	transport := &mockTransport{}
+	var issues []ValidationIssue
+	c, err := New(
+		defaultEndpointOption,
+		WithHTTPClient(newMockHTTPClient(transport)),
+		WithValidation(ValidationModeDrop, func(_ context.Context, i []ValidationIssue) {
+			issues = append(issues, i...)
+		}),
+	)
+	require.NoError(t, err)
+
+	batches := []*jaegerpb.Batch{
+		{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{validSpan(1), {}}},
+		{Spans: []*jaegerpb.Span{validSpan(2)}},
+	}
+	require.NoError(t, c.Export(context.Background(), batches))
+
+	requests := transport.requests()
+	require.Len(t, requests, 1)
+	assertRequestEqualBatches(t, requests[0].r, []*jaegerpb.Batch{
+		{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{validSpan(1)}},
+	})
+	assert.Len(t, issues, 2)
+	assert.EqualValues(t, 2, c.Stats().SpansInvalid)
+
+	_, err = New(defaultEndpointOption, WithValidation(ValidationMode(5), nil))
+	require.Error(t, err)
+}
@@ -15,22 +15,23 @@
 package client
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 
 	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
-	"github.com/klauspost/compress/zstd"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 
 	sapmpb "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/sapmprotocol"
 )
 
 // IngestResponse encapsulates the body of response returned by trace ingest and any error encountered
@@ -38,6 +39,10 @@ import (
 type IngestResponse struct {
 	Body []byte
 	Err  error
+	// Response is the PostSpansResponse decoded from the body of a successful response. It is nil if the body could
+	// not be decoded, or was not a PostSpansResponse. Receivers that do not report the accepted spans answer with an
+	// empty response. A response with rejected spans is still a success: the rejected spans are not sent again.
+	Response *sapmpb.PostSpansResponse
 }
 
 type resetWriteCloser interface {
@@ -56,6 +61,24 @@ type worker struct {
 	compressWriter     resetWriteCloser
 	disableCompression bool
 	compressionMethod  CompressionMethod
+	observer           Observer
+	stats              *clientStats
+	// streamingThreshold is the uncompressed request size above which requests are streamed, 0 to disable.
+	streamingThreshold int
+	// jsonEncoding encodes the requests with JSON instead of protobuf.
+	jsonEncoding bool
+	// grpcConn sends the requests with gRPC instead of HTTP when set. The requests are then compressed by gRPC
+	// with grpcCompression, empty to disable compression.
+	grpcConn        *grpc.ClientConn
+	grpcCompression CompressionMethod
+	// grpcJaeger sends the requests with the Jaeger CollectorService instead of the SapmService.
+	grpcJaeger bool
+	// capabilities holds the capabilities advertised by the endpoints, shared by the workers of a client.
+	capabilities *capabilityCache
+	// fallbackWriter compresses the requests with gzip when the endpoint does not support the compression method.
+	fallbackWriter resetWriteCloser
+	// scratch is reused to marshal one batch at a time.
+	scratch []byte
 }
 
 func newWorker(
@@ -65,10 +88,19 @@ func newWorker(
 	disableCompression bool,
 	compressionMethod CompressionMethod,
 	tracerProvider trace.TracerProvider,
+	observer Observer,
+	stats *clientStats,
+	streamingThreshold int,
 ) (*worker, error) {
 	if tracerProvider == nil {
 		tracerProvider = trace.NewNoopTracerProvider()
 	}
+	if observer == nil {
+		observer = NopObserver{}
+	}
+	if stats == nil {
+		stats = &clientStats{}
+	}
 	w := &worker{
 		tracer:             tracerProvider.Tracer("github.com/signalfx/sapm-proto/client"),
 		client:             client,
@@ -76,24 +108,19 @@ func newWorker(
 		endpoint:           endpoint,
 		disableCompression: disableCompression,
 		compressionMethod:  compressionMethod,
+		observer:           observer,
+		stats:              stats,
+		streamingThreshold: streamingThreshold,
 	}
 
 	if !disableCompression {
-		switch w.compressionMethod {
-		case CompressionMethodGzip:
-			w.compressWriter = gzip.NewWriter(nil)
-		case CompressionMethodZstd:
-			var err error
-			w.compressWriter, err = zstd.NewWriter(
-				nil,
-				// Enable sync mode to avoid concurrency overheads.
-				zstd.WithEncoderConcurrency(1),
-			)
-			if err != nil {
-				return nil, err
+		var err error
+		if w.compressWriter, err = sapmprotocol.NewCompressor(string(w.compressionMethod)); err != nil {
+			var encodingErr *sapmprotocol.ErrUnsupportedEncoding
+			if errors.As(err, &encodingErr) {
+				return nil, fmt.Errorf("unknown compression method %v", w.compressionMethod)
 			}
-		default:
-			return nil, fmt.Errorf("unknown compression method %v", w.compressionMethod)
+			return nil, err
 		}
 	}
 
@@ -104,10 +131,7 @@ func (w *worker) export(ctx context.Context, batches []*jaegerpb.Batch, accessTo
 	ctx, span := w.tracer.Start(ctx, "export")
 	defer span.End()
 
-	var spansCount int
-	for _, batch := range batches {
-		spansCount += len(batch.Spans)
-	}
+	spansCount := countSpans(batches)
 
 	span.SetAttributes(attribute.Int64("spans", int64(spansCount)))
 	span.SetAttributes(attribute.Int64("batches", int64(len(batches))))
@@ -116,32 +140,151 @@ func (w *worker) export(ctx context.Context, batches []*jaegerpb.Batch, accessTo
 		return nil, nil
 	}
 
+	w.observer.OnSendStart(ctx, int64(len(batches)), int64(spansCount))
+
 	sr, err := w.prepare(batches, spansCount)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "")
-		return nil, &ErrSend{Err: err, Permanent: true}
+		serr := &ErrSend{Err: err, Permanent: true, Spans: int64(spansCount), marshal: true}
+		w.observeFailure(ctx, serr, int64(spansCount))
+		return nil, serr
 	}
+	defer sr.release()
+
+	return w.sendAndObserve(ctx, sr, accessToken)
+}
+
+// exportRaw sends an already encoded request. The request is sent as is, without going through prepare.
+func (w *worker) exportRaw(ctx context.Context, sr *sendRequest, accessToken string) (*IngestResponse, *ErrSend) {
+	ctx, span := w.tracer.Start(ctx, "exportRaw")
+	defer span.End()
 
+	span.SetAttributes(attribute.Int64("bytes", int64(len(sr.message))))
+
+	w.observer.OnSendStart(ctx, sr.batches, sr.spans)
+	return w.sendAndObserve(ctx, sr, accessToken)
+}
+
+// sendAndObserve sends a prepared request and reports the outcome to the stats, the observer and the span in ctx.
+func (w *worker) sendAndObserve(ctx context.Context, sr *sendRequest, accessToken string) (*IngestResponse, *ErrSend) {
 	responseBody, serr := w.send(ctx, sr, accessToken)
 	if serr == nil {
+		w.stats.recordSuccess(sr)
+		w.observer.OnSendSuccess(ctx, sr.batches, sr.spans)
 		return responseBody, nil
 	}
-	span.RecordError(err)
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(serr)
 	span.SetStatus(codes.Error, "")
+	w.observeFailure(ctx, serr, sr.spans)
 
 	return responseBody, serr
 }
 
+// permanentStatus returns true if a request failing with the HTTP status code must not be retried: the server
+// rejected it as malformed, or rejected the access token. These are the requests matching ErrBadRequest and
+// ErrUnauthorized.
+func permanentStatus(statusCode int) bool {
+	return statusCode == http.StatusBadRequest || statusCode == http.StatusUnauthorized
+}
+
+func countSpans(batches []*jaegerpb.Batch) int {
+	var spansCount int
+	for _, batch := range batches {
+		spansCount += len(batch.Spans)
+	}
+	return spansCount
+}
+
+// observeFailure records a failed request and notifies the observer whether it was dropped or can be retried.
+func (w *worker) observeFailure(ctx context.Context, serr *ErrSend, spans int64) {
+	observeFailure(ctx, w.observer, w.stats, serr, spans)
+}
+
+func observeFailure(ctx context.Context, observer Observer, stats *clientStats, serr *ErrSend, spans int64) {
+	stats.recordFailure(serr, spans)
+	observer.OnSendFailure(ctx, serr)
+	if !serr.Permanent {
+		observer.OnRetry(ctx, serr)
+		return
+	}
+	reason := DropReasonRejected
+	if serr.StatusCode == 0 {
+		reason = DropReasonInvalidRequest
+	}
+	observer.OnDrop(ctx, reason, spans)
+}
+
+// requestEncoding returns the encoding of the requests prepared by the worker, empty if they are not compressed. The
+// compression method of the worker is used unless the endpoint advertised that it does not support it, in which
+// case gzip is used if the endpoint supports it, and no compression otherwise.
+func (w *worker) requestEncoding() CompressionMethod {
+	if w.disableCompression {
+		return CompressionMethodNone
+	}
+	caps := w.capabilities.get(w.endpoint)
+	if caps == nil || caps.SupportsEncoding(string(w.compressionMethod)) {
+		return w.compressionMethod
+	}
+	if caps.SupportsEncoding(string(CompressionMethodGzip)) {
+		return CompressionMethodGzip
+	}
+	return CompressionMethodNone
+}
+
+// compressor returns the compressor of the worker for encoding, creating the fallback gzip compressor on first use.
+func (w *worker) compressor(encoding CompressionMethod) (resetWriteCloser, error) {
+	if encoding == w.compressionMethod {
+		return w.compressWriter, nil
+	}
+	if w.fallbackWriter == nil {
+		compressor, err := sapmprotocol.NewCompressor(string(encoding))
+		if err != nil {
+			return nil, err
+		}
+		w.fallbackWriter = compressor
+	}
+	return w.fallbackWriter, nil
+}
+
 func (w *worker) send(ctx context.Context, r *sendRequest, accessToken string) (*IngestResponse, *ErrSend) {
-	req, err := http.NewRequestWithContext(ctx, "POST", w.endpoint, bytes.NewBuffer(r.message))
+	if w.grpcConn != nil {
+		return w.sendGRPC(ctx, r, accessToken)
+	}
+
+	var body io.ReadCloser
+	var stream *streamBody
+	if r.stream != nil {
+		stream = newStreamBody(r)
+		body = stream
+	} else {
+		body = r.newMessageBody()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.endpoint, body)
 	if err != nil {
-		return nil, &ErrSend{Err: err, Permanent: true}
+		_ = body.Close()
+		if stream != nil {
+			stream.finish()
+		}
+		return nil, &ErrSend{Err: err, Permanent: true, Spans: r.spans}
+	}
+	if stream == nil {
+		req.ContentLength = int64(len(r.message))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return r.newMessageBody(), nil
+		}
 	}
-	req.Header.Add(headerContentType, headerValueXProtobuf)
+	if w.jsonEncoding {
+		req.Header.Add(headerContentType, headerValueJSON)
+	} else {
+		req.Header.Add(headerContentType, headerValueXProtobuf)
+	}
+	req.Header.Set(headerProtocolVersion, sapmprotocol.ProtocolVersion)
 
-	if !w.disableCompression {
-		req.Header.Add(headerContentEncoding, string(w.compressionMethod))
+	if r.encoding != "" {
+		req.Header.Add(headerContentEncoding, string(r.encoding))
 	}
 
 	if accessToken == "" {
@@ -152,26 +295,47 @@ func (w *worker) send(ctx context.Context, r *sendRequest, accessToken string) (
 		req.Header.Add(headerAccessToken, accessToken)
 	}
 
+	// The header is kept by the HTTP client when it follows redirects or replays the request on a new connection.
+	if key := IdempotencyKeyFromContext(ctx); key != "" {
+		req.Header.Set(headerIdempotencyKey, key)
+	}
+
 	resp, err := w.client.Do(req)
+	if stream != nil {
+		stream.finish()
+		if stream.encodeErr != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, &ErrSend{Err: stream.encodeErr, Permanent: true, Spans: r.spans, marshal: true}
+		}
+	}
 	if err != nil {
-		return nil, &ErrSend{Err: err}
+		return nil, &ErrSend{Err: err, Spans: r.spans, network: true}
 	}
 
+	w.capabilities.update(w.endpoint, resp)
+
 	bodyBytes, err := io.ReadAll(resp.Body)
-	ingestResponse := &IngestResponse{bodyBytes, err}
+	ingestResponse := &IngestResponse{Body: bodyBytes, Err: err}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		if err == nil {
+			ingestResponse.Response = decodeResponse(bodyBytes, resp.Header.Get(headerContentType))
+		}
 		return ingestResponse, nil
 	}
 
 	// Drop the batch if server thinks it is malformed in some way or client is not authorized
-	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+	if permanentStatus(resp.StatusCode) {
 		msg := fmt.Sprintf("server responded with: %d", resp.StatusCode)
 		return ingestResponse, &ErrSend{
-			Err:        fmt.Errorf("dropping request: %s", msg),
-			StatusCode: http.StatusBadRequest,
-			Permanent:  true,
+			Err:             fmt.Errorf("dropping request: %s", msg),
+			StatusCode:      resp.StatusCode,
+			Permanent:       true,
+			ResponseExcerpt: responseExcerpt(bodyBytes),
+			Spans:           r.spans,
 		}
 	}
 
@@ -189,6 +353,8 @@ func (w *worker) send(ctx context.Context, r *sendRequest, accessToken string) (
 			Err:               errors.New("server responded with 429"),
 			StatusCode:        resp.StatusCode,
 			RetryDelaySeconds: retryAfter,
+			ResponseExcerpt:   responseExcerpt(bodyBytes),
+			Spans:             r.spans,
 		}
 	}
 
@@ -196,45 +362,140 @@ func (w *worker) send(ctx context.Context, r *sendRequest, accessToken string) (
 	// redirects are not handled right now but should be to confirm with the spec.
 
 	return ingestResponse, &ErrSend{
-		Err:        fmt.Errorf("error exporting spans. server responded with status %d", resp.StatusCode),
-		StatusCode: resp.StatusCode,
+		Err:             fmt.Errorf("error exporting spans. server responded with status %d", resp.StatusCode),
+		StatusCode:      resp.StatusCode,
+		ResponseExcerpt: responseExcerpt(bodyBytes),
+		Spans:           r.spans,
 	}
 }
 
+// decodeResponse decodes the PostSpansResponse held by the body of a successful response, encoded with the
+// contentType media type. It returns nil if the body is not a PostSpansResponse.
+func decodeResponse(body []byte, contentType string) *sapmpb.PostSpansResponse {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	resp := &sapmpb.PostSpansResponse{}
+	switch mediaType {
+	case sapmprotocol.ContentTypeHeaderValue, sapmprotocol.ContentTypeProtobufHeaderValue:
+		err = resp.Unmarshal(body)
+	case sapmprotocol.ContentTypeJSONHeaderValue:
+		err = sapmprotocol.UnmarshalJSON(body, resp)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
 // prepare takes a jaeger batches, converts them to a SAPM PostSpansRequest, compresses it and returns a request ready
-// to be sent.
+// to be sent. The batches are marshaled straight into the compressor, one at a time, and the output is written to a
+// pooled buffer that is reused once the request was sent. Requests larger than the streaming threshold are not
+// buffered at all: they are encoded while the HTTP transport reads the request body.
 func (w *worker) prepare(batches []*jaegerpb.Batch, spansCount int) (*sendRequest, error) {
-	psr := &sapmpb.PostSpansRequest{
-		Batches: batches,
+	sr := &sendRequest{
+		batches:  int64(len(batches)),
+		spans:    int64(spansCount),
+		encoding: w.requestEncoding(),
 	}
-
-	encoded, err := psr.Marshal()
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	if w.jsonEncoding {
+		return w.prepareJSON(sr, batches)
 	}
 
-	if w.disableCompression {
-		return &sendRequest{
-			message: encoded,
-			batches: int64(len(batches)),
-			spans:   int64(spansCount),
-		}, nil
+	// Sizing spans allocates, so the request size is only computed upfront when it is needed.
+	if sr.encoding == "" || w.streamingThreshold > 0 {
+		sr.uncompressedSize = int64(requestSize(batches))
 	}
 
-	buf := bytes.NewBuffer([]byte{})
-	w.compressWriter.Reset(buf)
+	if w.streamingThreshold > 0 && sr.uncompressedSize > int64(w.streamingThreshold) {
+		sr.stream = func(dst io.Writer) error {
+			_, err := w.encode(dst, batches, sr.encoding)
+			return err
+		}
+		return sr, nil
+	}
 
-	if _, err = w.compressWriter.Write(encoded); err != nil {
-		return nil, fmt.Errorf("failed to compress request: %w", err)
+	buf := getPayloadBuffer()
+	if sr.encoding == "" {
+		// Nothing to compress, marshal the whole request directly into the pooled buffer.
+		size := int(sr.uncompressedSize)
+		buf.Grow(size)
+		message := buf.AvailableBuffer()[:size]
+		psr := &sapmpb.PostSpansRequest{Batches: batches}
+		if _, err := psr.MarshalToSizedBuffer(message); err != nil {
+			putPayloadBuffer(buf)
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		sr.message = message
+	} else {
+		n, err := w.encode(buf, batches, sr.encoding)
+		if err != nil {
+			putPayloadBuffer(buf)
+			return nil, err
+		}
+		sr.message = buf.Bytes()
+		sr.uncompressedSize = int64(n)
 	}
+	sr.buf = buf
+	sr.refs.Store(1)
+	return sr, nil
+}
 
-	if err = w.compressWriter.Close(); err != nil {
-		return nil, fmt.Errorf("failed to compress request: %w", err)
+// prepareJSON encodes the batches as a JSON PostSpansRequest into a pooled buffer, compressed unless compression is
+// disabled.
+func (w *worker) prepareJSON(sr *sendRequest, batches []*jaegerpb.Batch) (*sendRequest, error) {
+	buf := getPayloadBuffer()
+	psr := &sapmpb.PostSpansRequest{Batches: batches}
+	var err error
+	if sr.encoding == "" {
+		err = sapmprotocol.MarshalJSON(buf, psr)
+		sr.uncompressedSize = int64(buf.Len())
+	} else {
+		var n atomic.Int64
+		var compressor resetWriteCloser
+		if compressor, err = w.compressor(sr.encoding); err == nil {
+			compressor.Reset(buf)
+			if err = sapmprotocol.MarshalJSON(&countingWriter{w: compressor, n: &n}, psr); err == nil {
+				err = compressor.Close()
+			}
+		}
+		sr.uncompressedSize = n.Load()
 	}
-	sr := &sendRequest{
-		message: buf.Bytes(),
-		batches: int64(len(batches)),
-		spans:   int64(spansCount),
+	if err != nil {
+		putPayloadBuffer(buf)
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
+	sr.message = buf.Bytes()
+	sr.buf = buf
+	sr.refs.Store(1)
 	return sr, nil
 }
+
+// encode writes the batches to dst as a PostSpansRequest, compressed with encoding unless it is empty.
+// It returns the size of the request before compression.
+func (w *worker) encode(dst io.Writer, batches []*jaegerpb.Batch, encoding CompressionMethod) (int, error) {
+	var n int
+	var err error
+	if encoding == "" {
+		if w.scratch, n, err = writeBatches(dst, batches, w.scratch); err != nil {
+			return n, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		return n, nil
+	}
+
+	compressor, err := w.compressor(encoding)
+	if err != nil {
+		return n, err
+	}
+	compressor.Reset(dst)
+	if w.scratch, n, err = writeBatches(compressor, batches, w.scratch); err != nil {
+		return n, fmt.Errorf("failed to compress request: %w", err)
+	}
+	if err = compressor.Close(); err != nil {
+		return n, fmt.Errorf("failed to compress request: %w", err)
+	}
+	return n, nil
+}
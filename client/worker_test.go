@@ -22,8 +22,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
 	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
@@ -33,6 +38,7 @@ import (
 
 	gen "github.com/signalfx/sapm-proto/gen"
 	"github.com/signalfx/sapm-proto/internal/testhelpers"
+	"github.com/signalfx/sapm-proto/sapmprotocol"
 )
 
 var (
@@ -73,7 +79,9 @@ var (
 )
 
 func newTestWorker(c *http.Client) *worker {
-	w, err := newWorker(c, "http://local", "", false, CompressionMethodGzip, trace.NewNoopTracerProvider())
+	w, err := newWorker(
+		c, "http://local", "", false, CompressionMethodGzip, trace.NewNoopTracerProvider(), nil, nil, 0,
+	)
 	if err != nil {
 		panic(err)
 	}
@@ -81,7 +89,9 @@ func newTestWorker(c *http.Client) *worker {
 }
 
 func newTestWorkerWithCompression(c *http.Client, disableCompression bool) *worker {
-	w, err := newWorker(c, "http://local", "", disableCompression, CompressionMethodGzip, trace.NewNoopTracerProvider())
+	w, err := newWorker(
+		c, "http://local", "", disableCompression, CompressionMethodGzip, trace.NewNoopTracerProvider(), nil, nil, 0,
+	)
 	if err != nil {
 		panic(err)
 	}
@@ -316,6 +326,9 @@ func TestCompressionSize(t *testing.T) {
 				test.disableCompression,
 				test.compressionMethod,
 				trace.NewNoopTracerProvider(),
+				nil,
+				nil,
+				0,
 			)
 			require.NoError(t, err)
 			sr, err := w.prepare(sapmData.Batches, len(sapmData.Batches))
@@ -348,6 +361,9 @@ func BenchmarkCompression(b *testing.B) {
 						test.disableCompression,
 						test.compressionMethod,
 						trace.NewNoopTracerProvider(),
+						nil,
+						nil,
+						0,
 					)
 					require.NoError(b, err)
 
@@ -369,3 +385,235 @@ func BenchmarkCompression(b *testing.B) {
 		}
 	}
 }
+
+func TestFileDeadLetterSink(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewFileDeadLetterSink(dir)
+	require.NoError(t, err)
+
+	letter := &DeadLetter{
+		Time:         time.Now().UTC(),
+		Batches:      testBatches,
+		ResponseBody: []byte("rejected"),
+		Err:          &ErrSend{Err: errors.New("dropping request"), StatusCode: 400, Permanent: true},
+	}
+	require.NoError(t, sink.Write(context.Background(), letter))
+	require.NoError(t, sink.Write(context.Background(), letter))
+
+	payloads, err := filepath.Glob(filepath.Join(dir, "*.pb"))
+	require.NoError(t, err)
+	require.Len(t, payloads, 2)
+
+	read, err := ReadFileDeadLetter(payloads[0])
+	require.NoError(t, err)
+	assert.True(t, letter.Time.Equal(read.Time))
+	assert.EqualValues(t, testBatches, read.Batches)
+	assert.Equal(t, letter.ResponseBody, read.ResponseBody)
+	assert.Equal(t, 400, read.Err.StatusCode)
+	assert.Equal(t, "dropping request", read.Err.Error())
+
+	_, err = NewFileDeadLetterSink("")
+	require.Error(t, err)
+}
+
+func TestWorkerStreaming(t *testing.T) {
+	var received []*gen.PostSpansRequest
+	var chunked []bool
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		psr, err := sapmprotocol.ParseTraceV2Request(r)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, psr)
+		chunked = append(chunked, r.ContentLength == -1)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	sapmData := testhelpers.CreateSapmData(100)
+	for _, test := range compressionTests {
+		for _, threshold := range []int{0, 1} {
+			t.Run(test.name+"/threshold="+strconv.Itoa(threshold), func(t *testing.T) {
+				mu.Lock()
+				received, chunked = nil, nil
+				mu.Unlock()
+
+				w, err := newWorker(
+					server.Client(), server.URL, "", test.disableCompression, test.compressionMethod,
+					trace.NewNoopTracerProvider(), nil, nil, threshold,
+				)
+				require.NoError(t, err)
+
+				for i := 0; i < 3; i++ {
+					_, serr := w.export(context.Background(), sapmData.Batches, "")
+					require.Nil(t, serr)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				require.Len(t, received, 3)
+				for i := range received {
+					assert.EqualValues(t, sapmData.Batches, received[i].Batches)
+					assert.Equal(t, threshold > 0, chunked[i])
+				}
+				assert.Greater(t, w.stats.bytesSent.Load(), int64(0))
+			})
+		}
+	}
+}
+
+func TestWorkerStreamingAborted(t *testing.T) {
+	// The mock transport never reads the request body, the stream must not block the worker.
+	transport := &mockTransport{statusCode: 500}
+	w, err := newWorker(
+		newMockHTTPClient(transport), "http://local", "", false, CompressionMethodGzip,
+		trace.NewNoopTracerProvider(), nil, nil, 1,
+	)
+	require.NoError(t, err)
+
+	_, serr := w.export(context.Background(), testBatches, "")
+	require.NotNil(t, serr)
+	assert.Equal(t, 500, serr.StatusCode)
+	assert.False(t, serr.Permanent)
+}
+
+func TestSendRequestRelease(t *testing.T) {
+	w := newTestWorker(newMockHTTPClient(&mockTransport{}))
+	sr, err := w.prepare(testBatches, testSpansCount)
+	require.NoError(t, err)
+	require.NotNil(t, sr.buf)
+
+	body := sr.newMessageBody()
+	sr.release()
+	assert.EqualValues(t, 1, sr.refs.Load())
+
+	contents, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, sr.message, contents)
+	require.NoError(t, body.Close())
+	require.NoError(t, body.Close())
+	assert.EqualValues(t, 0, sr.refs.Load())
+}
+
+// legacyPrepare is the encoding path used before requests were marshaled straight into the compressor,
+// kept to compare allocations in BenchmarkPrepare.
+func legacyPrepare(w *worker, batches []*jaegerpb.Batch) ([]byte, error) {
+	encoded, err := (&gen.PostSpansRequest{Batches: batches}).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if w.disableCompression {
+		return encoded, nil
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w.compressWriter.Reset(buf)
+	if _, err = w.compressWriter.Write(encoded); err != nil {
+		return nil, err
+	}
+	if err = w.compressWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func BenchmarkPrepare(b *testing.B) {
+	batchSizes := []int{1, 100, 1000}
+	for _, batchSize := range batchSizes {
+		sapmData := testhelpers.CreateSapmData(batchSize)
+		for _, test := range compressionTests {
+			w, err := newWorker(
+				newMockHTTPClient(&mockTransport{}), "http://local", "", test.disableCompression,
+				test.compressionMethod, trace.NewNoopTracerProvider(), nil, nil, 0,
+			)
+			require.NoError(b, err)
+
+			b.Run("legacy/"+test.name+"/batch="+strconv.Itoa(batchSize), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, err := legacyPrepare(w, sapmData.Batches)
+					require.NoError(b, err)
+				}
+			})
+			b.Run("pooled/"+test.name+"/batch="+strconv.Itoa(batchSize), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					sr, err := w.prepare(sapmData.Batches, batchSize)
+					require.NoError(b, err)
+					sr.release()
+				}
+			})
+		}
+	}
+}
+
+func TestWorkerSendErrorTaxonomy(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		permanent  bool
+		matches    error
+	}{
+		{statusCode: 400, permanent: true, matches: ErrBadRequest},
+		{statusCode: 401, permanent: true, matches: ErrUnauthorized},
+		{statusCode: 403, matches: ErrForbidden},
+		{statusCode: 413, matches: ErrPayloadTooLarge},
+		{statusCode: 429, matches: ErrThrottled},
+		{statusCode: 500, matches: ErrServer},
+		{statusCode: 503, matches: ErrServer},
+	}
+	sentinels := []error{
+		ErrBadRequest, ErrUnauthorized, ErrForbidden, ErrPayloadTooLarge, ErrThrottled, ErrServer, ErrMarshal,
+		ErrUnsupportedEncoding, ErrNetwork, ErrTimeout,
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.statusCode), func(t *testing.T) {
+			transport := &mockTransport{statusCode: tt.statusCode, body: "rejected"}
+			w := newTestWorker(newMockHTTPClient(transport))
+
+			_, sendErr := w.export(context.Background(), testBatches, "")
+			require.NotNil(t, sendErr)
+			assert.Equal(t, tt.statusCode, sendErr.StatusCode)
+			assert.Equal(t, tt.permanent, sendErr.Permanent)
+			assert.Equal(t, "rejected", sendErr.ResponseExcerpt)
+			assert.EqualValues(t, testSpansCount, sendErr.Spans)
+
+			var err error = sendErr
+			for _, sentinel := range sentinels {
+				assert.Equal(t, sentinel == tt.matches, errors.Is(err, sentinel), sentinel.Error())
+			}
+		})
+	}
+}
+
+func TestWorkerNetworkErrors(t *testing.T) {
+	transport := &mockTransport{err: errors.New("connection refused")}
+	w := newTestWorker(newMockHTTPClient(transport))
+
+	_, sendErr := w.export(context.Background(), testBatches, "")
+	require.NotNil(t, sendErr)
+	assert.ErrorIs(t, sendErr, ErrNetwork)
+	assert.NotErrorIs(t, sendErr, ErrTimeout)
+	assert.False(t, sendErr.Permanent)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	transport.reset(200)
+	transport.delay = 50 * time.Millisecond
+	transport.err = context.DeadlineExceeded
+	_, sendErr = w.export(ctx, testBatches, "")
+	require.NotNil(t, sendErr)
+	assert.ErrorIs(t, sendErr, ErrNetwork)
+	assert.ErrorIs(t, sendErr, ErrTimeout)
+	assert.ErrorIs(t, sendErr, context.DeadlineExceeded)
+}
+
+func TestResponseExcerpt(t *testing.T) {
+	assert.Equal(t, "short", responseExcerpt([]byte("short")))
+
+	long := bytes.Repeat([]byte("é"), maxResponseExcerpt)
+	excerpt := responseExcerpt(long)
+	assert.LessOrEqual(t, len(excerpt), maxResponseExcerpt)
+	assert.Equal(t, strings.Repeat("é", maxResponseExcerpt/2), excerpt)
+}
@@ -4,11 +4,15 @@
 package splunk_sapm
 
 import (
+	context "context"
 	fmt "fmt"
 	_ "github.com/gogo/protobuf/gogoproto"
 	proto "github.com/gogo/protobuf/proto"
 	golang_proto "github.com/golang/protobuf/proto"
 	v1 "github.com/jaegertracing/jaeger-idl/model/v1"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
 	io "io"
 	math "math"
 	math_bits "math/bits"
@@ -73,10 +77,20 @@ func (m *PostSpansRequest) GetBatches() []*v1.Batch {
 	return nil
 }
 
+// PostSpansResponse is the response to a PostSpansRequest. Older receivers answer with an empty response, so a
+// response without accepted or rejected spans does not tell anything about the request.
 type PostSpansResponse struct {
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	// The number of spans accepted by the receiver.
+	AcceptedSpans int64 `protobuf:"varint,1,opt,name=accepted_spans,json=acceptedSpans,proto3" json:"accepted_spans,omitempty"`
+	// The number of spans rejected by the receiver. A successful request with rejected spans was partially accepted.
+	RejectedSpans int64 `protobuf:"varint,2,opt,name=rejected_spans,json=rejectedSpans,proto3" json:"rejected_spans,omitempty"`
+	// A human-readable message explaining why spans were rejected.
+	ErrorMessage string `protobuf:"bytes,3,opt,name=error_message,json=errorMessage,proto3" json:"error_message,omitempty"`
+	// The batches holding rejected spans, if the receiver reports them.
+	RejectedBatches      []*BatchRejection `protobuf:"bytes,4,rep,name=rejected_batches,json=rejectedBatches,proto3" json:"rejected_batches,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *PostSpansResponse) Reset()         { *m = PostSpansResponse{} }
@@ -112,30 +126,217 @@ func (m *PostSpansResponse) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_PostSpansResponse proto.InternalMessageInfo
 
+func (m *PostSpansResponse) GetAcceptedSpans() int64 {
+	if m != nil {
+		return m.AcceptedSpans
+	}
+	return 0
+}
+
+func (m *PostSpansResponse) GetRejectedSpans() int64 {
+	if m != nil {
+		return m.RejectedSpans
+	}
+	return 0
+}
+
+func (m *PostSpansResponse) GetErrorMessage() string {
+	if m != nil {
+		return m.ErrorMessage
+	}
+	return ""
+}
+
+func (m *PostSpansResponse) GetRejectedBatches() []*BatchRejection {
+	if m != nil {
+		return m.RejectedBatches
+	}
+	return nil
+}
+
+// BatchRejection reports the spans of a batch rejected by a receiver.
+type BatchRejection struct {
+	// The index of the batch in the request.
+	BatchIndex int32 `protobuf:"varint,1,opt,name=batch_index,json=batchIndex,proto3" json:"batch_index,omitempty"`
+	// The number of spans of the batch rejected by the receiver.
+	RejectedSpans int64 `protobuf:"varint,2,opt,name=rejected_spans,json=rejectedSpans,proto3" json:"rejected_spans,omitempty"`
+	// Why the spans were rejected.
+	Reason               string   `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BatchRejection) Reset()         { *m = BatchRejection{} }
+func (m *BatchRejection) String() string { return proto.CompactTextString(m) }
+func (*BatchRejection) ProtoMessage()    {}
+func (*BatchRejection) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ce02d09d5d26685f, []int{2}
+}
+func (m *BatchRejection) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *BatchRejection) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_BatchRejection.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *BatchRejection) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchRejection.Merge(m, src)
+}
+func (m *BatchRejection) XXX_Size() int {
+	return m.Size()
+}
+func (m *BatchRejection) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchRejection.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchRejection proto.InternalMessageInfo
+
+func (m *BatchRejection) GetBatchIndex() int32 {
+	if m != nil {
+		return m.BatchIndex
+	}
+	return 0
+}
+
+func (m *BatchRejection) GetRejectedSpans() int64 {
+	if m != nil {
+		return m.RejectedSpans
+	}
+	return 0
+}
+
+func (m *BatchRejection) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*PostSpansRequest)(nil), "splunk.sapm.PostSpansRequest")
 	golang_proto.RegisterType((*PostSpansRequest)(nil), "splunk.sapm.PostSpansRequest")
 	proto.RegisterType((*PostSpansResponse)(nil), "splunk.sapm.PostSpansResponse")
 	golang_proto.RegisterType((*PostSpansResponse)(nil), "splunk.sapm.PostSpansResponse")
+	proto.RegisterType((*BatchRejection)(nil), "splunk.sapm.BatchRejection")
+	golang_proto.RegisterType((*BatchRejection)(nil), "splunk.sapm.BatchRejection")
 }
 
 func init() { proto.RegisterFile("proto/sapm.proto", fileDescriptor_ce02d09d5d26685f) }
 func init() { golang_proto.RegisterFile("proto/sapm.proto", fileDescriptor_ce02d09d5d26685f) }
 
 var fileDescriptor_ce02d09d5d26685f = []byte{
-	// 179 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x28, 0x28, 0xca, 0x2f,
-	0xc9, 0xd7, 0x2f, 0x4e, 0x2c, 0xc8, 0xd5, 0x03, 0x33, 0x85, 0xb8, 0x8b, 0x0b, 0x72, 0x4a, 0xf3,
-	0xb2, 0xf5, 0x40, 0x42, 0x52, 0x22, 0xe9, 0xf9, 0xe9, 0xf9, 0x10, 0x25, 0x20, 0x16, 0x44, 0x89,
-	0x94, 0x72, 0x56, 0x62, 0x6a, 0x7a, 0x6a, 0x91, 0x6e, 0x66, 0x4a, 0x8e, 0x3e, 0x44, 0x32, 0xb1,
-	0x20, 0x33, 0xbe, 0xcc, 0x48, 0x3f, 0x37, 0x3f, 0x25, 0x35, 0x07, 0xa2, 0x48, 0xc9, 0x89, 0x4b,
-	0x20, 0x20, 0xbf, 0xb8, 0x24, 0xb8, 0x20, 0x31, 0xaf, 0x38, 0x28, 0xb5, 0xb0, 0x34, 0xb5, 0xb8,
-	0x44, 0x48, 0x8f, 0x8b, 0x3d, 0x29, 0xb1, 0x24, 0x39, 0x23, 0xb5, 0x58, 0x82, 0x51, 0x81, 0x59,
-	0x83, 0xdb, 0x48, 0x44, 0x0f, 0x62, 0x94, 0x1e, 0xc4, 0x00, 0x3d, 0x27, 0x90, 0x6c, 0x10, 0x4c,
-	0x91, 0x92, 0x30, 0x97, 0x20, 0x92, 0x19, 0xc5, 0x05, 0xf9, 0x79, 0xc5, 0xa9, 0x4e, 0x02, 0x27,
-	0x1e, 0xc9, 0x31, 0x5e, 0x78, 0x24, 0xc7, 0xf8, 0xe0, 0x91, 0x1c, 0xe3, 0x81, 0xc7, 0x72, 0x8c,
-	0x49, 0x6c, 0x60, 0x1b, 0x8d, 0x01, 0x01, 0x00, 0x00, 0xff, 0xff, 0x57, 0xac, 0x24, 0xa3, 0xcd,
-	0x00, 0x00, 0x00,
+	// 343 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x91, 0xc1, 0x4a, 0xc3, 0x40,
+	0x10, 0x86, 0x5d, 0xab, 0x95, 0x4e, 0x6c, 0x8d, 0xa1, 0x48, 0xa9, 0x18, 0x4b, 0x8b, 0xd0, 0x8b,
+	0x5b, 0xa8, 0x6f, 0x90, 0x83, 0x20, 0x28, 0x48, 0x7a, 0xf4, 0x10, 0xb6, 0xc9, 0x10, 0x53, 0x9b,
+	0xec, 0xba, 0x9b, 0x16, 0x1f, 0xcf, 0xa3, 0x27, 0xf1, 0x11, 0xa4, 0xbe, 0x88, 0x64, 0x37, 0xa9,
+	0xad, 0x20, 0x78, 0xdb, 0xfc, 0xff, 0x97, 0x9f, 0xf9, 0x67, 0xc0, 0x16, 0x92, 0xe7, 0x7c, 0xa4,
+	0x98, 0x48, 0xa9, 0x7e, 0x3a, 0x96, 0x12, 0xf3, 0x45, 0xf6, 0x44, 0x0b, 0xa9, 0xdb, 0x8e, 0x79,
+	0xcc, 0x0d, 0x52, 0xbc, 0x0c, 0xd2, 0x1d, 0xcc, 0x18, 0xc6, 0x28, 0x2f, 0x93, 0x68, 0x3e, 0x32,
+	0x26, 0x13, 0x49, 0xb0, 0x1c, 0x8f, 0x52, 0x1e, 0xe1, 0xdc, 0x40, 0x7d, 0x0f, 0xec, 0x7b, 0xae,
+	0xf2, 0x89, 0x60, 0x99, 0xf2, 0xf1, 0x79, 0x81, 0x2a, 0x77, 0x28, 0x1c, 0x4c, 0x59, 0x1e, 0x3e,
+	0xa2, 0xea, 0x90, 0x5e, 0x6d, 0x68, 0x8d, 0xdb, 0xd4, 0x44, 0x51, 0x13, 0x40, 0xbd, 0xc2, 0xf5,
+	0x2b, 0xa8, 0xff, 0x4e, 0xe0, 0x78, 0x23, 0x44, 0x09, 0x9e, 0x29, 0x74, 0x2e, 0xa0, 0xc5, 0xc2,
+	0x10, 0x45, 0x8e, 0x51, 0xa0, 0x0a, 0xa7, 0x43, 0x7a, 0x64, 0x58, 0xf3, 0x9b, 0x95, 0xaa, 0xf1,
+	0x02, 0x93, 0x38, 0xc3, 0xf0, 0x07, 0xdb, 0x35, 0x58, 0xa5, 0x1a, 0x6c, 0x00, 0x4d, 0x94, 0x92,
+	0xcb, 0x20, 0x45, 0xa5, 0x58, 0x8c, 0x9d, 0x5a, 0x8f, 0x0c, 0x1b, 0xfe, 0xa1, 0x16, 0xef, 0x8c,
+	0xe6, 0x5c, 0x83, 0xbd, 0xce, 0xaa, 0x1a, 0xec, 0xe9, 0x06, 0xa7, 0x74, 0x63, 0x5f, 0xe5, 0xfc,
+	0x9a, 0x4c, 0x78, 0xe6, 0x1f, 0x55, 0x3f, 0x79, 0x65, 0x21, 0x01, 0xad, 0x6d, 0xc4, 0x39, 0x07,
+	0x4b, 0x07, 0x06, 0x49, 0x16, 0xe1, 0x8b, 0x6e, 0xb2, 0xef, 0x83, 0x96, 0x6e, 0x0a, 0xe5, 0xbf,
+	0x35, 0x4e, 0xa0, 0x2e, 0x91, 0x29, 0x9e, 0x95, 0xf3, 0x97, 0x5f, 0xe3, 0x07, 0xb0, 0x26, 0x4c,
+	0xa4, 0x13, 0x94, 0xcb, 0x24, 0x44, 0xe7, 0x16, 0x1a, 0xeb, 0x85, 0x3a, 0x67, 0x5b, 0xb3, 0xff,
+	0xbe, 0x56, 0xd7, 0xfd, 0xcb, 0x36, 0x77, 0xe8, 0xef, 0x78, 0xf6, 0xdb, 0xca, 0x25, 0x1f, 0x2b,
+	0x97, 0x7c, 0xae, 0x5c, 0xf2, 0xfa, 0xe5, 0x92, 0x69, 0x5d, 0x1f, 0xff, 0xea, 0x7b, 0x00, 0x38,
+	0xc2, 0x86, 0x57, 0x58, 0x02, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// SapmServiceClient is the client API for SapmService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type SapmServiceClient interface {
+	PostSpans(ctx context.Context, in *PostSpansRequest, opts ...grpc.CallOption) (*PostSpansResponse, error)
+}
+
+type sapmServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewSapmServiceClient(cc *grpc.ClientConn) SapmServiceClient {
+	return &sapmServiceClient{cc}
+}
+
+func (c *sapmServiceClient) PostSpans(ctx context.Context, in *PostSpansRequest, opts ...grpc.CallOption) (*PostSpansResponse, error) {
+	out := new(PostSpansResponse)
+	err := c.cc.Invoke(ctx, "/splunk.sapm.SapmService/PostSpans", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SapmServiceServer is the server API for SapmService service.
+type SapmServiceServer interface {
+	PostSpans(context.Context, *PostSpansRequest) (*PostSpansResponse, error)
+}
+
+// UnimplementedSapmServiceServer can be embedded to have forward compatible implementations.
+type UnimplementedSapmServiceServer struct {
+}
+
+func (*UnimplementedSapmServiceServer) PostSpans(ctx context.Context, req *PostSpansRequest) (*PostSpansResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PostSpans not implemented")
+}
+
+func RegisterSapmServiceServer(s *grpc.Server, srv SapmServiceServer) {
+	s.RegisterService(&_SapmService_serviceDesc, srv)
+}
+
+func _SapmService_PostSpans_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PostSpansRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SapmServiceServer).PostSpans(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/splunk.sapm.SapmService/PostSpans",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SapmServiceServer).PostSpans(ctx, req.(*PostSpansRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _SapmService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "splunk.sapm.SapmService",
+	HandlerType: (*SapmServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PostSpans",
+			Handler:    _SapmService_PostSpans_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/sapm.proto",
 }
 
 func (m *PostSpansRequest) Marshal() (dAtA []byte, err error) {
@@ -203,6 +404,81 @@ func (m *PostSpansResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if len(m.RejectedBatches) > 0 {
+		for iNdEx := len(m.RejectedBatches) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RejectedBatches[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintSapm(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x22
+		}
+	}
+	if len(m.ErrorMessage) > 0 {
+		i -= len(m.ErrorMessage)
+		copy(dAtA[i:], m.ErrorMessage)
+		i = encodeVarintSapm(dAtA, i, uint64(len(m.ErrorMessage)))
+		i--
+		dAtA[i] = 0x1a
+	}
+	if m.RejectedSpans != 0 {
+		i = encodeVarintSapm(dAtA, i, uint64(m.RejectedSpans))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.AcceptedSpans != 0 {
+		i = encodeVarintSapm(dAtA, i, uint64(m.AcceptedSpans))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *BatchRejection) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *BatchRejection) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *BatchRejection) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if len(m.Reason) > 0 {
+		i -= len(m.Reason)
+		copy(dAtA[i:], m.Reason)
+		i = encodeVarintSapm(dAtA, i, uint64(len(m.Reason)))
+		i--
+		dAtA[i] = 0x1a
+	}
+	if m.RejectedSpans != 0 {
+		i = encodeVarintSapm(dAtA, i, uint64(m.RejectedSpans))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.BatchIndex != 0 {
+		i = encodeVarintSapm(dAtA, i, uint64(m.BatchIndex))
+		i--
+		dAtA[i] = 0x8
+	}
 	return len(dAtA) - i, nil
 }
 
@@ -241,6 +517,44 @@ func (m *PostSpansResponse) Size() (n int) {
 	}
 	var l int
 	_ = l
+	if m.AcceptedSpans != 0 {
+		n += 1 + sovSapm(uint64(m.AcceptedSpans))
+	}
+	if m.RejectedSpans != 0 {
+		n += 1 + sovSapm(uint64(m.RejectedSpans))
+	}
+	l = len(m.ErrorMessage)
+	if l > 0 {
+		n += 1 + l + sovSapm(uint64(l))
+	}
+	if len(m.RejectedBatches) > 0 {
+		for _, e := range m.RejectedBatches {
+			l = e.Size()
+			n += 1 + l + sovSapm(uint64(l))
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *BatchRejection) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.BatchIndex != 0 {
+		n += 1 + sovSapm(uint64(m.BatchIndex))
+	}
+	if m.RejectedSpans != 0 {
+		n += 1 + sovSapm(uint64(m.RejectedSpans))
+	}
+	l = len(m.Reason)
+	if l > 0 {
+		n += 1 + l + sovSapm(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -367,6 +681,231 @@ func (m *PostSpansResponse) Unmarshal(dAtA []byte) error {
 			return fmt.Errorf("proto: PostSpansResponse: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field AcceptedSpans", wireType)
+			}
+			m.AcceptedSpans = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSapm
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.AcceptedSpans |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RejectedSpans", wireType)
+			}
+			m.RejectedSpans = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSapm
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RejectedSpans |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ErrorMessage", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSapm
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthSapm
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthSapm
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ErrorMessage = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RejectedBatches", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSapm
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthSapm
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthSapm
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RejectedBatches = append(m.RejectedBatches, &BatchRejection{})
+			if err := m.RejectedBatches[len(m.RejectedBatches)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipSapm(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthSapm
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *BatchRejection) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowSapm
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: BatchRejection: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: BatchRejection: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BatchIndex", wireType)
+			}
+			m.BatchIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSapm
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BatchIndex |= int32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RejectedSpans", wireType)
+			}
+			m.RejectedSpans = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSapm
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RejectedSpans |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Reason", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSapm
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthSapm
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthSapm
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Reason = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipSapm(dAtA[iNdEx:])
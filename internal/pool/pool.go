@@ -0,0 +1,20 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pool holds the limits shared by the memory pools of the client and the receivers.
+package pool
+
+// MaxBufferSize is the capacity above which buffers are left to the GC instead of going back to their pool, so that
+// a single huge request does not pin its memory for the lifetime of the process.
+const MaxBufferSize = 8 << 20
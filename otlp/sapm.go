@@ -0,0 +1,134 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/open-telemetry/opentelemetry-collector-contrib/pkg/translator/jaeger"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/sapmprotocol"
+)
+
+// TraceEndpoint is the default path of the OTLP/HTTP traces endpoint.
+const TraceEndpoint = "/v1/traces"
+
+// FromSapm converts the batches of a SAPM request to OTLP traces. The conversion may modify the spans of psr: the
+// tags carrying the instrumentation scope are moved to the scope of the traces.
+func FromSapm(psr *splunksapm.PostSpansRequest) (ptrace.Traces, error) {
+	td, err := jaeger.ProtoToTraces(psr.GetBatches())
+	if err != nil {
+		return ptrace.Traces{}, fmt.Errorf("failed to convert SAPM request to OTLP: %w", err)
+	}
+	return td, nil
+}
+
+// RequestOption configures the request built by NewHTTPRequest.
+type RequestOption func(*requestOptions)
+
+type requestOptions struct {
+	contentEncoding string
+	json            bool
+}
+
+// WithContentEncoding compresses the request with the given Content-Encoding, which may be any encoding registered
+// with sapmprotocol.RegisterEncoding, stacked or not. An empty value disables compression. OTLP receivers are only
+// required to support gzip, which is used by default.
+func WithContentEncoding(contentEncoding string) RequestOption {
+	return func(o *requestOptions) {
+		o.contentEncoding = contentEncoding
+	}
+}
+
+// WithJSONEncoding encodes the request with JSON instead of protobuf.
+func WithJSONEncoding() RequestOption {
+	return func(o *requestOptions) {
+		o.json = true
+	}
+}
+
+// NewHTTPRequest returns a request posting the spans of a SAPM request to an OTLP/HTTP traces endpoint, such as
+// "https://otlp.example.com/v1/traces". The spans are converted with FromSapm and sent as an OTLP ExportRequest,
+// encoded with protobuf and compressed with gzip unless the options say otherwise. The caller is left to set the
+// headers authenticating the request.
+func NewHTTPRequest(
+	ctx context.Context, endpoint string, psr *splunksapm.PostSpansRequest, opts ...RequestOption,
+) (*http.Request, error) {
+	o := requestOptions{contentEncoding: sapmprotocol.GZipEncodingHeaderValue}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	stack, err := sapmprotocol.ParseContentEncoding(o.contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	td, err := FromSapm(psr)
+	if err != nil {
+		return nil, err
+	}
+	er := ptraceotlp.NewExportRequestFromTraces(td)
+	var body []byte
+	contentType := sapmprotocol.ContentTypeHeaderValue
+	if o.json {
+		body, err = er.MarshalJSON()
+		contentType = sapmprotocol.ContentTypeJSONHeaderValue
+	} else {
+		body, err = er.MarshalProto()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal OTLP request: %w", err)
+	}
+
+	// Stacked encodings are applied in order.
+	for _, e := range stack {
+		if body, err = compress(body, e); err != nil {
+			return nil, fmt.Errorf("failed to compress OTLP request: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(sapmprotocol.ContentTypeHeaderName, contentType)
+	if len(stack) > 0 {
+		req.Header.Set(sapmprotocol.ContentEncodingHeaderName, o.contentEncoding)
+	}
+	return req, nil
+}
+
+// compress returns b compressed with a pooled compressor of the encoding.
+func compress(b []byte, e *sapmprotocol.Encoding) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	c, err := e.GetCompressor(buf)
+	if err != nil {
+		return nil, err
+	}
+	defer e.PutCompressor(c)
+	if _, err = c.Write(b); err != nil {
+		return nil, err
+	}
+	if err = c.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
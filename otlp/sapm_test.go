@@ -0,0 +1,108 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/sapmprotocol"
+)
+
+func newTestSapmRequest() *splunksapm.PostSpansRequest {
+	return &splunksapm.PostSpansRequest{
+		Batches: []*model.Batch{
+			{
+				Process: generateProtoProcess(),
+				Spans:   []*model.Span{generateProtoSpan()},
+			},
+		},
+	}
+}
+
+func TestFromSapm(t *testing.T) {
+	td, err := FromSapm(newTestSapmRequest())
+	require.NoError(t, err)
+	require.Equal(t, 1, td.SpanCount())
+	rs := td.ResourceSpans().At(0)
+	serviceName, ok := rs.Resource().Attributes().Get("service.name")
+	require.True(t, ok)
+	assert.Equal(t, "service", serviceName.Str())
+	span := rs.ScopeSpans().At(0).Spans().At(0)
+	assert.Equal(t, "operationA", span.Name())
+	assert.Equal(t, testSpanStartTime, span.StartTimestamp().AsTime())
+	assert.Equal(t, 2, span.Events().Len())
+
+	td, err = FromSapm(&splunksapm.PostSpansRequest{})
+	require.NoError(t, err)
+	assert.Zero(t, td.SpanCount())
+	td, err = FromSapm(nil)
+	require.NoError(t, err)
+	assert.Zero(t, td.SpanCount())
+}
+
+func TestNewHTTPRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []RequestOption
+		wantEncoding string
+	}{
+		{name: "default", wantEncoding: "gzip"},
+		{name: "uncompressed", opts: []RequestOption{WithContentEncoding("")}},
+		{name: "zstd", opts: []RequestOption{WithContentEncoding("zstd")}, wantEncoding: "zstd"},
+		{name: "stacked", opts: []RequestOption{WithContentEncoding("gzip, br")}, wantEncoding: "gzip, br"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := NewHTTPRequest(context.Background(), "http://localhost"+TraceEndpoint, newTestSapmRequest(), tt.opts...)
+			require.NoError(t, err)
+			assert.Equal(t, http.MethodPost, req.Method)
+			assert.Equal(t, TraceEndpoint, req.URL.Path)
+			assert.Equal(t, tt.wantEncoding, req.Header.Get(sapmprotocol.ContentEncodingHeaderName))
+			assert.Equal(t, sapmprotocol.ContentTypeHeaderValue, req.Header.Get(sapmprotocol.ContentTypeHeaderName))
+
+			// The OTLP request converts back to the SAPM request.
+			psr, err := ParseRequest(req)
+			require.NoError(t, err)
+			assert.Equal(t, newTestSapmRequest(), psr)
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		req, err := NewHTTPRequest(context.Background(), "http://localhost"+TraceEndpoint, newTestSapmRequest(),
+			WithJSONEncoding(), WithContentEncoding(""))
+		require.NoError(t, err)
+		assert.Equal(t, sapmprotocol.ContentTypeJSONHeaderValue, req.Header.Get(sapmprotocol.ContentTypeHeaderName))
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		er := ptraceotlp.NewExportRequest()
+		require.NoError(t, er.UnmarshalJSON(body))
+		assert.Equal(t, 1, er.Traces().SpanCount())
+	})
+
+	_, err := NewHTTPRequest(context.Background(), "http://localhost", newTestSapmRequest(), WithContentEncoding("compress"))
+	var encodingErr *sapmprotocol.ErrUnsupportedEncoding
+	assert.ErrorAs(t, err, &encodingErr)
+	_, err = NewHTTPRequest(context.Background(), "://", newTestSapmRequest())
+	assert.Error(t, err)
+}
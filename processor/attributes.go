@@ -0,0 +1,141 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+)
+
+// Target selects the tags an attribute processor applies to.
+type Target int
+
+const (
+	// TargetSpan applies to the tags of every span.
+	TargetSpan Target = iota
+	// TargetProcess applies to the tags of the process of every batch.
+	TargetProcess
+)
+
+// AddAttributes returns a Processor that sets the tags on the target, replacing existing tags with the same key.
+func AddAttributes(target Target, tags ...jaegerpb.KeyValue) Processor {
+	return Func(func(_ context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+		forEachTags(batches, target, func(kvs []jaegerpb.KeyValue) []jaegerpb.KeyValue {
+			for _, tag := range tags {
+				kvs = upsertTag(kvs, tag)
+			}
+			return kvs
+		})
+		return batches, nil
+	})
+}
+
+// RemoveAttributes returns a Processor that removes the tags with the given keys from the target.
+func RemoveAttributes(target Target, keys ...string) Processor {
+	remove := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		remove[k] = struct{}{}
+	}
+	return Func(func(_ context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+		forEachTags(batches, target, func(kvs []jaegerpb.KeyValue) []jaegerpb.KeyValue {
+			kept := kvs[:0]
+			for _, kv := range kvs {
+				if _, ok := remove[kv.Key]; !ok {
+					kept = append(kept, kv)
+				}
+			}
+			return kept
+		})
+		return batches, nil
+	})
+}
+
+// RenameAttributes returns a Processor that renames the tags of the target, from the keys of renames to their values.
+// A renamed tag replaces any existing tag with the new key.
+func RenameAttributes(target Target, renames map[string]string) Processor {
+	return Func(func(_ context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+		forEachTags(batches, target, func(kvs []jaegerpb.KeyValue) []jaegerpb.KeyValue {
+			var renamed []jaegerpb.KeyValue
+			kept := kvs[:0]
+			for _, kv := range kvs {
+				if to, ok := renames[kv.Key]; ok && to != kv.Key {
+					kv.Key = to
+					renamed = append(renamed, kv)
+					continue
+				}
+				kept = append(kept, kv)
+			}
+			for _, kv := range renamed {
+				kept = upsertTag(kept, kv)
+			}
+			return kept
+		})
+		return batches, nil
+	})
+}
+
+// ProcessTagsFromEnv returns a Processor that sets string tags on the process of every batch from environment
+// variables. envToKey maps environment variable names to tag keys. The environment is read once, when the processor
+// is created, and unset variables are ignored.
+func ProcessTagsFromEnv(envToKey map[string]string) Processor {
+	envs := make([]string, 0, len(envToKey))
+	for env := range envToKey {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+
+	var tags []jaegerpb.KeyValue
+	for _, env := range envs {
+		if val, ok := os.LookupEnv(env); ok {
+			tags = append(tags, jaegerpb.String(envToKey[env], val))
+		}
+	}
+	return AddAttributes(TargetProcess, tags...)
+}
+
+// forEachTags calls fn with the tags of the target and replaces them with its result.
+func forEachTags(batches []*jaegerpb.Batch, target Target, fn func([]jaegerpb.KeyValue) []jaegerpb.KeyValue) {
+	for _, batch := range batches {
+		if batch == nil {
+			continue
+		}
+		switch target {
+		case TargetProcess:
+			if batch.Process == nil {
+				batch.Process = &jaegerpb.Process{}
+			}
+			batch.Process.Tags = fn(batch.Process.Tags)
+		case TargetSpan:
+			for _, span := range batch.Spans {
+				if span != nil {
+					span.Tags = fn(span.Tags)
+				}
+			}
+		}
+	}
+}
+
+func upsertTag(kvs []jaegerpb.KeyValue, tag jaegerpb.KeyValue) []jaegerpb.KeyValue {
+	for i := range kvs {
+		if kvs[i].Key == tag.Key {
+			kvs[i] = tag
+			return kvs
+		}
+	}
+	return append(kvs, tag)
+}
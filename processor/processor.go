@@ -0,0 +1,84 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package processor provides processors that modify Jaeger batches, for use by SAPM clients and receivers.
+package processor
+
+import (
+	"context"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+
+	sapmpb "github.com/signalfx/sapm-proto/gen"
+)
+
+// Processor modifies batches before they are sent or after they are received.
+// Processors may modify the batches in place and return the batches to pass on, which can be a different slice
+// if batches were added or removed. Processors must be safe for concurrent use.
+type Processor interface {
+	Process(ctx context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error)
+}
+
+// Func is an adapter to use ordinary functions as processors.
+type Func func(ctx context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error)
+
+// Process calls f(ctx, batches).
+func (f Func) Process(ctx context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+	return f(ctx, batches)
+}
+
+type processedKey struct{}
+
+// ContextWithProcessed returns a context marking the batches exported with it as already processed, so that Chain
+// passes them through unchanged. Processors forwarding batches to an exporter running them, such as the tail
+// sampler of the sampling package, use it to avoid processing the batches twice.
+func ContextWithProcessed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, processedKey{}, true)
+}
+
+// Processed returns true if ctx was returned by ContextWithProcessed.
+func Processed(ctx context.Context) bool {
+	processed, _ := ctx.Value(processedKey{}).(bool)
+	return processed
+}
+
+// Chain is a Processor running processors in order, each one receiving the output of the previous one.
+// It stops at the first error. Batches processed with a context returned by ContextWithProcessed are returned
+// unchanged.
+type Chain []Processor
+
+// Process runs the processors of the chain.
+func (c Chain) Process(ctx context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+	if Processed(ctx) {
+		return batches, nil
+	}
+	var err error
+	for _, p := range c {
+		if batches, err = p.Process(ctx, batches); err != nil {
+			return nil, err
+		}
+	}
+	return batches, nil
+}
+
+// ProcessRequest runs p on the batches of a SAPM request, such as one returned by sapmprotocol.ParseTraceV2Request,
+// and stores the result back in the request.
+func ProcessRequest(ctx context.Context, p Processor, psr *sapmpb.PostSpansRequest) error {
+	batches, err := p.Process(ctx, psr.Batches)
+	if err != nil {
+		return err
+	}
+	psr.Batches = batches
+	return nil
+}
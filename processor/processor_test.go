@@ -0,0 +1,123 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testBatches() []*jaegerpb.Batch {
+	process := &jaegerpb.Process{
+		ServiceName: "svc",
+		Tags:        []jaegerpb.KeyValue{jaegerpb.String("host.name", "h1")},
+	}
+	return []*jaegerpb.Batch{
+		{
+			Process: process,
+			Spans: []*jaegerpb.Span{
+				{OperationName: "a", Tags: []jaegerpb.KeyValue{jaegerpb.String("env", "dev"), jaegerpb.Int64("n", 1)}},
+				{OperationName: "b", Tags: []jaegerpb.KeyValue{jaegerpb.String("old", "v")}},
+			},
+		},
+		{
+			// batches may share their process
+			Process: process,
+			Spans:   []*jaegerpb.Span{{OperationName: "c"}},
+		},
+		{
+			Spans: []*jaegerpb.Span{{OperationName: "d"}},
+		},
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	ctx := context.Background()
+
+	batches, err := AddAttributes(TargetSpan, jaegerpb.String("env", "prod"), jaegerpb.Bool("added", true)).
+		Process(ctx, testBatches())
+	require.NoError(t, err)
+	assert.Equal(t, []jaegerpb.KeyValue{
+		jaegerpb.String("env", "prod"), jaegerpb.Int64("n", 1), jaegerpb.Bool("added", true),
+	}, batches[0].Spans[0].Tags)
+	assert.Equal(t, jaegerpb.Bool("added", true), batches[2].Spans[0].Tags[1])
+
+	batches, err = AddAttributes(TargetProcess, jaegerpb.String("deployment.environment", "prod")).
+		Process(ctx, testBatches())
+	require.NoError(t, err)
+	assert.Equal(t, []jaegerpb.KeyValue{
+		jaegerpb.String("host.name", "h1"), jaegerpb.String("deployment.environment", "prod"),
+	}, batches[0].Process.Tags)
+	assert.Equal(t, []jaegerpb.KeyValue{jaegerpb.String("deployment.environment", "prod")}, batches[2].Process.Tags)
+
+	batches, err = RemoveAttributes(TargetSpan, "env", "old").Process(ctx, testBatches())
+	require.NoError(t, err)
+	assert.Equal(t, []jaegerpb.KeyValue{jaegerpb.Int64("n", 1)}, batches[0].Spans[0].Tags)
+	assert.Empty(t, batches[0].Spans[1].Tags)
+
+	batches, err = RenameAttributes(TargetSpan, map[string]string{"old": "new", "env": "n", "n": "env"}).
+		Process(ctx, testBatches())
+	require.NoError(t, err)
+	assert.Equal(t, []jaegerpb.KeyValue{jaegerpb.String("n", "dev"), jaegerpb.Int64("env", 1)}, batches[0].Spans[0].Tags)
+	assert.Equal(t, []jaegerpb.KeyValue{jaegerpb.String("new", "v")}, batches[0].Spans[1].Tags)
+}
+
+func TestProcessTagsFromEnv(t *testing.T) {
+	t.Setenv("SAPM_TEST_ENV", "staging")
+	batches, err := ProcessTagsFromEnv(map[string]string{
+		"SAPM_TEST_ENV":   "deployment.environment",
+		"SAPM_TEST_UNSET": "unset",
+	}).Process(context.Background(), testBatches())
+	require.NoError(t, err)
+	assert.Equal(t, []jaegerpb.KeyValue{
+		jaegerpb.String("host.name", "h1"), jaegerpb.String("deployment.environment", "staging"),
+	}, batches[1].Process.Tags)
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	record := func(name string) Processor {
+		return Func(func(_ context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+			calls = append(calls, name)
+			return batches[1:], nil
+		})
+	}
+	batches, err := Chain{record("first"), record("second")}.Process(context.Background(), testBatches())
+	require.NoError(t, err)
+	assert.Len(t, batches, 1)
+	assert.Equal(t, []string{"first", "second"}, calls)
+
+	failing := Func(func(context.Context, []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+		return nil, errors.New("failed")
+	})
+	calls = nil
+	_, err = Chain{failing, record("never")}.Process(context.Background(), testBatches())
+	require.Error(t, err)
+	assert.Empty(t, calls)
+
+	// Batches that were already processed are passed through.
+	ctx := ContextWithProcessed(context.Background())
+	assert.True(t, Processed(ctx))
+	assert.False(t, Processed(context.Background()))
+	batches, err = Chain{failing, record("never")}.Process(ctx, testBatches())
+	require.NoError(t, err)
+	assert.Equal(t, testBatches(), batches)
+	assert.Empty(t, calls)
+}
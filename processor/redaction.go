@@ -0,0 +1,191 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"regexp"
+	"sync/atomic"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+)
+
+// DefaultRedactionMask replaces the values matched by RedactionConfig.Patterns when no Mask is configured.
+const DefaultRedactionMask = "****"
+
+// RedactionConfig configures a Redactor. Rules apply to the tags of spans and processes and to the fields of
+// span logs. A removed tag is neither hashed nor masked, and a hashed tag is not masked.
+type RedactionConfig struct {
+	// AllowedKeys, if not empty, lists the only tag keys that are kept. All other tags are removed.
+	AllowedKeys []string
+	// BlockedKeys lists the keys of the tags that are removed.
+	BlockedKeys []string
+	// HashedKeys lists the keys of the tags whose values are replaced by their SHA-256 hash, as a hex string.
+	HashedKeys []string
+	// HashKey, if set, turns the hash into an HMAC-SHA256 keyed with HashKey, so that hashes of low-entropy values
+	// cannot be reversed by brute force.
+	HashKey []byte
+	// Patterns are regular expressions whose matches are replaced by Mask in string tag values and operation names.
+	Patterns []string
+	// Mask replaces the matches of Patterns. It defaults to DefaultRedactionMask.
+	Mask string
+}
+
+// RedactionStats counts the values redacted by a Redactor since it was created.
+type RedactionStats struct {
+	Removed int64
+	Hashed  int64
+	Masked  int64
+}
+
+// Redactor is a Processor that scrubs sensitive data from batches.
+type Redactor struct {
+	allowed  map[string]struct{}
+	blocked  map[string]struct{}
+	hashed   map[string]struct{}
+	hashKey  []byte
+	patterns []*regexp.Regexp
+	mask     string
+
+	removed atomic.Int64
+	hashes  atomic.Int64
+	masked  atomic.Int64
+}
+
+var _ Processor = (*Redactor)(nil)
+
+// NewRedactor creates a Redactor from cfg. It returns an error if one of the patterns is not a valid regular
+// expression.
+func NewRedactor(cfg RedactionConfig) (*Redactor, error) {
+	r := &Redactor{
+		allowed: keySet(cfg.AllowedKeys),
+		blocked: keySet(cfg.BlockedKeys),
+		hashed:  keySet(cfg.HashedKeys),
+		hashKey: cfg.HashKey,
+		mask:    cfg.Mask,
+	}
+	if r.mask == "" {
+		r.mask = DefaultRedactionMask
+	}
+	for _, p := range cfg.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Process redacts the batches in place. Processes and spans shared by several batches are redacted once.
+func (r *Redactor) Process(_ context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+	h := r.newHash()
+	processes := make(map[*jaegerpb.Process]struct{})
+	spans := make(map[*jaegerpb.Span]struct{})
+	for _, batch := range batches {
+		if batch == nil {
+			continue
+		}
+		if _, seen := processes[batch.Process]; batch.Process != nil && !seen {
+			processes[batch.Process] = struct{}{}
+			batch.Process.Tags = r.redactTags(batch.Process.Tags, h)
+		}
+		for _, span := range batch.Spans {
+			if span == nil {
+				continue
+			}
+			if _, seen := spans[span]; seen {
+				continue
+			}
+			spans[span] = struct{}{}
+			span.OperationName = r.maskString(span.OperationName)
+			span.Tags = r.redactTags(span.Tags, h)
+			for i := range span.Logs {
+				span.Logs[i].Fields = r.redactTags(span.Logs[i].Fields, h)
+			}
+		}
+	}
+	return batches, nil
+}
+
+// Stats returns the number of values redacted so far.
+func (r *Redactor) Stats() RedactionStats {
+	return RedactionStats{
+		Removed: r.removed.Load(),
+		Hashed:  r.hashes.Load(),
+		Masked:  r.masked.Load(),
+	}
+}
+
+func (r *Redactor) redactTags(kvs []jaegerpb.KeyValue, h hash.Hash) []jaegerpb.KeyValue {
+	kept := kvs[:0]
+	for _, kv := range kvs {
+		if r.remove(kv.Key) {
+			r.removed.Add(1)
+			continue
+		}
+		if _, ok := r.hashed[kv.Key]; ok {
+			h.Reset()
+			h.Write([]byte(kv.AsString()))
+			kv = jaegerpb.String(kv.Key, hex.EncodeToString(h.Sum(nil)))
+			r.hashes.Add(1)
+		} else if kv.VType == jaegerpb.ValueType_STRING {
+			kv.VStr = r.maskString(kv.VStr)
+		}
+		kept = append(kept, kv)
+	}
+	return kept
+}
+
+func (r *Redactor) remove(key string) bool {
+	if _, ok := r.blocked[key]; ok {
+		return true
+	}
+	if len(r.allowed) == 0 {
+		return false
+	}
+	_, ok := r.allowed[key]
+	return !ok
+}
+
+func (r *Redactor) maskString(s string) string {
+	for _, re := range r.patterns {
+		if re.MatchString(s) {
+			s = re.ReplaceAllLiteralString(s, r.mask)
+			r.masked.Add(1)
+		}
+	}
+	return s
+}
+
+func (r *Redactor) newHash() hash.Hash {
+	if len(r.hashKey) > 0 {
+		return hmac.New(sha256.New, r.hashKey)
+	}
+	return sha256.New()
+}
+
+func keySet(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		set[k] = struct{}{}
+	}
+	return set
+}
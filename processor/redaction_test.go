@@ -0,0 +1,147 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	sapmpb "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/sapmprotocol"
+)
+
+func sensitiveBatches() []*jaegerpb.Batch {
+	return []*jaegerpb.Batch{
+		{
+			Process: &jaegerpb.Process{
+				ServiceName: "svc",
+				Tags:        []jaegerpb.KeyValue{jaegerpb.String("host.ip", "10.0.0.1")},
+			},
+			Spans: []*jaegerpb.Span{
+				{
+					OperationName: "GET /users/jane@example.com",
+					Tags: []jaegerpb.KeyValue{
+						jaegerpb.String("user.email", "jane@example.com"),
+						jaegerpb.Int64("user.id", 42),
+						jaegerpb.String("password", "hunter2"),
+						jaegerpb.String("http.method", "GET"),
+					},
+					Logs: []jaegerpb.Log{{Fields: []jaegerpb.KeyValue{
+						jaegerpb.String("message", "login by jane@example.com"),
+					}}},
+				},
+			},
+		},
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor(RedactionConfig{
+		BlockedKeys: []string{"password"},
+		HashedKeys:  []string{"user.id", "host.ip"},
+		Patterns:    []string{`[\w.]+@[\w.]+`},
+	})
+	require.NoError(t, err)
+
+	batches, err := r.Process(context.Background(), sensitiveBatches())
+	require.NoError(t, err)
+
+	span := batches[0].Spans[0]
+	assert.Equal(t, "GET /users/****", span.OperationName)
+	assert.Equal(t, []jaegerpb.KeyValue{
+		jaegerpb.String("user.email", "****"),
+		jaegerpb.String("user.id", sha256Hex("42")),
+		jaegerpb.String("http.method", "GET"),
+	}, span.Tags)
+	assert.Equal(t, "login by ****", span.Logs[0].Fields[0].VStr)
+	assert.Equal(t, []jaegerpb.KeyValue{jaegerpb.String("host.ip", sha256Hex("10.0.0.1"))}, batches[0].Process.Tags)
+
+	assert.Equal(t, RedactionStats{Removed: 1, Hashed: 2, Masked: 3}, r.Stats())
+}
+
+func TestRedactorAllowList(t *testing.T) {
+	r, err := NewRedactor(RedactionConfig{
+		AllowedKeys: []string{"http.method", "user.id"},
+		HashedKeys:  []string{"user.id"},
+		HashKey:     []byte("secret"),
+		Mask:        "[redacted]",
+		Patterns:    []string{`jane`},
+	})
+	require.NoError(t, err)
+
+	batches, err := r.Process(context.Background(), sensitiveBatches())
+	require.NoError(t, err)
+
+	span := batches[0].Spans[0]
+	require.Len(t, span.Tags, 2)
+	assert.Equal(t, "user.id", span.Tags[0].Key)
+	assert.NotEqual(t, sha256Hex("42"), span.Tags[0].VStr)
+	assert.Equal(t, jaegerpb.String("http.method", "GET"), span.Tags[1])
+	assert.Equal(t, "GET /users/[redacted]@example.com", span.OperationName)
+	assert.Empty(t, span.Logs[0].Fields)
+	assert.Empty(t, batches[0].Process.Tags)
+}
+
+func TestRedactorSharedProcess(t *testing.T) {
+	r, err := NewRedactor(RedactionConfig{
+		HashedKeys: []string{"host.ip"},
+		Patterns:   []string{`[\w.]+@[\w.]+`},
+	})
+	require.NoError(t, err)
+
+	batches := sensitiveBatches()
+	batches = append(batches, &jaegerpb.Batch{Process: batches[0].Process, Spans: batches[0].Spans})
+	batches, err = r.Process(context.Background(), batches)
+	require.NoError(t, err)
+
+	assert.Equal(t, []jaegerpb.KeyValue{jaegerpb.String("host.ip", sha256Hex("10.0.0.1"))}, batches[1].Process.Tags)
+	assert.Equal(t, RedactionStats{Hashed: 1, Masked: 3}, r.Stats())
+}
+
+func TestRedactorInvalidPattern(t *testing.T) {
+	_, err := NewRedactor(RedactionConfig{Patterns: []string{"("}})
+	require.Error(t, err)
+}
+
+func TestRedactParsedRequest(t *testing.T) {
+	payload, err := (&sapmpb.PostSpansRequest{Batches: sensitiveBatches()}).Marshal()
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, sapmprotocol.TraceEndpointV2, bytes.NewReader(payload))
+	req.Header.Set(sapmprotocol.ContentTypeHeaderName, sapmprotocol.ContentTypeHeaderValue)
+
+	psr, err := sapmprotocol.ParseTraceV2Request(req)
+	require.NoError(t, err)
+
+	r, err := NewRedactor(RedactionConfig{BlockedKeys: []string{"password", "user.email"}})
+	require.NoError(t, err)
+	require.NoError(t, ProcessRequest(context.Background(), r, psr))
+
+	assert.Len(t, psr.Batches[0].Spans[0].Tags, 2)
+	assert.EqualValues(t, 2, r.Stats().Removed)
+}
@@ -0,0 +1,96 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The client uses the sampling package, so the tests running samplers in a client live in an external test package.
+package sampling_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/signalfx/sapm-proto/client"
+	"github.com/signalfx/sapm-proto/sampling"
+	"github.com/signalfx/sapm-proto/sapmprotocol"
+)
+
+func TestTailSamplerClient(t *testing.T) {
+	var mu sync.Mutex
+	var received []jaegerpb.SpanID
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		psr, err := sapmprotocol.ParseTraceV2Request(req)
+		if !assert.NoError(t, err) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, b := range psr.Batches {
+			for _, s := range b.Spans {
+				received = append(received, s.SpanID)
+			}
+		}
+	}))
+	defer server.Close()
+	receivedSpans := func() []jaegerpb.SpanID {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]jaegerpb.SpanID(nil), received...)
+	}
+
+	// The sampler forwards the sampled traces to the client running it.
+	var c *client.Client
+	var calls atomic.Int32
+	ts, err := sampling.NewTailSampler(sampling.TailConfig{
+		DecisionWait: time.Hour,
+		Policies:     []sampling.Policy{sampling.ErrorPolicy()},
+		Consumer: func(ctx context.Context, batches []*jaegerpb.Batch) error {
+			calls.Add(1)
+			return c.Export(ctx, batches)
+		},
+	})
+	require.NoError(t, err)
+	c, err = client.New(client.WithEndpoint(server.URL), client.WithProcessors(ts))
+	require.NoError(t, err)
+	defer c.Stop()
+
+	process := &jaegerpb.Process{ServiceName: "svc"}
+	newSpan := func(traceID uint64, spanID jaegerpb.SpanID, tags ...jaegerpb.KeyValue) *jaegerpb.Span {
+		return &jaegerpb.Span{TraceID: jaegerpb.TraceID{Low: traceID}, SpanID: spanID, Tags: tags}
+	}
+	require.NoError(t, c.Export(context.Background(), []*jaegerpb.Batch{{
+		Process: process,
+		Spans:   []*jaegerpb.Span{newSpan(1, 10, jaegerpb.Bool("error", true)), newSpan(2, 20)},
+	}}))
+	assert.Empty(t, receivedSpans())
+
+	require.NoError(t, ts.Shutdown(context.Background()))
+	assert.Equal(t, []jaegerpb.SpanID{10}, receivedSpans())
+
+	// Late spans of a sampled trace are sent right away.
+	require.NoError(t, c.Export(context.Background(), []*jaegerpb.Batch{{
+		Process: process,
+		Spans:   []*jaegerpb.Span{newSpan(1, 11), newSpan(2, 21)},
+	}}))
+	assert.Equal(t, []jaegerpb.SpanID{10, 11}, receivedSpans())
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -0,0 +1,176 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sampling provides processors that sample the spans of Jaeger batches. They implement processor.Processor
+// so they can be passed to client.WithProcessors or run on the requests parsed by sapmprotocol with
+// processor.ProcessRequest.
+package sampling
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+
+	"github.com/signalfx/sapm-proto/processor"
+)
+
+// maxRandomNumber is the upper bound of the trace ID bits used for probabilistic sampling, matching the Jaeger SDKs
+// so that services sampling at the same ratio keep the same traces.
+const maxRandomNumber = ^(uint64(1) << 63)
+
+// Probabilistic is a Processor keeping a fixed ratio of the traces. The decision only depends on the trace ID, so all
+// the spans of a trace are kept or dropped together, even across processes.
+type Probabilistic struct {
+	boundary uint64
+}
+
+var _ processor.Processor = (*Probabilistic)(nil)
+
+// NewProbabilistic creates a Probabilistic sampler keeping the given ratio of traces, between 0 and 1.
+func NewProbabilistic(ratio float64) (*Probabilistic, error) {
+	if ratio < 0 || ratio > 1 || math.IsNaN(ratio) {
+		return nil, fmt.Errorf("sampling ratio must be between 0 and 1, got %v", ratio)
+	}
+	return &Probabilistic{boundary: uint64(float64(maxRandomNumber) * ratio)}, nil
+}
+
+// Sampled returns true if the trace is kept.
+func (p *Probabilistic) Sampled(traceID jaegerpb.TraceID) bool {
+	return traceID.Low&maxRandomNumber < p.boundary
+}
+
+// Process returns the spans of the sampled traces.
+func (p *Probabilistic) Process(_ context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+	return filterSpans(batches, func(_ *jaegerpb.Process, span *jaegerpb.Span) bool {
+		return p.Sampled(span.TraceID)
+	}), nil
+}
+
+// RateLimiter is a Processor limiting the number of spans per second of each service. Spans above the limit are
+// dropped.
+type RateLimiter struct {
+	defaultRate float64
+	rates       map[string]float64
+	now         func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var _ processor.Processor = (*RateLimiter)(nil)
+
+// NewRateLimiter creates a RateLimiter allowing defaultRate spans per second to each service, except for the services
+// listed in perService. A rate of 0 drops every span of the service, a negative rate disables the limit.
+func NewRateLimiter(defaultRate float64, perService map[string]float64) *RateLimiter {
+	rates := make(map[string]float64, len(perService))
+	for service, rate := range perService {
+		rates[service] = rate
+	}
+	return &RateLimiter{
+		defaultRate: defaultRate,
+		rates:       rates,
+		now:         time.Now,
+		buckets:     map[string]*tokenBucket{},
+	}
+}
+
+// Process returns the spans allowed by the rate limits.
+func (r *RateLimiter) Process(_ context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	return filterSpans(batches, func(process *jaegerpb.Process, _ *jaegerpb.Span) bool {
+		service := ""
+		if process != nil {
+			service = process.ServiceName
+		}
+		return r.bucket(service, now).take(now)
+	}), nil
+}
+
+func (r *RateLimiter) bucket(service string, now time.Time) *tokenBucket {
+	b, ok := r.buckets[service]
+	if !ok {
+		rate, ok := r.rates[service]
+		if !ok {
+			rate = r.defaultRate
+		}
+		b = newTokenBucket(rate, now)
+		r.buckets[service] = b
+	}
+	return b
+}
+
+// tokenBucket allows rate events per second, with bursts of up to rate events. The burst is at least one event, so
+// that rates below one event per second let an event through every 1/rate seconds.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	burst := max(rate, 1)
+	if rate == 0 {
+		burst = 0
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	if b.rate < 0 {
+		return true
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// filterSpans returns the batches holding the spans for which keep returns true. Batches left without spans are
+// dropped. The input slices are not modified.
+func filterSpans(batches []*jaegerpb.Batch, keep func(*jaegerpb.Process, *jaegerpb.Span) bool) []*jaegerpb.Batch {
+	out := make([]*jaegerpb.Batch, 0, len(batches))
+	for _, batch := range batches {
+		if batch == nil {
+			continue
+		}
+		var spans []*jaegerpb.Span
+		for _, span := range batch.Spans {
+			if span != nil && keep(batch.Process, span) {
+				spans = append(spans, span)
+			}
+		}
+		switch {
+		case len(spans) == 0:
+		case len(spans) == len(batch.Spans):
+			out = append(out, batch)
+		default:
+			b := *batch
+			b.Spans = spans
+			out = append(out, &b)
+		}
+	}
+	return out
+}
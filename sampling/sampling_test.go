@@ -0,0 +1,267 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sampling
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func span(traceID uint64, tags ...jaegerpb.KeyValue) *jaegerpb.Span {
+	return &jaegerpb.Span{TraceID: jaegerpb.TraceID{Low: traceID}, SpanID: jaegerpb.SpanID(traceID), Tags: tags}
+}
+
+func TestProbabilistic(t *testing.T) {
+	_, err := NewProbabilistic(1.5)
+	require.Error(t, err)
+
+	all, err := NewProbabilistic(1)
+	require.NoError(t, err)
+	none, err := NewProbabilistic(0)
+	require.NoError(t, err)
+	half, err := NewProbabilistic(0.5)
+	require.NoError(t, err)
+
+	batch := &jaegerpb.Batch{Process: &jaegerpb.Process{ServiceName: "svc"}}
+	for i := uint64(0); i < 1000; i++ {
+		batch.Spans = append(batch.Spans, span(i*0x9E3779B97F4A7C15))
+	}
+	batches := []*jaegerpb.Batch{batch}
+
+	out, err := all.Process(context.Background(), batches)
+	require.NoError(t, err)
+	assert.Equal(t, batches, out)
+
+	out, err = none.Process(context.Background(), batches)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	out, err = half.Process(context.Background(), batches)
+	require.NoError(t, err)
+	require.Len(t, out, 1)
+	assert.InDelta(t, 500, len(out[0].Spans), 50)
+	assert.Len(t, batch.Spans, 1000, "input batch must not be modified")
+	for _, s := range out[0].Spans {
+		assert.True(t, half.Sampled(s.TraceID))
+	}
+
+	// Jaeger SDKs only use the low 63 bits of the trace ID.
+	assert.True(t, half.Sampled(jaegerpb.TraceID{High: 1, Low: 1 << 63}))
+	assert.False(t, half.Sampled(jaegerpb.TraceID{Low: 1<<63 - 1}))
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewRateLimiter(2, map[string]float64{"noisy": 1, "unlimited": -1})
+	r.now = func() time.Time { return now }
+
+	batches := func() []*jaegerpb.Batch {
+		var out []*jaegerpb.Batch
+		for _, service := range []string{"svc", "noisy", "unlimited"} {
+			out = append(out, &jaegerpb.Batch{
+				Process: &jaegerpb.Process{ServiceName: service},
+				Spans:   []*jaegerpb.Span{span(1), span(2), span(3)},
+			})
+		}
+		return out
+	}
+	counts := func(batches []*jaegerpb.Batch) map[string]int {
+		c := map[string]int{}
+		for _, b := range batches {
+			c[b.Process.ServiceName] += len(b.Spans)
+		}
+		return c
+	}
+
+	out, err := r.Process(context.Background(), batches())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"svc": 2, "noisy": 1, "unlimited": 3}, counts(out))
+
+	out, err = r.Process(context.Background(), batches())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"unlimited": 3}, counts(out))
+
+	now = now.Add(500 * time.Millisecond)
+	out, err = r.Process(context.Background(), batches())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"svc": 1, "unlimited": 3}, counts(out))
+}
+
+func TestRateLimiterFractionalRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewRateLimiter(0.5, map[string]float64{"muted": 0})
+	r.now = func() time.Time { return now }
+
+	kept := map[string]int{}
+	for i := 0; i < 12; i++ {
+		out, err := r.Process(context.Background(), []*jaegerpb.Batch{
+			{Process: &jaegerpb.Process{ServiceName: "svc"}, Spans: []*jaegerpb.Span{span(1), span(2)}},
+			{Process: &jaegerpb.Process{ServiceName: "muted"}, Spans: []*jaegerpb.Span{span(3)}},
+		})
+		require.NoError(t, err)
+		for _, b := range out {
+			kept[b.Process.ServiceName] += len(b.Spans)
+		}
+		now = now.Add(500 * time.Millisecond)
+	}
+	// One span right away, then one every 2 seconds.
+	assert.Equal(t, map[string]int{"svc": 3}, kept)
+}
+
+func TestPolicies(t *testing.T) {
+	start := time.Unix(100, 0)
+	process := &jaegerpb.Process{ServiceName: "svc", Tags: []jaegerpb.KeyValue{jaegerpb.String("env", "prod")}}
+	trace := func(spans ...*jaegerpb.Span) *Trace {
+		tr := &Trace{}
+		for _, s := range spans {
+			tr.Spans = append(tr.Spans, s)
+			tr.Processes = append(tr.Processes, process)
+		}
+		return tr
+	}
+
+	assert.True(t, ErrorPolicy().Sample(trace(span(1), span(1, jaegerpb.Bool("error", true)))))
+	assert.True(t, ErrorPolicy().Sample(trace(span(1, jaegerpb.String("otel.status_code", "ERROR")))))
+	assert.False(t, ErrorPolicy().Sample(trace(span(1, jaegerpb.Bool("error", false)))))
+
+	long := trace(
+		&jaegerpb.Span{StartTime: start, Duration: time.Second},
+		&jaegerpb.Span{StartTime: start.Add(time.Second), Duration: time.Second},
+	)
+	assert.True(t, LatencyPolicy(2*time.Second).Sample(long))
+	assert.False(t, LatencyPolicy(3*time.Second).Sample(long))
+	assert.False(t, LatencyPolicy(0).Sample(trace()))
+
+	assert.True(t, TagPolicy("http.status_code", "500").Sample(trace(span(1, jaegerpb.Int64("http.status_code", 500)))))
+	assert.False(t, TagPolicy("http.status_code", "500").Sample(trace(span(1, jaegerpb.Int64("http.status_code", 200)))))
+	assert.True(t, TagPolicy("env").Sample(trace(span(1))))
+	assert.False(t, TagPolicy("env", "dev").Sample(trace(span(1))))
+}
+
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches []*jaegerpb.Batch
+}
+
+func (r *batchRecorder) consume(_ context.Context, batches []*jaegerpb.Batch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, batches...)
+	return nil
+}
+
+func (r *batchRecorder) spans() []uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ids []uint64
+	for _, b := range r.batches {
+		for _, s := range b.Spans {
+			ids = append(ids, uint64(s.SpanID))
+		}
+	}
+	return ids
+}
+
+func TestTailSampler(t *testing.T) {
+	now := time.Unix(0, 0)
+	rec := &batchRecorder{}
+	ts := newTailSampler(TailConfig{
+		DecisionWait: time.Second,
+		MaxTraces:    10,
+		Policies:     []Policy{ErrorPolicy()},
+		Consumer:     rec.consume,
+	}, func() time.Time { return now })
+
+	process := &jaegerpb.Process{ServiceName: "svc"}
+	errored := &jaegerpb.Span{TraceID: jaegerpb.TraceID{Low: 1}, SpanID: 11, Tags: []jaegerpb.KeyValue{jaegerpb.Bool("error", true)}}
+	out, err := ts.Process(context.Background(), []*jaegerpb.Batch{{
+		Process: process,
+		Spans:   []*jaegerpb.Span{{TraceID: jaegerpb.TraceID{Low: 1}, SpanID: 10}, {TraceID: jaegerpb.TraceID{Low: 2}, SpanID: 20}},
+	}})
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	now = now.Add(500 * time.Millisecond)
+	_, err = ts.Process(context.Background(), []*jaegerpb.Batch{{Process: process, Spans: []*jaegerpb.Span{errored}}})
+	require.NoError(t, err)
+	assert.Empty(t, ts.decideExpired())
+
+	now = now.Add(500 * time.Millisecond)
+	ts.consume(context.Background(), ts.decideExpired())
+	assert.Equal(t, []uint64{10, 11}, rec.spans())
+	require.Len(t, rec.batches, 1)
+	assert.Same(t, process, rec.batches[0].Process)
+
+	// Late spans follow the decision made for their trace.
+	_, err = ts.Process(context.Background(), []*jaegerpb.Batch{{
+		Process: process,
+		Spans:   []*jaegerpb.Span{{TraceID: jaegerpb.TraceID{Low: 1}, SpanID: 12}, {TraceID: jaegerpb.TraceID{Low: 2}, SpanID: 21}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{10, 11, 12}, rec.spans())
+	assert.Empty(t, ts.traces)
+
+	// Decisions are forgotten after another decision window.
+	now = now.Add(2 * time.Second)
+	ts.decideExpired()
+	assert.Empty(t, ts.decided)
+}
+
+func TestTailSamplerMaxTraces(t *testing.T) {
+	rec := &batchRecorder{}
+	ts := newTailSampler(TailConfig{
+		DecisionWait: time.Hour,
+		MaxTraces:    1,
+		Policies:     []Policy{TagPolicy("keep")},
+		Consumer:     rec.consume,
+	}, time.Now)
+
+	_, err := ts.Process(context.Background(), []*jaegerpb.Batch{{
+		Spans: []*jaegerpb.Span{span(1, jaegerpb.Bool("keep", true)), span(2)},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1}, rec.spans())
+	assert.Len(t, ts.traces, 1)
+}
+
+func TestTailSamplerShutdown(t *testing.T) {
+	_, err := NewTailSampler(TailConfig{Policies: []Policy{ErrorPolicy()}})
+	require.Error(t, err)
+	_, err = NewTailSampler(TailConfig{Consumer: (&batchRecorder{}).consume})
+	require.Error(t, err)
+
+	rec := &batchRecorder{}
+	ts, err := NewTailSampler(TailConfig{
+		DecisionWait: time.Hour,
+		Policies:     []Policy{ErrorPolicy()},
+		Consumer:     rec.consume,
+	})
+	require.NoError(t, err)
+	_, err = ts.Process(context.Background(), []*jaegerpb.Batch{{
+		Spans: []*jaegerpb.Span{span(1, jaegerpb.Bool("error", true)), span(2)},
+	}})
+	require.NoError(t, err)
+	assert.Empty(t, rec.spans())
+
+	require.NoError(t, ts.Shutdown(context.Background()))
+	assert.Equal(t, []uint64{1}, rec.spans())
+	require.NoError(t, ts.Shutdown(context.Background()))
+}
@@ -0,0 +1,379 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sampling
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+
+	"github.com/signalfx/sapm-proto/processor"
+)
+
+const (
+	// DefaultDecisionWait is the time spans are buffered before the sampling decision is made.
+	DefaultDecisionWait = 10 * time.Second
+	// DefaultMaxTraces is the number of traces buffered by default.
+	DefaultMaxTraces = 50000
+
+	// otelStatusCodeTag is the tag holding the span status of spans converted from OpenTelemetry.
+	otelStatusCodeTag = "otel.status_code"
+)
+
+// Trace holds the spans of a trace buffered by a TailSampler.
+type Trace struct {
+	ID    jaegerpb.TraceID
+	Spans []*jaegerpb.Span
+	// Processes holds the process of each span: Processes[i] is the process of Spans[i].
+	Processes []*jaegerpb.Process
+}
+
+// Policy decides whether a trace is sampled once its decision window is over.
+type Policy interface {
+	Sample(trace *Trace) bool
+}
+
+// PolicyFunc is an adapter to use ordinary functions as policies.
+type PolicyFunc func(trace *Trace) bool
+
+// Sample calls f(trace).
+func (f PolicyFunc) Sample(trace *Trace) bool {
+	return f(trace)
+}
+
+// ErrorPolicy samples the traces holding a span with the error tag set to true, or with an OpenTelemetry
+// ERROR status.
+func ErrorPolicy() Policy {
+	return PolicyFunc(func(trace *Trace) bool {
+		for _, span := range trace.Spans {
+			for _, tag := range span.Tags {
+				switch {
+				case tag.Key == "error" && tag.VType == jaegerpb.ValueType_BOOL && tag.VBool:
+					return true
+				case tag.Key == otelStatusCodeTag && tag.VStr == "ERROR":
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// LatencyPolicy samples the traces lasting at least threshold, from the start of their first span to the end of
+// their last span.
+func LatencyPolicy(threshold time.Duration) Policy {
+	return PolicyFunc(func(trace *Trace) bool {
+		var start, end time.Time
+		for i, span := range trace.Spans {
+			spanEnd := span.StartTime.Add(span.Duration)
+			if i == 0 || span.StartTime.Before(start) {
+				start = span.StartTime
+			}
+			if i == 0 || spanEnd.After(end) {
+				end = spanEnd
+			}
+		}
+		return len(trace.Spans) > 0 && end.Sub(start) >= threshold
+	})
+}
+
+// TagPolicy samples the traces holding a span whose span or process tags include key with one of the given values,
+// compared as strings. Without values, any tag with the key matches.
+func TagPolicy(key string, values ...string) Policy {
+	matches := func(tags []jaegerpb.KeyValue) bool {
+		for _, tag := range tags {
+			if tag.Key != key {
+				continue
+			}
+			if len(values) == 0 {
+				return true
+			}
+			v := tag.AsString()
+			for _, value := range values {
+				if v == value {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return PolicyFunc(func(trace *Trace) bool {
+		for i, span := range trace.Spans {
+			if matches(span.Tags) || (trace.Processes[i] != nil && matches(trace.Processes[i].Tags)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// TailConfig configures a TailSampler.
+type TailConfig struct {
+	// DecisionWait is the time spans are buffered after the first span of their trace was received.
+	// It defaults to DefaultDecisionWait.
+	DecisionWait time.Duration
+	// MaxTraces is the number of traces buffered. When it is reached, the decision for the oldest trace is made
+	// early. It defaults to DefaultMaxTraces.
+	MaxTraces int
+	// Policies decide which traces are sampled. A trace is sampled if any of the policies samples it.
+	Policies []Policy
+	// Consumer receives the spans of the sampled traces and must not be nil. It is called from a background goroutine
+	// when decision windows expire, and synchronously, on the goroutine of the caller, by Process for the late spans
+	// of sampled traces and the traces decided early because MaxTraces was reached, and by Shutdown for the remaining
+	// traces. It may therefore be called concurrently and delays the return of Process. An error returned by
+	// Consumer is dropped, the consumer is expected to report it. The context passed to Consumer is marked with
+	// processor.ContextWithProcessed, so Consumer may be the Export method of the client running the TailSampler:
+	// the spans skip the processors of the client instead of being buffered again.
+	Consumer func(ctx context.Context, batches []*jaegerpb.Batch) error
+}
+
+// TailSampler is a Processor buffering spans for a decision window, then passing the spans of the traces sampled by
+// its policies to a consumer, for instance client.Client.Export. Process keeps every span it receives and returns no
+// batches, so the TailSampler must be the last processor of a chain. Spans received after the decision for their
+// trace was made follow that decision, as long as the decision is remembered, which is for another decision window.
+//
+// The TailSampler keeps the *jaegerpb.Span and *jaegerpb.Process of the batches passed to Process after it returns,
+// until they are passed to the consumer or dropped. The batches must not be modified nor reused by the caller, so the
+// TailSampler must not process the requests of a handler created with sapmprotocol.WithPooledRequests, whose spans
+// are recycled once the consumer of the handler returns.
+type TailSampler struct {
+	cfg TailConfig
+	now func() time.Time
+
+	mu      sync.Mutex
+	traces  map[jaegerpb.TraceID]*pendingTrace
+	order   []jaegerpb.TraceID
+	decided map[jaegerpb.TraceID]decision
+
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+var _ processor.Processor = (*TailSampler)(nil)
+
+type pendingTrace struct {
+	Trace
+	deadline time.Time
+}
+
+type decision struct {
+	sampled bool
+	expiry  time.Time
+}
+
+// NewTailSampler creates a TailSampler and starts its background decision loop. Shutdown must be called to stop it.
+func NewTailSampler(cfg TailConfig) (*TailSampler, error) {
+	if cfg.Consumer == nil {
+		return nil, errors.New("tail sampling consumer cannot be nil")
+	}
+	if len(cfg.Policies) == 0 {
+		return nil, errors.New("tail sampling requires at least one policy")
+	}
+	if cfg.DecisionWait <= 0 {
+		cfg.DecisionWait = DefaultDecisionWait
+	}
+	if cfg.MaxTraces <= 0 {
+		cfg.MaxTraces = DefaultMaxTraces
+	}
+	t := newTailSampler(cfg, time.Now)
+	go t.run()
+	return t, nil
+}
+
+func newTailSampler(cfg TailConfig, now func() time.Time) *TailSampler {
+	return &TailSampler{
+		cfg:     cfg,
+		now:     now,
+		traces:  map[jaegerpb.TraceID]*pendingTrace{},
+		decided: map[jaegerpb.TraceID]decision{},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Process buffers the spans until the sampling decision for their trace is made. It returns no batches, except
+// when ctx is marked with processor.ContextWithProcessed: the batches were then forwarded by a sampler and are
+// returned unchanged. Late spans of sampled traces are passed to the consumer right away.
+func (t *TailSampler) Process(ctx context.Context, batches []*jaegerpb.Batch) ([]*jaegerpb.Batch, error) {
+	if processor.Processed(ctx) {
+		return batches, nil
+	}
+	t.mu.Lock()
+	now := t.now()
+	var late []*Trace
+	lateSpans := map[jaegerpb.TraceID]*Trace{}
+	for _, batch := range batches {
+		if batch == nil {
+			continue
+		}
+		for _, span := range batch.Spans {
+			if span == nil {
+				continue
+			}
+			if d, ok := t.decided[span.TraceID]; ok {
+				if d.sampled {
+					tr, ok := lateSpans[span.TraceID]
+					if !ok {
+						tr = &Trace{ID: span.TraceID}
+						lateSpans[span.TraceID] = tr
+						late = append(late, tr)
+					}
+					tr.Spans = append(tr.Spans, span)
+					tr.Processes = append(tr.Processes, batch.Process)
+				}
+				continue
+			}
+			t.add(now, batch.Process, span)
+		}
+	}
+	sampled := t.evict()
+	t.mu.Unlock()
+
+	t.consume(ctx, append(sampled, late...))
+	return nil, nil
+}
+
+// Shutdown stops the decision loop, then makes the decision for every buffered trace and passes the sampled ones
+// to the consumer.
+func (t *TailSampler) Shutdown(ctx context.Context) error {
+	t.once.Do(func() {
+		close(t.done)
+	})
+	select {
+	case <-t.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	t.mu.Lock()
+	var sampled []*Trace
+	for _, id := range t.order {
+		if tr := t.decide(id, t.now()); tr != nil {
+			sampled = append(sampled, tr)
+		}
+	}
+	t.order = nil
+	t.mu.Unlock()
+
+	t.consume(ctx, sampled)
+	return nil
+}
+
+func (t *TailSampler) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(max(t.cfg.DecisionWait/10, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.consume(context.Background(), t.decideExpired())
+		}
+	}
+}
+
+// add must be called with the lock held.
+func (t *TailSampler) add(now time.Time, process *jaegerpb.Process, span *jaegerpb.Span) {
+	tr, ok := t.traces[span.TraceID]
+	if !ok {
+		tr = &pendingTrace{Trace: Trace{ID: span.TraceID}, deadline: now.Add(t.cfg.DecisionWait)}
+		t.traces[span.TraceID] = tr
+		t.order = append(t.order, span.TraceID)
+	}
+	tr.Spans = append(tr.Spans, span)
+	tr.Processes = append(tr.Processes, process)
+}
+
+// evict makes the decision early for the oldest traces above MaxTraces. It must be called with the lock held.
+func (t *TailSampler) evict() []*Trace {
+	var sampled []*Trace
+	now := t.now()
+	for len(t.order) > t.cfg.MaxTraces {
+		if tr := t.decide(t.order[0], now); tr != nil {
+			sampled = append(sampled, tr)
+		}
+		t.order = t.order[1:]
+	}
+	return sampled
+}
+
+// decideExpired makes the decision for the traces whose decision window is over.
+func (t *TailSampler) decideExpired() []*Trace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var sampled []*Trace
+	for len(t.order) > 0 && !t.traces[t.order[0]].deadline.After(now) {
+		if tr := t.decide(t.order[0], now); tr != nil {
+			sampled = append(sampled, tr)
+		}
+		t.order = t.order[1:]
+	}
+	for id, d := range t.decided {
+		if d.expiry.Before(now) {
+			delete(t.decided, id)
+		}
+	}
+	return sampled
+}
+
+// decide removes the trace from the buffer and returns it if it is sampled. It must be called with the lock held.
+func (t *TailSampler) decide(id jaegerpb.TraceID, now time.Time) *Trace {
+	tr := t.traces[id]
+	delete(t.traces, id)
+	sampled := false
+	for _, p := range t.cfg.Policies {
+		if p.Sample(&tr.Trace) {
+			sampled = true
+			break
+		}
+	}
+	t.decided[id] = decision{sampled: sampled, expiry: now.Add(t.cfg.DecisionWait)}
+	if !sampled {
+		return nil
+	}
+	return &tr.Trace
+}
+
+func (t *TailSampler) consume(ctx context.Context, traces []*Trace) {
+	if len(traces) == 0 {
+		return
+	}
+	_ = t.cfg.Consumer(processor.ContextWithProcessed(ctx), toBatches(traces))
+}
+
+// toBatches groups the spans of the traces into one batch per process.
+func toBatches(traces []*Trace) []*jaegerpb.Batch {
+	var batches []*jaegerpb.Batch
+	byProcess := map[*jaegerpb.Process]*jaegerpb.Batch{}
+	for _, tr := range traces {
+		for i, span := range tr.Spans {
+			process := tr.Processes[i]
+			b, ok := byProcess[process]
+			if !ok {
+				b = &jaegerpb.Batch{Process: process}
+				byProcess[process] = b
+				batches = append(batches, b)
+			}
+			b.Spans = append(b.Spans, span)
+		}
+	}
+	return batches
+}
@@ -0,0 +1,136 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Capabilities are the capabilities a SAPM server advertises in the headers of its responses, so that clients can
+// adapt their requests to the server.
+type Capabilities struct {
+	// Version is the SAPM protocol version of the server.
+	Version string
+	// Encodings are the Content-Encodings accepted by the server. They are sent in the Accept-Encoding header of the
+	// responses, as defined by RFC 7694.
+	Encodings []string
+	// MaxRequestBytes is the maximum size of the request bodies accepted by the server, as sent on the wire. It is 0
+	// if there is no limit.
+	MaxRequestBytes int64
+	// MaxDecompressedBytes is the maximum size of the request bodies accepted by the server, once decompressed. It is
+	// 0 if there is no limit.
+	MaxDecompressedBytes int64
+	// Features are the protocol features supported by the server, such as FeatureJSON.
+	Features []string
+}
+
+// SetHeaders advertises the capabilities in the headers of a response.
+func (c *Capabilities) SetHeaders(h http.Header) {
+	h.Set(ProtocolVersionHeaderName, c.Version)
+	if len(c.Encodings) > 0 {
+		h.Set(AcceptEncodingHeaderName, strings.Join(c.Encodings, ", "))
+	}
+	if c.MaxRequestBytes > 0 {
+		h.Set(MaxRequestBytesHeaderName, strconv.FormatInt(c.MaxRequestBytes, 10))
+	}
+	if c.MaxDecompressedBytes > 0 {
+		h.Set(MaxDecompressedBytesHeaderName, strconv.FormatInt(c.MaxDecompressedBytes, 10))
+	}
+	if len(c.Features) > 0 {
+		h.Set(FeaturesHeaderName, strings.Join(c.Features, ", "))
+	}
+}
+
+// ParseCapabilities returns the capabilities advertised in the headers of a response. It returns nil if the response
+// does not advertise any, which is the case of servers predating the capability headers. Malformed sizes are
+// ignored.
+func ParseCapabilities(h http.Header) *Capabilities {
+	version := h.Get(ProtocolVersionHeaderName)
+	if version == "" {
+		return nil
+	}
+	c := &Capabilities{
+		Version:   version,
+		Encodings: splitList(h.Get(AcceptEncodingHeaderName)),
+		Features:  splitList(h.Get(FeaturesHeaderName)),
+	}
+	c.MaxRequestBytes, _ = strconv.ParseInt(h.Get(MaxRequestBytesHeaderName), 10, 64)
+	c.MaxDecompressedBytes, _ = strconv.ParseInt(h.Get(MaxDecompressedBytesHeaderName), 10, 64)
+	return c
+}
+
+// SupportsEncoding returns true if the server accepts every encoding of a Content-Encoding header value. The
+// identity encoding is always accepted, and servers that do not advertise their encodings are assumed to accept any.
+func (c *Capabilities) SupportsEncoding(contentEncoding string) bool {
+	if len(c.Encodings) == 0 {
+		return true
+	}
+	for _, name := range strings.Split(contentEncoding, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.EqualFold(name, "identity") {
+			continue
+		}
+		if !containsFold(c.Encodings, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasFeature returns true if the server supports the feature.
+func (c *Capabilities) HasFeature(feature string) bool {
+	return containsFold(c.Features, feature)
+}
+
+// capabilities returns the capabilities of the handler, computed once when it is created.
+func (h *traceHandler) capabilities() *Capabilities {
+	limits := parseLimits{}
+	for _, opt := range h.parseOptions {
+		opt(&limits)
+	}
+	maxRequestBytes := h.maxRequestBytes
+	if limits.maxCompressedSize > 0 && (maxRequestBytes <= 0 || limits.maxCompressedSize < maxRequestBytes) {
+		maxRequestBytes = limits.maxCompressedSize
+	}
+	return &Capabilities{
+		Version:              ProtocolVersion,
+		Encodings:            Encodings(),
+		MaxRequestBytes:      maxRequestBytes,
+		MaxDecompressedBytes: limits.maxDecompressedSize,
+		Features:             []string{FeatureJSON, FeaturePartialSuccess},
+	}
+}
+
+// splitList splits a comma-separated header value, skipping empty elements.
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
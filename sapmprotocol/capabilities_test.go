@@ -0,0 +1,94 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+)
+
+func TestCapabilitiesHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		caps *Capabilities
+	}{
+		{name: "version only", caps: &Capabilities{Version: "2.1"}},
+		{
+			name: "all",
+			caps: &Capabilities{
+				Version:              ProtocolVersion,
+				Encodings:            []string{"gzip", "zstd"},
+				MaxRequestBytes:      1 << 20,
+				MaxDecompressedBytes: 8 << 20,
+				Features:             []string{FeatureJSON, FeaturePartialSuccess},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			tt.caps.SetHeaders(h)
+			assert.Equal(t, tt.caps, ParseCapabilities(h))
+		})
+	}
+
+	assert.Nil(t, ParseCapabilities(http.Header{AcceptEncodingHeaderName: {"gzip"}}))
+
+	h := http.Header{}
+	h.Set(ProtocolVersionHeaderName, "3")
+	h.Set(AcceptEncodingHeaderName, " gzip,, ZSTD ")
+	h.Set(MaxRequestBytesHeaderName, "lots")
+	caps := ParseCapabilities(h)
+	require.NotNil(t, caps)
+	assert.Equal(t, []string{"gzip", "ZSTD"}, caps.Encodings)
+	assert.Zero(t, caps.MaxRequestBytes)
+	assert.True(t, caps.SupportsEncoding("zstd"))
+	assert.True(t, caps.SupportsEncoding("gzip, zstd"))
+	assert.True(t, caps.SupportsEncoding("identity"))
+	assert.False(t, caps.SupportsEncoding("gzip, br"))
+	assert.False(t, caps.HasFeature(FeatureJSON))
+	assert.True(t, (&Capabilities{Version: "2"}).SupportsEncoding("br"))
+}
+
+func TestTraceHandlerCapabilities(t *testing.T) {
+	h := NewTraceHandler(func(context.Context, *splunksapm.PostSpansRequest, string) error { return nil },
+		WithMaxRequestBytes(4096),
+		WithParseOptions(WithMaxCompressedSize(1024), WithMaxDecompressedSize(8192)),
+	)
+
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		req := httptest.NewRequest(method, TraceEndpointV2, bytes.NewReader(nil))
+		req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		assert.Equal(t, &Capabilities{
+			Version:              ProtocolVersion,
+			Encodings:            Encodings(),
+			MaxRequestBytes:      1024,
+			MaxDecompressedBytes: 8192,
+			Features:             []string{FeatureJSON, FeaturePartialSuccess},
+		}, ParseCapabilities(rw.Header()), method)
+	}
+	assert.Contains(t, Encodings(), ZStdEncodingHeaderValue)
+}
@@ -21,6 +21,10 @@ const (
 	ContentTypeHeaderName = "Content-Type"
 	// ContentTypeHeaderValue is the value used for protobuf Content-Type http headers
 	ContentTypeHeaderValue = "application/x-protobuf"
+	// ContentTypeProtobufHeaderValue is the standard protobuf Content-Type, accepted as an alias of ContentTypeHeaderValue
+	ContentTypeProtobufHeaderValue = "application/protobuf"
+	// ContentTypeJSONHeaderValue is the value used for JSON-encoded Content-Type http headers
+	ContentTypeJSONHeaderValue = "application/json"
 
 	// AcceptEncodingHeaderName is the http header name used for Accept-Encoding
 	AcceptEncodingHeaderName = "Accept-Encoding"
@@ -30,4 +34,41 @@ const (
 	GZipEncodingHeaderValue = "gzip"
 	// ZStdEncodingHeaderValue is the value used for zstd-compressed encoding http headers
 	ZStdEncodingHeaderValue = "zstd"
+	// DeflateEncodingHeaderValue is the value used for deflate-compressed encoding http headers
+	DeflateEncodingHeaderValue = "deflate"
+	// SnappyEncodingHeaderValue is the value used for snappy-compressed (framing format) encoding http headers
+	SnappyEncodingHeaderValue = "snappy"
+	// LZ4EncodingHeaderValue is the value used for lz4-compressed (frame format) encoding http headers
+	LZ4EncodingHeaderValue = "lz4"
+	// BrotliEncodingHeaderValue is the value used for brotli-compressed encoding http headers
+	BrotliEncodingHeaderValue = "br"
+
+	// TokenHeaderName is the http header name holding the access token of the client
+	TokenHeaderName = "X-SF-Token" // nolint:gosec
+	// RetryAfterHeaderName is the http header name used to tell clients how many seconds to wait before retrying
+	RetryAfterHeaderName = "Retry-After"
+
+	// IdempotencyKeyHeaderName is the http header name holding the key identifying a logical request across retries
+	IdempotencyKeyHeaderName = "Idempotency-Key"
+
+	// ProtocolVersionHeaderName is the http header name holding the SAPM protocol version of the sender. Clients send
+	// it with their requests, servers send it with their responses along with their capabilities.
+	ProtocolVersionHeaderName = "X-SAPM-Version"
+	// ProtocolVersion is the version of the SAPM protocol implemented by this package
+	ProtocolVersion = "2.1"
+	// MaxRequestBytesHeaderName is the http response header name holding the maximum size of the request bodies
+	// accepted by the server, as sent on the wire
+	MaxRequestBytesHeaderName = "X-SAPM-Max-Request-Bytes"
+	// MaxDecompressedBytesHeaderName is the http response header name holding the maximum size of the request bodies
+	// accepted by the server, once decompressed
+	MaxDecompressedBytesHeaderName = "X-SAPM-Max-Decompressed-Bytes"
+	// FeaturesHeaderName is the http response header name holding the comma-separated protocol features supported by
+	// the server
+	FeaturesHeaderName = "X-SAPM-Features"
+
+	// FeatureJSON is the feature advertised by servers accepting JSON-encoded requests
+	FeatureJSON = "json"
+	// FeaturePartialSuccess is the feature advertised by servers reporting the accepted and rejected spans in the
+	// PostSpansResponse
+	FeaturePartialSuccess = "partial-success"
 )
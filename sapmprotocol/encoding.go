@@ -0,0 +1,318 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	grpcencoding "google.golang.org/grpc/encoding"
+	// Register the gzip compressor of gRPC, so that it is not replaced by the one of the registry.
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+// Decompressor is a decompressing reader that can be reused for several inputs.
+type Decompressor interface {
+	io.Reader
+	Reset(r io.Reader) error
+}
+
+// Compressor is a compressing writer that can be reused for several outputs. Close flushes the compressed data to
+// the underlying writer without closing it.
+type Compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// ErrUnsupportedEncoding is returned when a Content-Encoding is not registered.
+type ErrUnsupportedEncoding struct {
+	Encoding string
+}
+
+func (e *ErrUnsupportedEncoding) Error() string {
+	return fmt.Sprintf("unsupported content encoding %q", e.Encoding)
+}
+
+// Encoding is a Content-Encoding registered with RegisterEncoding. It pools its decompressors and compressors.
+type Encoding struct {
+	name        string
+	readers     sync.Pool
+	writers     sync.Pool
+	newReader   func() Decompressor
+	newWriterFn func() (Compressor, error)
+}
+
+var (
+	encodingsMu sync.RWMutex
+	encodings   = map[string]*Encoding{}
+)
+
+func init() {
+	RegisterEncoding(GZipEncodingHeaderValue,
+		func() Decompressor { return &gzip.Reader{} },
+		func() (Compressor, error) { return gzip.NewWriter(nil), nil },
+	)
+	RegisterEncoding(ZStdEncodingHeaderValue,
+		func() Decompressor {
+			// Enable sync mode to avoid concurrency overheads. With http requests we don't need any concurrent
+			// decompression for individual request payload, it is pointless.
+			d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			return d
+		},
+		func() (Compressor, error) {
+			// Enable sync mode to avoid concurrency overheads.
+			return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		},
+	)
+	// The deflate Content-Encoding is the zlib format, not raw deflate (RFC 9110 section 8.4.1.2).
+	RegisterEncoding(DeflateEncodingHeaderValue,
+		func() Decompressor { return &zlibReader{} },
+		func() (Compressor, error) { return zlib.NewWriterLevel(nil, zlib.DefaultCompression) },
+	)
+	RegisterEncoding(SnappyEncodingHeaderValue,
+		func() Decompressor { return &noErrorReset[*s2.Reader]{s2.NewReader(nil)} },
+		func() (Compressor, error) {
+			return s2.NewWriter(nil, s2.WriterSnappyCompat(), s2.WriterConcurrency(1)), nil
+		},
+	)
+	RegisterEncoding(LZ4EncodingHeaderValue,
+		func() Decompressor { return &noErrorReset[*lz4.Reader]{lz4.NewReader(nil)} },
+		func() (Compressor, error) { return lz4.NewWriter(nil), nil },
+	)
+	RegisterEncoding(BrotliEncodingHeaderValue,
+		func() Decompressor { return brotli.NewReader(nil) },
+		func() (Compressor, error) { return brotli.NewWriter(nil), nil },
+	)
+
+	// Expose the encodings gRPC lacks as gRPC compressors. The gRPC registry is not safe for concurrent use and is
+	// shared by the whole program, so this is only done here, without replacing the compressors of gRPC.
+	for _, e := range encodings {
+		if grpcencoding.GetCompressor(e.name) == nil {
+			grpcencoding.RegisterCompressor(grpcCompressor{e: e})
+		}
+	}
+}
+
+// RegisterEncoding registers the Content-Encoding name, used by ParseSapmRequest and the SAPM client. It replaces any
+// encoding already registered with the same name. newDecompressor and newCompressor are called when the pools of the
+// encoding are empty. Only the built-in encodings are registered as gRPC compressors: other encodings must be
+// registered with google.golang.org/grpc/encoding to be used with gRPC.
+func RegisterEncoding(name string, newDecompressor func() Decompressor, newCompressor func() (Compressor, error)) {
+	e := &Encoding{name: name, newReader: newDecompressor, newWriterFn: newCompressor}
+	encodingsMu.Lock()
+	encodings[strings.ToLower(name)] = e
+	encodingsMu.Unlock()
+}
+
+// LookupEncoding returns the registered encoding with the given name, or an *ErrUnsupportedEncoding.
+func LookupEncoding(name string) (*Encoding, error) {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	e, ok := encodings[strings.ToLower(name)]
+	if !ok {
+		return nil, &ErrUnsupportedEncoding{Encoding: name}
+	}
+	return e, nil
+}
+
+// Encodings returns the names of the registered encodings, sorted.
+func Encodings() []string {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	names := make([]string, 0, len(encodings))
+	for _, e := range encodings {
+		names = append(names, e.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name returns the Content-Encoding value of the encoding.
+func (e *Encoding) Name() string {
+	return e.name
+}
+
+// GetDecompressor returns a pooled decompressor reading from r. It must be returned with PutDecompressor.
+func (e *Encoding) GetDecompressor(r io.Reader) (Decompressor, error) {
+	d, ok := e.readers.Get().(Decompressor)
+	if !ok {
+		d = e.newReader()
+	}
+	if err := d.Reset(r); err != nil {
+		e.readers.Put(d)
+		return nil, err
+	}
+	return d, nil
+}
+
+// PutDecompressor returns a decompressor to the pool.
+func (e *Encoding) PutDecompressor(d Decompressor) {
+	e.readers.Put(d)
+}
+
+// GetCompressor returns a pooled compressor writing to w. It must be returned with PutCompressor.
+func (e *Encoding) GetCompressor(w io.Writer) (Compressor, error) {
+	c, ok := e.writers.Get().(Compressor)
+	if !ok {
+		var err error
+		if c, err = e.newWriterFn(); err != nil {
+			return nil, err
+		}
+	}
+	c.Reset(w)
+	return c, nil
+}
+
+// PutCompressor returns a compressor to the pool.
+func (e *Encoding) PutCompressor(c Compressor) {
+	e.writers.Put(c)
+}
+
+// ParseContentEncoding returns the encodings listed in a Content-Encoding header value, in the order they were
+// applied. The identity encoding is skipped. An *ErrUnsupportedEncoding is returned for unknown encodings.
+func ParseContentEncoding(header string) ([]*Encoding, error) {
+	if header == "" {
+		return nil, nil
+	}
+	var stack []*Encoding
+	for _, name := range strings.Split(header, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.EqualFold(name, "identity") {
+			continue
+		}
+		e, err := LookupEncoding(name)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, e)
+	}
+	return stack, nil
+}
+
+// NewDecodingReader returns a reader decoding r, which was encoded with the stacked encodings. The decompressors are
+// pooled: release must be called once the reader is not used anymore, even if an error is returned.
+func NewDecodingReader(r io.Reader, stack []*Encoding) (io.Reader, func(), error) {
+	var decompressors []Decompressor
+	var encs []*Encoding
+	release := func() {
+		for i, d := range decompressors {
+			encs[i].PutDecompressor(d)
+		}
+	}
+	// The last encoding applied is the first one to remove.
+	for i := len(stack) - 1; i >= 0; i-- {
+		d, err := stack[i].GetDecompressor(r)
+		if err != nil {
+			return nil, release, err
+		}
+		decompressors = append(decompressors, d)
+		encs = append(encs, stack[i])
+		r = d
+	}
+	return r, release, nil
+}
+
+// NewCompressor returns a compressor applying the stacked encodings of a Content-Encoding header value, in order.
+// The compressor is not pooled, it is meant to be reused by its owner.
+func NewCompressor(contentEncoding string) (Compressor, error) {
+	stack, err := ParseContentEncoding(contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if len(stack) == 0 {
+		return nil, &ErrUnsupportedEncoding{Encoding: contentEncoding}
+	}
+	layers := make([]Compressor, len(stack))
+	for i, e := range stack {
+		if layers[i], err = e.newWriterFn(); err != nil {
+			return nil, err
+		}
+	}
+	if len(layers) == 1 {
+		return layers[0], nil
+	}
+	return &stackedCompressor{layers: layers}, nil
+}
+
+// stackedCompressor applies several encodings: the output of each layer is compressed by the next one.
+type stackedCompressor struct {
+	layers []Compressor
+}
+
+func (s *stackedCompressor) Reset(w io.Writer) {
+	for i := len(s.layers) - 1; i >= 0; i-- {
+		s.layers[i].Reset(w)
+		w = s.layers[i]
+	}
+}
+
+func (s *stackedCompressor) Write(p []byte) (int, error) {
+	return s.layers[0].Write(p)
+}
+
+// Close flushes the layers in order, so that each layer receives all the output of the previous one.
+func (s *stackedCompressor) Close() error {
+	for _, l := range s.layers {
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zlibReader adapts the zlib reader to the Decompressor interface. The zlib reader reads its header when it is
+// created, so it is only created by the first Reset.
+type zlibReader struct {
+	r io.ReadCloser
+}
+
+func (z *zlibReader) Read(p []byte) (int, error) {
+	return z.r.Read(p)
+}
+
+func (z *zlibReader) Reset(r io.Reader) error {
+	if z.r == nil {
+		var err error
+		z.r, err = zlib.NewReader(r)
+		return err
+	}
+	return z.r.(zlib.Resetter).Reset(r, nil)
+}
+
+// noErrorReset adapts readers whose Reset method returns no error to the Decompressor interface.
+type noErrorReset[T interface {
+	io.Reader
+	Reset(io.Reader)
+}] struct {
+	r T
+}
+
+func (n *noErrorReset[T]) Read(p []byte) (int, error) {
+	return n.r.Read(p)
+}
+
+func (n *noErrorReset[T]) Reset(r io.Reader) error {
+	n.r.Reset(r)
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"compress/zlib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	grpcencoding "google.golang.org/grpc/encoding"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/testhelpers"
+)
+
+func encode(t *testing.T, contentEncoding string, payload []byte) []byte {
+	c, err := NewCompressor(contentEncoding)
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	c.Reset(buf)
+	_, err = c.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	return buf.Bytes()
+}
+
+func TestEncodings(t *testing.T) {
+	sapm := testhelpers.CreateSapmData(100)
+	payload, err := sapm.Marshal()
+	require.NoError(t, err)
+
+	for _, contentEncoding := range []string{
+		GZipEncodingHeaderValue,
+		ZStdEncodingHeaderValue,
+		DeflateEncodingHeaderValue,
+		SnappyEncodingHeaderValue,
+		LZ4EncodingHeaderValue,
+		BrotliEncodingHeaderValue,
+		"gzip, zstd",
+		"identity,br , LZ4",
+	} {
+		t.Run(contentEncoding, func(t *testing.T) {
+			body := encode(t, contentEncoding, payload)
+			assert.NotEqual(t, payload, body)
+
+			// Parse twice to exercise the pooled decompressors.
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(body))
+				req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+				req.Header.Set(ContentEncodingHeaderName, contentEncoding)
+				psr, err := ParseTraceV2Request(req)
+				require.NoError(t, err)
+				assert.Equal(t, sapm.Batches, psr.Batches)
+			}
+		})
+	}
+}
+
+func TestDeflateEncodingIsZlib(t *testing.T) {
+	sapm := testhelpers.CreateSapmData(10)
+	payload, err := sapm.Marshal()
+	require.NoError(t, err)
+
+	// Bodies compressed by standard HTTP clients are readable.
+	buf := &bytes.Buffer{}
+	w := zlib.NewWriter(buf)
+	_, err = w.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, buf)
+	req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+	req.Header.Set(ContentEncodingHeaderName, DeflateEncodingHeaderValue)
+	psr, err := ParseTraceV2Request(req)
+	require.NoError(t, err)
+	assert.Equal(t, sapm.Batches, psr.Batches)
+
+	// Bodies compressed by the registry are readable by standard HTTP servers.
+	r, err := zlib.NewReader(bytes.NewReader(encode(t, DeflateEncodingHeaderValue, payload)))
+	require.NoError(t, err)
+	decoded := &bytes.Buffer{}
+	_, err = decoded.ReadFrom(r)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decoded.Bytes())
+
+	// A corrupt body fails the first Reset of a decompressor.
+	req = httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader([]byte("not zlib")))
+	req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+	req.Header.Set(ContentEncodingHeaderName, DeflateEncodingHeaderValue)
+	_, err = ParseTraceV2Request(req)
+	assert.Error(t, err)
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	_, err := LookupEncoding("compress")
+	assert.Equal(t, &ErrUnsupportedEncoding{Encoding: "compress"}, err)
+
+	_, err = NewCompressor("")
+	assert.Equal(t, &ErrUnsupportedEncoding{Encoding: ""}, err)
+
+	stack, err := ParseContentEncoding("identity")
+	require.NoError(t, err)
+	assert.Empty(t, stack)
+
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(nil))
+	req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+	req.Header.Set(ContentEncodingHeaderName, "gzip, compress")
+	_, err = ParseTraceV2Request(req)
+	assert.Equal(t, &ErrUnsupportedEncoding{Encoding: "compress"}, err)
+}
+
+func TestRegisterEncoding(t *testing.T) {
+	gz, err := LookupEncoding(GZipEncodingHeaderValue)
+	require.NoError(t, err)
+	RegisterEncoding("x-gzip", gz.newReader, gz.newWriterFn)
+
+	payload, err := (&splunksapm.PostSpansRequest{
+		Batches: []*model.Batch{{Process: &model.Process{ServiceName: "svc"}}},
+	}).Marshal()
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(encode(t, "x-gzip", payload)))
+	req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+	req.Header.Set(ContentEncodingHeaderName, "X-Gzip")
+	psr, err := ParseTraceV2Request(req)
+	require.NoError(t, err)
+	assert.Equal(t, "svc", psr.Batches[0].Process.ServiceName)
+
+	// The gRPC registry is left alone.
+	assert.Nil(t, grpcencoding.GetCompressor("x-gzip"))
+}
+
+func TestGRPCCompressors(t *testing.T) {
+	// gRPC keeps its own gzip compressor.
+	_, ok := grpcencoding.GetCompressor(GZipEncodingHeaderValue).(grpcCompressor)
+	assert.False(t, ok)
+	for _, name := range []string{ZStdEncodingHeaderValue, DeflateEncodingHeaderValue, BrotliEncodingHeaderValue} {
+		_, ok = grpcencoding.GetCompressor(name).(grpcCompressor)
+		assert.True(t, ok, name)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+)
+
+// GRPCPostSpansMethod is the full name of the SapmService.PostSpans gRPC method.
+const GRPCPostSpansMethod = "/splunk.sapm.SapmService/PostSpans"
+
+var (
+	// TokenMetadataKey is the gRPC metadata key holding the access token of the client.
+	TokenMetadataKey = strings.ToLower(TokenHeaderName)
+	// IdempotencyKeyMetadataKey is the gRPC metadata key holding the idempotency key of the request.
+	IdempotencyKeyMetadataKey = strings.ToLower(IdempotencyKeyHeaderName)
+)
+
+// NewGRPCServer returns a SapmService implementation passing the requests to consumer, to be registered with
+// splunksapm.RegisterSapmServiceServer. Consumer errors are answered like the handler returned by NewTraceHandler
+// does, with the status code matching the HTTP status of the handler: PermanentError is answered with
+// InvalidArgument, ThrottledError with ResourceExhausted and UnavailableError with Unavailable. The retry delay is
+// sent as a RetryInfo detail. Successful requests are answered with a PostSpansResponse reporting the accepted and
+// rejected spans. Install IdempotencyCache.UnaryServerInterceptor on the server to answer retried requests without
+// passing them to consumer again.
+func NewGRPCServer(consumer ConsumerFunc) splunksapm.SapmServiceServer {
+	return &grpcServer{consumer: consumer}
+}
+
+type grpcServer struct {
+	consumer ConsumerFunc
+}
+
+func (s *grpcServer) PostSpans(ctx context.Context, req *splunksapm.PostSpansRequest) (*splunksapm.PostSpansResponse, error) {
+	spans := countSpans(req)
+	resp, err := newPostSpansResponse(spans, s.consumer(ctx, req, tokenFromIncomingContext(ctx)))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp, nil
+}
+
+// tokenFromIncomingContext returns the access token sent in the metadata of a gRPC request, empty if there is none.
+func tokenFromIncomingContext(ctx context.Context) string {
+	if values := metadata.ValueFromIncomingContext(ctx, TokenMetadataKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcError converts a consumer error to a gRPC status error.
+func grpcError(err error) error {
+	herr := &HandlerError{}
+	if !errors.As(err, &herr) {
+		herr = &HandlerError{Err: err, StatusCode: http.StatusServiceUnavailable}
+	}
+	st := status.New(GRPCCodeFromHTTP(herr.StatusCode), herr.Error())
+	if herr.RetryAfter > 0 {
+		if withDetails, detailsErr := st.WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(herr.RetryAfter),
+		}); detailsErr == nil {
+			st = withDetails
+		}
+	}
+	return st.Err()
+}
+
+// httpToGRPCCodeMap holds the HTTP status codes that do not map to the default code of their class.
+var httpToGRPCCodeMap = map[int]codes.Code{
+	http.StatusUnauthorized:       codes.Unauthenticated,
+	http.StatusForbidden:          codes.PermissionDenied,
+	http.StatusNotFound:           codes.NotFound,
+	http.StatusTooManyRequests:    codes.ResourceExhausted,
+	499:                           codes.Canceled,
+	http.StatusNotImplemented:     codes.Unimplemented,
+	http.StatusServiceUnavailable: codes.Unavailable,
+	http.StatusGatewayTimeout:     codes.DeadlineExceeded,
+}
+
+// grpcToHTTPStatusMap follows the mapping used by grpc-gateway.
+var grpcToHTTPStatusMap = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// GRPCCodeFromHTTP returns the gRPC status code matching an HTTP status code of a SAPM response. It follows the
+// OpenTelemetry mapping of HTTP status codes: other 4xx codes map to InvalidArgument and other 5xx codes to Internal.
+func GRPCCodeFromHTTP(statusCode int) codes.Code {
+	if statusCode >= 100 && statusCode < 400 {
+		return codes.OK
+	}
+	if code, ok := httpToGRPCCodeMap[statusCode]; ok {
+		return code
+	}
+	if statusCode >= 400 && statusCode < 500 {
+		return codes.InvalidArgument
+	}
+	if statusCode >= 500 && statusCode < 600 {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// HTTPStatusFromGRPC returns the HTTP status code matching a gRPC status code, following the mapping used by
+// grpc-gateway. Unknown codes map to 500.
+func HTTPStatusFromGRPC(code codes.Code) int {
+	if httpCode, ok := grpcToHTTPStatusMap[code]; ok {
+		return httpCode
+	}
+	return http.StatusInternalServerError
+}
+
+// GRPCRetryDelay returns the retry delay carried by the RetryInfo detail of a gRPC status, 0 if there is none.
+func GRPCRetryDelay(st *status.Status) time.Duration {
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.GetRetryDelay().AsDuration()
+		}
+	}
+	return 0
+}
+
+// grpcCompressor exposes a registered encoding as a gRPC compressor, so that the encodings supported over HTTP can
+// be used with the grpc.UseCompressor call option.
+type grpcCompressor struct {
+	e *Encoding
+}
+
+var _ encoding.Compressor = grpcCompressor{}
+
+func (c grpcCompressor) Name() string {
+	return c.e.name
+}
+
+func (c grpcCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	z, err := c.e.GetCompressor(w)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledCompressor{Compressor: z, e: c.e}, nil
+}
+
+func (c grpcCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	d, err := c.e.GetDecompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledDecompressor{d: d, e: c.e}, nil
+}
+
+// pooledCompressor returns the compressor to the pool of its encoding when it is closed.
+type pooledCompressor struct {
+	Compressor
+	e *Encoding
+}
+
+func (p *pooledCompressor) Close() error {
+	err := p.Compressor.Close()
+	p.e.PutCompressor(p.Compressor)
+	return err
+}
+
+// pooledDecompressor returns the decompressor to the pool of its encoding once the input is fully read.
+type pooledDecompressor struct {
+	d Decompressor
+	e *Encoding
+}
+
+func (p *pooledDecompressor) Read(b []byte) (int, error) {
+	if p.d == nil {
+		return 0, io.EOF
+	}
+	n, err := p.d.Read(b)
+	if err == io.EOF {
+		p.e.PutDecompressor(p.d)
+		p.d = nil
+	}
+	return n, err
+}
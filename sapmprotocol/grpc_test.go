@@ -0,0 +1,149 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/testhelpers"
+)
+
+// serveGRPC serves the services registered by register on an in-memory listener and returns a connection to it.
+func serveGRPC(t *testing.T, register func(*grpc.Server), opts ...grpc.ServerOption) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(opts...)
+	register(server)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestGRPCServer(t *testing.T) {
+	var received *splunksapm.PostSpansRequest
+	var token string
+	var consumerErr error
+	conn := serveGRPC(t, func(s *grpc.Server) {
+		splunksapm.RegisterSapmServiceServer(s, NewGRPCServer(
+			func(_ context.Context, psr *splunksapm.PostSpansRequest, tok string) error {
+				received, token = psr, tok
+				return consumerErr
+			},
+		))
+	})
+	client := splunksapm.NewSapmServiceClient(conn)
+	psr := testhelpers.CreateSapmData(5)
+
+	for _, name := range []string{
+		"", GZipEncodingHeaderValue, ZStdEncodingHeaderValue, DeflateEncodingHeaderValue, SnappyEncodingHeaderValue,
+		LZ4EncodingHeaderValue, BrotliEncodingHeaderValue,
+	} {
+		t.Run("compression "+name, func(t *testing.T) {
+			var opts []grpc.CallOption
+			if name != "" {
+				opts = append(opts, grpc.UseCompressor(name))
+			}
+			ctx := metadata.AppendToOutgoingContext(context.Background(), TokenMetadataKey, "token")
+			resp, err := client.PostSpans(ctx, psr, opts...)
+			require.NoError(t, err)
+			assert.Equal(t, &splunksapm.PostSpansResponse{AcceptedSpans: 5}, resp)
+			assert.Equal(t, psr, received)
+			assert.Equal(t, "token", token)
+		})
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		wantCode  codes.Code
+		wantRetry time.Duration
+	}{
+		{name: "permanent", err: PermanentError(errors.New("invalid")), wantCode: codes.InvalidArgument},
+		{
+			name:      "throttled",
+			err:       ThrottledError(errors.New("slow down"), 3*time.Second),
+			wantCode:  codes.ResourceExhausted,
+			wantRetry: 3 * time.Second,
+		},
+		{
+			name:      "unavailable",
+			err:       UnavailableError(errors.New("down"), time.Second),
+			wantCode:  codes.Unavailable,
+			wantRetry: time.Second,
+		},
+		{name: "other", err: errors.New("failed"), wantCode: codes.Unavailable},
+		{
+			name:     "handler error",
+			err:      &HandlerError{Err: errors.New("denied"), StatusCode: http.StatusForbidden},
+			wantCode: codes.PermissionDenied,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumerErr = tt.err
+			_, err := client.PostSpans(context.Background(), psr)
+			st, ok := status.FromError(err)
+			require.True(t, ok)
+			assert.Equal(t, tt.wantCode, st.Code())
+			assert.Equal(t, tt.err.Error(), st.Message())
+			assert.Equal(t, tt.wantRetry, GRPCRetryDelay(st))
+		})
+	}
+
+	t.Run("partial success", func(t *testing.T) {
+		consumerErr = &PartialSuccessError{Message: "too old", RejectedSpans: 2}
+		resp, err := client.PostSpans(context.Background(), psr)
+		require.NoError(t, err)
+		assert.Equal(t, &splunksapm.PostSpansResponse{AcceptedSpans: 3, RejectedSpans: 2, ErrorMessage: "too old"}, resp)
+	})
+}
+
+func TestGRPCStatusMapping(t *testing.T) {
+	for _, code := range []codes.Code{
+		codes.OK, codes.Canceled, codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied,
+		codes.NotFound, codes.ResourceExhausted, codes.Unimplemented, codes.Unavailable, codes.DeadlineExceeded,
+		codes.Internal,
+	} {
+		assert.Equal(t, code, GRPCCodeFromHTTP(HTTPStatusFromGRPC(code)), code.String())
+	}
+	assert.Equal(t, codes.InvalidArgument, GRPCCodeFromHTTP(http.StatusRequestEntityTooLarge))
+	assert.Equal(t, codes.InvalidArgument, GRPCCodeFromHTTP(http.StatusConflict))
+	assert.Equal(t, codes.Internal, GRPCCodeFromHTTP(http.StatusBadGateway))
+	assert.Equal(t, codes.Unknown, GRPCCodeFromHTTP(0))
+	assert.Equal(t, http.StatusBadRequest, HTTPStatusFromGRPC(codes.FailedPrecondition))
+	assert.Equal(t, http.StatusConflict, HTTPStatusFromGRPC(codes.Aborted))
+	assert.Equal(t, http.StatusInternalServerError, HTTPStatusFromGRPC(codes.DataLoss))
+}
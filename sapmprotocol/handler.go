@@ -0,0 +1,213 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+)
+
+// ConsumerFunc receives the requests accepted by a trace handler along with the access token sent by the client,
+// empty if there was none. An error returned by the consumer fails the request: wrap it with PermanentError,
+// ThrottledError or UnavailableError to choose the response, other errors are answered with 503 Service Unavailable
+// so that clients retry. A consumer that accepted only some of the spans returns a *PartialSuccessError instead,
+// which is answered successfully.
+type ConsumerFunc func(ctx context.Context, psr *splunksapm.PostSpansRequest, token string) error
+
+// HandlerError is an error that sets the response of a trace handler.
+type HandlerError struct {
+	Err error
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// RetryAfter is sent in the Retry-After header, rounded up to the second, unless it is 0.
+	RetryAfter time.Duration
+}
+
+func (e *HandlerError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// PermanentError marks a consumer error as permanent: the request is answered with 400 Bad Request and clients
+// drop it.
+func PermanentError(err error) error {
+	return &HandlerError{Err: err, StatusCode: http.StatusBadRequest}
+}
+
+// ThrottledError makes the handler answer with 429 Too Many Requests, asking clients to pause for retryAfter.
+func ThrottledError(err error, retryAfter time.Duration) error {
+	return &HandlerError{Err: err, StatusCode: http.StatusTooManyRequests, RetryAfter: retryAfter}
+}
+
+// UnavailableError makes the handler answer with 503 Service Unavailable, asking clients to retry after retryAfter.
+func UnavailableError(err error, retryAfter time.Duration) error {
+	return &HandlerError{Err: err, StatusCode: http.StatusServiceUnavailable, RetryAfter: retryAfter}
+}
+
+// HandlerOption configures the handler created by NewTraceHandler.
+type HandlerOption func(*traceHandler)
+
+// WithMaxRequestBytes limits the size of the request bodies, before decompression. Larger requests are answered with
+// 413 Request Entity Too Large. There is no limit by default.
+func WithMaxRequestBytes(n int64) HandlerOption {
+	return func(h *traceHandler) {
+		h.maxRequestBytes = n
+	}
+}
+
+// WithParseOptions sets the options used to parse the requests, for instance to limit their decompressed size.
+// Requests exceeding the limits are answered with 413 Request Entity Too Large.
+func WithParseOptions(opts ...ParseOption) HandlerOption {
+	return func(h *traceHandler) {
+		h.parseOptions = append(h.parseOptions, opts...)
+	}
+}
+
+// WithPooledRequests decodes the requests with ParsePooledTraceV2Request, releasing them when the consumer returns.
+// The consumer must not retain the request, nor anything it references, after it returns.
+func WithPooledRequests() HandlerOption {
+	return func(h *traceHandler) {
+		h.pooled = true
+	}
+}
+
+type traceHandler struct {
+	consumer        ConsumerFunc
+	maxRequestBytes int64
+	parseOptions    []ParseOption
+	pooled          bool
+	// header holds the capability headers sent with every response.
+	header http.Header
+}
+
+// NewTraceHandler returns an http.Handler receiving SAPM requests, meant to be mounted at TraceEndpointV2.
+// It only accepts POST requests, parses them with ParseSapmRequest and passes them to consumer. Successful requests
+// are answered with a PostSpansResponse reporting the accepted and rejected spans, encoded like the request and
+// compressed with gzip if the client accepts it. Every response advertises the Capabilities of the handler: the
+// registered encodings, the size limits set by the options and the supported features.
+func NewTraceHandler(consumer ConsumerFunc, opts ...HandlerOption) http.Handler {
+	h := &traceHandler{consumer: consumer}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.header = http.Header{}
+	h.capabilities().SetHeaders(h.header)
+	return h
+}
+
+func (h *traceHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	for name, values := range h.header {
+		rw.Header()[name] = values
+	}
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.maxRequestBytes > 0 {
+		req.Body = http.MaxBytesReader(rw, req.Body, h.maxRequestBytes)
+	}
+
+	var psr *splunksapm.PostSpansRequest
+	var err error
+	if h.pooled {
+		var pooled *PooledRequest
+		if pooled, err = ParsePooledTraceV2Request(req, h.parseOptions...); err == nil {
+			defer pooled.Release()
+			psr = pooled.PostSpansRequest
+		}
+	} else {
+		psr, err = ParseTraceV2Request(req, h.parseOptions...)
+	}
+	if err != nil {
+		writeError(rw, parseError(err))
+		return
+	}
+
+	spans := countSpans(psr)
+	resp, err := newPostSpansResponse(spans, h.consumer(req.Context(), psr, req.Header.Get(TokenHeaderName)))
+	if err != nil {
+		herr := &HandlerError{}
+		if !errors.As(err, &herr) {
+			herr = &HandlerError{Err: err, StatusCode: http.StatusServiceUnavailable}
+		}
+		writeError(rw, herr)
+		return
+	}
+
+	writeResponse(rw, req, resp)
+}
+
+// parseError maps an error returned by ParseSapmRequest to the response of the handler.
+func parseError(err error) *HandlerError {
+	var maxBytesErr *http.MaxBytesError
+	var encodingErr *ErrUnsupportedEncoding
+	switch {
+	case errors.Is(err, ErrBadContentType), errors.As(err, &encodingErr):
+		return &HandlerError{Err: err, StatusCode: http.StatusUnsupportedMediaType}
+	case errors.As(err, &maxBytesErr), errors.Is(err, ErrTooLarge):
+		return &HandlerError{Err: err, StatusCode: http.StatusRequestEntityTooLarge}
+	}
+	return &HandlerError{Err: err, StatusCode: http.StatusBadRequest}
+}
+
+func writeError(rw http.ResponseWriter, herr *HandlerError) {
+	if herr.RetryAfter > 0 {
+		seconds := (herr.RetryAfter + time.Second - 1) / time.Second
+		rw.Header().Set(RetryAfterHeaderName, strconv.FormatInt(int64(seconds), 10))
+	}
+	http.Error(rw, herr.Error(), herr.StatusCode)
+}
+
+func writeResponse(rw http.ResponseWriter, req *http.Request, resp *splunksapm.PostSpansResponse) {
+	// The request was parsed successfully, so its content type is valid.
+	mediaType, _ := parseContentType(req.Header.Get(ContentTypeHeaderName))
+	var body []byte
+	var err error
+	if mediaType == ContentTypeJSONHeaderValue {
+		buf := &bytes.Buffer{}
+		err = MarshalJSON(buf, resp)
+		body = buf.Bytes()
+	} else {
+		body, err = resp.Marshal()
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set(ContentTypeHeaderName, mediaType)
+	if !strings.Contains(req.Header.Get(AcceptEncodingHeaderName), GZipEncodingHeaderValue) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(body)
+		return
+	}
+	rw.Header().Set(ContentEncodingHeaderName, GZipEncodingHeaderValue)
+	rw.WriteHeader(http.StatusOK)
+	gz := gzip.NewWriter(rw)
+	_, _ = gz.Write(body)
+	_ = gz.Close()
+}
@@ -0,0 +1,232 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+)
+
+func TestTraceHandler(t *testing.T) {
+	validProto, err := (&splunksapm.PostSpansRequest{
+		Batches: []*model.Batch{{Process: &model.Process{ServiceName: "svc"}, Spans: []*model.Span{{}}}},
+	}).Marshal()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		encoding    string
+		body        []byte
+		consumerErr error
+		opts        []HandlerOption
+		wantStatus  int
+		wantRetry   string
+		wantToken   string
+	}{
+		{name: "ok", body: validProto, wantStatus: http.StatusOK, wantToken: "token"},
+		{
+			name:       "pooled",
+			body:       validProto,
+			opts:       []HandlerOption{WithPooledRequests()},
+			wantStatus: http.StatusOK,
+			wantToken:  "token",
+		},
+		{
+			name:       "pooled bad proto",
+			body:       []byte("hello world"),
+			opts:       []HandlerOption{WithPooledRequests()},
+			wantStatus: http.StatusBadRequest,
+		},
+		{name: "get", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+		{name: "bad content type", contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "bad encoding", encoding: "compress", body: validProto, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "bad gzip", encoding: GZipEncodingHeaderValue, body: validProto, wantStatus: http.StatusBadRequest},
+		{name: "bad proto", body: []byte("hello world"), wantStatus: http.StatusBadRequest},
+		{
+			name:       "too large",
+			body:       validProto,
+			opts:       []HandlerOption{WithMaxRequestBytes(int64(len(validProto) - 1))},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "decompressed too large",
+			body:       validProto,
+			opts:       []HandlerOption{WithParseOptions(WithMaxDecompressedSize(1))},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "permanent",
+			body:        validProto,
+			consumerErr: PermanentError(errors.New("invalid")),
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "throttled",
+			body:        validProto,
+			consumerErr: ThrottledError(errors.New("slow down"), 1500*time.Millisecond),
+			wantStatus:  http.StatusTooManyRequests,
+			wantRetry:   "2",
+		},
+		{
+			name:        "unavailable",
+			body:        validProto,
+			consumerErr: UnavailableError(errors.New("down"), time.Second),
+			wantStatus:  http.StatusServiceUnavailable,
+			wantRetry:   "1",
+		},
+		{
+			name:        "other consumer error",
+			body:        validProto,
+			consumerErr: errors.New("failed"),
+			wantStatus:  http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotToken string
+			h := NewTraceHandler(func(_ context.Context, psr *splunksapm.PostSpansRequest, token string) error {
+				assert.Len(t, psr.Batches, 1)
+				gotToken = token
+				return tt.consumerErr
+			}, tt.opts...)
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, TraceEndpointV2, bytes.NewReader(tt.body))
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = ContentTypeHeaderValue
+			}
+			req.Header.Set(ContentTypeHeaderName, contentType)
+			req.Header.Set(ContentEncodingHeaderName, tt.encoding)
+			req.Header.Set(TokenHeaderName, "token")
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantRetry, rw.Header().Get(RetryAfterHeaderName))
+			if tt.wantToken != "" {
+				assert.Equal(t, tt.wantToken, gotToken)
+			}
+		})
+	}
+}
+
+func TestTraceHandlerResponse(t *testing.T) {
+	h := NewTraceHandler(func(context.Context, *splunksapm.PostSpansRequest, string) error { return nil })
+
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(nil))
+	req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+	req.Header.Set(AcceptEncodingHeaderName, GZipEncodingHeaderValue)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	require.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, ContentTypeHeaderValue, rw.Header().Get(ContentTypeHeaderName))
+	assert.Equal(t, GZipEncodingHeaderValue, rw.Header().Get(ContentEncodingHeaderName))
+	gz, err := gzip.NewReader(rw.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.NoError(t, (&splunksapm.PostSpansResponse{}).Unmarshal(body))
+}
+
+func TestTraceHandlerJSONResponse(t *testing.T) {
+	h := NewTraceHandler(func(context.Context, *splunksapm.PostSpansRequest, string) error { return nil })
+
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader([]byte(`{}`)))
+	req.Header.Set(ContentTypeHeaderName, "application/json; charset=utf-8")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	require.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, ContentTypeJSONHeaderValue, rw.Header().Get(ContentTypeHeaderName))
+	require.NoError(t, UnmarshalJSON(rw.Body.Bytes(), &splunksapm.PostSpansResponse{}))
+}
+
+func TestTraceHandlerPartialSuccess(t *testing.T) {
+	psr := &splunksapm.PostSpansRequest{Batches: []*model.Batch{
+		{Spans: []*model.Span{{}, {}}},
+		{Spans: []*model.Span{{}, {}, {}}},
+	}}
+	body, err := psr.Marshal()
+	require.NoError(t, err)
+
+	rejection := &splunksapm.BatchRejection{BatchIndex: 1, RejectedSpans: 2, Reason: "too old"}
+	tests := []struct {
+		name        string
+		consumerErr error
+		opts        []HandlerOption
+		want        *splunksapm.PostSpansResponse
+	}{
+		{name: "success", want: &splunksapm.PostSpansResponse{AcceptedSpans: 5}},
+		{
+			name:        "rejected spans",
+			consumerErr: &PartialSuccessError{Message: "invalid spans", RejectedSpans: 1},
+			want:        &splunksapm.PostSpansResponse{AcceptedSpans: 4, RejectedSpans: 1, ErrorMessage: "invalid spans"},
+		},
+		{
+			name:        "rejected batches",
+			consumerErr: fmt.Errorf("wrapped: %w", &PartialSuccessError{RejectedBatches: []*splunksapm.BatchRejection{rejection}}),
+			opts:        []HandlerOption{WithPooledRequests()},
+			want: &splunksapm.PostSpansResponse{
+				AcceptedSpans:   3,
+				RejectedSpans:   2,
+				RejectedBatches: []*splunksapm.BatchRejection{rejection},
+			},
+		},
+		{
+			name:        "all rejected",
+			consumerErr: &PartialSuccessError{RejectedSpans: 7},
+			want:        &splunksapm.PostSpansResponse{RejectedSpans: 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTraceHandler(func(_ context.Context, psr *splunksapm.PostSpansRequest, _ string) error {
+				// The response reports the spans received, even if the consumer modifies the request.
+				psr.Batches = psr.Batches[:1]
+				return tt.consumerErr
+			}, tt.opts...)
+			req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(body))
+			req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			require.Equal(t, http.StatusOK, rw.Code)
+			got := &splunksapm.PostSpansResponse{}
+			require.NoError(t, got.Unmarshal(rw.Body.Bytes()))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
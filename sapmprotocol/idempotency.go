@@ -0,0 +1,240 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// IdempotencyCache remembers the idempotency keys of the requests a receiver accepted, for a limited time and up to
+// a maximum number of keys, so that requests retried by clients after a lost response can be acknowledged without
+// being processed again. The cache also remembers the responses to these requests, so that retried requests get the
+// same response as the original one.
+type IdempotencyCache struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu sync.Mutex
+	// keys indexes the elements of order, which holds idempotencyEntry values from the oldest to the newest.
+	keys  map[string]*list.Element
+	order *list.List
+}
+
+type idempotencyEntry struct {
+	key    string
+	expiry time.Time
+	// response is the response to the request holding the key: a *cachedResponse for HTTP requests, the response
+	// message for gRPC requests. It is nil for the keys added with Add.
+	response interface{}
+}
+
+// NewIdempotencyCache creates an IdempotencyCache remembering keys for ttl, and at most maxEntries keys.
+// When the cache is full, the oldest keys are forgotten first.
+func NewIdempotencyCache(ttl time.Duration, maxEntries int) *IdempotencyCache {
+	return &IdempotencyCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		keys:       map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+// Contains returns true if key was added less than the cache TTL ago. An empty key is never contained.
+func (c *IdempotencyCache) Contains(key string) bool {
+	_, ok := c.get(key)
+	return ok
+}
+
+// Add remembers key. It must be called once the request holding the key was successfully processed, so that a
+// failed request can be retried with the same key.
+func (c *IdempotencyCache) Add(key string) {
+	c.add(key, nil)
+}
+
+// get returns the response remembered with key, and whether key is in the cache.
+func (c *IdempotencyCache) get(key string) (interface{}, bool) {
+	if key == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(c.now())
+	e, ok := c.keys[key]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(idempotencyEntry).response, true
+}
+
+func (c *IdempotencyCache) add(key string, response interface{}) {
+	if key == "" || c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.expire(now)
+	if e, ok := c.keys[key]; ok {
+		c.order.Remove(e)
+	}
+	c.keys[key] = c.order.PushBack(idempotencyEntry{key: key, expiry: now.Add(c.ttl), response: response})
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Front())
+	}
+}
+
+// Len returns the number of keys in the cache.
+func (c *IdempotencyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(c.now())
+	return c.order.Len()
+}
+
+// Handler returns a handler answering the requests whose idempotency key is in the cache without calling next. They
+// get the response next gave to the original request: the same status code, headers and body, such as the
+// PostSpansResponse and the capability headers of the handler returned by NewTraceHandler. The keys of the requests
+// next answers with a 2xx status code are added to the cache along with their response. Keys are scoped to the
+// access token of the request, so that tenants using the same key do not get each other's responses: keys added with
+// Add only match the requests without access token, and are answered with an empty 200 OK response. Concurrent
+// requests with the same key may all be passed to next.
+func (c *IdempotencyCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(IdempotencyKeyHeaderName)
+		if key == "" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		key = scopedKey(req.Header.Get(TokenHeaderName), key)
+		if resp, ok := c.get(key); ok {
+			if cached, ok := resp.(*cachedResponse); ok {
+				cached.write(rw)
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		if rec.status >= 200 && rec.status <= 299 {
+			c.add(key, &cachedResponse{status: rec.status, header: rec.header, body: rec.body.Bytes()})
+		}
+	})
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor answering the requests whose idempotency key, sent in the
+// IdempotencyKeyMetadataKey metadata, is in the cache without calling the handler. They get the response message the
+// handler returned for the original request. The keys of the requests the handler answers successfully are added to
+// the cache along with their response. Keys are only matched against the requests of the same method and access
+// token, sent in the TokenMetadataKey metadata, so the interceptor can be installed with grpc.UnaryInterceptor on a
+// server hosting both NewGRPCServer and NewJaegerCollectorServer, or other services, and shared by tenants.
+// Concurrent requests with the same key may all be passed to the handler.
+func (c *IdempotencyCache) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		values := metadata.ValueFromIncomingContext(ctx, IdempotencyKeyMetadataKey)
+		if len(values) == 0 || values[0] == "" {
+			return handler(ctx, req)
+		}
+		// The method is part of the key, so that responses of one method are never returned by another one.
+		key := info.FullMethod + " " + scopedKey(tokenFromIncomingContext(ctx), values[0])
+		if resp, ok := c.get(key); ok && resp != nil {
+			return resp, nil
+		}
+		resp, err := handler(ctx, req)
+		if err == nil && resp != nil {
+			c.add(key, resp)
+		}
+		return resp, err
+	}
+}
+
+// scopedKey returns the cache key of an idempotency key sent with an access token. Requests without access token use
+// the idempotency key as is. Tokens cannot hold a NUL byte, which separates them from the idempotency key.
+func scopedKey(token, key string) string {
+	if token == "" {
+		return key
+	}
+	return token + "\x00" + key
+}
+
+// expire must be called with the lock held. Entries expire in insertion order since they all share the same TTL.
+func (c *IdempotencyCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil && !e.Value.(idempotencyEntry).expiry.After(now); e = c.order.Front() {
+		c.remove(e)
+	}
+}
+
+func (c *IdempotencyCache) remove(e *list.Element) {
+	delete(c.keys, e.Value.(idempotencyEntry).key)
+	c.order.Remove(e)
+}
+
+// cachedResponse is a response remembered by the idempotency cache.
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (r *cachedResponse) write(rw http.ResponseWriter) {
+	for name, values := range r.header {
+		rw.Header()[name] = values
+	}
+	rw.WriteHeader(r.status)
+	_, _ = rw.Write(r.body)
+}
+
+// responseRecorder records the response written by a handler while writing it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,194 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger-idl/proto-gen/api_v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/testhelpers"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewIdempotencyCache(time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	assert.False(t, c.Contains("a"))
+	c.Add("a")
+	c.Add("")
+	assert.True(t, c.Contains("a"))
+	assert.False(t, c.Contains(""))
+
+	now = now.Add(30 * time.Second)
+	c.Add("b")
+	c.Add("c")
+	assert.False(t, c.Contains("a"), "oldest key is evicted when the cache is full")
+	assert.True(t, c.Contains("b"))
+	assert.Equal(t, 2, c.Len())
+
+	now = now.Add(time.Minute)
+	assert.False(t, c.Contains("b"))
+	assert.Equal(t, 0, c.Len())
+
+	c.Add("d")
+	now = now.Add(50 * time.Second)
+	c.Add("d")
+	now = now.Add(50 * time.Second)
+	assert.True(t, c.Contains("d"), "adding a key again extends its TTL")
+}
+
+func TestIdempotencyCacheHandler(t *testing.T) {
+	calls := 0
+	status := http.StatusAccepted
+	h := NewIdempotencyCache(time.Minute, 10).Handler(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		calls++
+		rw.WriteHeader(status)
+	}))
+
+	serveWithToken := func(key, token string) int {
+		req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, nil)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeaderName, key)
+		}
+		if token != "" {
+			req.Header.Set(TokenHeaderName, token)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	serve := func(key string) int { return serveWithToken(key, "") }
+
+	status = http.StatusServiceUnavailable
+	assert.Equal(t, http.StatusServiceUnavailable, serve("key"))
+	status = http.StatusAccepted
+	assert.Equal(t, http.StatusAccepted, serve("key"))
+	status = http.StatusCreated
+	assert.Equal(t, http.StatusAccepted, serve("key"), "the original response is replayed")
+	assert.Equal(t, 2, calls)
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusCreated, serve(""))
+	}
+	assert.Equal(t, 4, calls)
+
+	// Keys are scoped to the access token.
+	assert.Equal(t, http.StatusCreated, serveWithToken("key", "a"))
+	status = http.StatusAccepted
+	assert.Equal(t, http.StatusAccepted, serveWithToken("key", "b"))
+	assert.Equal(t, http.StatusCreated, serveWithToken("key", "a"), "the response of another tenant is not replayed")
+	assert.Equal(t, 6, calls)
+}
+
+func TestIdempotencyCacheTraceHandler(t *testing.T) {
+	calls := 0
+	cache := NewIdempotencyCache(time.Minute, 10)
+	h := cache.Handler(NewTraceHandler(func(context.Context, *splunksapm.PostSpansRequest, string) error {
+		calls++
+		return &PartialSuccessError{Message: "too old", RejectedSpans: 1}
+	}))
+	body, err := testhelpers.CreateSapmData(3).Marshal()
+	require.NoError(t, err)
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(body))
+		req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+		req.Header.Set(IdempotencyKeyHeaderName, "key")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+	first, retried := serve(), serve()
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, first.Code, retried.Code)
+	assert.Equal(t, first.Header(), retried.Header())
+	assert.NotNil(t, ParseCapabilities(retried.Header()))
+	resp := &splunksapm.PostSpansResponse{}
+	require.NoError(t, resp.Unmarshal(retried.Body.Bytes()))
+	assert.Equal(t, &splunksapm.PostSpansResponse{AcceptedSpans: 2, RejectedSpans: 1, ErrorMessage: "too old"}, resp)
+
+	// Keys added directly are acknowledged without a body.
+	cache.Add("added")
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(body))
+	req.Header.Set(IdempotencyKeyHeaderName, "added")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Zero(t, rw.Body.Len())
+	assert.Equal(t, 1, calls)
+}
+
+func TestIdempotencyCacheGRPC(t *testing.T) {
+	calls := 0
+	var consumerErr error
+	consumer := func(context.Context, *splunksapm.PostSpansRequest, string) error {
+		calls++
+		return consumerErr
+	}
+	conn := serveGRPC(t, func(s *grpc.Server) {
+		splunksapm.RegisterSapmServiceServer(s, NewGRPCServer(consumer))
+		api_v2.RegisterCollectorServiceServer(s, NewJaegerCollectorServer(consumer))
+	}, grpc.UnaryInterceptor(NewIdempotencyCache(time.Minute, 10).UnaryServerInterceptor()))
+	client := splunksapm.NewSapmServiceClient(conn)
+	psr := testhelpers.CreateSapmData(3)
+	withKey := func(key string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), IdempotencyKeyMetadataKey, key)
+	}
+
+	// Failed requests can be retried with the same key.
+	consumerErr = PermanentError(errors.New("invalid"))
+	_, err := client.PostSpans(withKey("key"), psr)
+	require.Error(t, err)
+	consumerErr = nil
+	for i := 0; i < 2; i++ {
+		resp, err := client.PostSpans(withKey("key"), psr)
+		require.NoError(t, err)
+		assert.Equal(t, &splunksapm.PostSpansResponse{AcceptedSpans: 3}, resp)
+	}
+	assert.Equal(t, 2, calls)
+
+	// Requests without a key are always processed.
+	_, err = client.PostSpans(context.Background(), psr)
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// Keys are not shared across methods.
+	jaeger := api_v2.NewCollectorServiceClient(conn)
+	for i := 0; i < 2; i++ {
+		_, err = jaeger.PostSpans(withKey("key"), &api_v2.PostSpansRequest{Batch: *psr.Batches[0]})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 4, calls)
+
+	// Keys are not shared across access tokens.
+	for _, token := range []string{"a", "b", "a"} {
+		_, err = client.PostSpans(metadata.AppendToOutgoingContext(withKey("key"), TokenMetadataKey, token), psr)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 6, calls)
+}
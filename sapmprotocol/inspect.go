@@ -0,0 +1,168 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+)
+
+const (
+	// Field numbers of the jaeger messages read by Inspect.
+	batchSpansFieldNumber         = 1
+	batchProcessFieldNumber       = 2
+	spanTraceIDFieldNumber        = 1
+	processServiceNameFieldNumber = 1
+)
+
+var errTruncated = errors.New("truncated message")
+
+// RequestSummary describes the content of a PostSpansRequest, as returned by Inspect.
+type RequestSummary struct {
+	Batches []BatchSummary
+	// Spans is the total number of spans of the request.
+	Spans int
+}
+
+// BatchSummary describes one batch of a PostSpansRequest.
+type BatchSummary struct {
+	// ServiceName is the service name of the process of the batch, empty if the batch has no process.
+	ServiceName string
+	Spans       int
+	// TraceIDs are the distinct trace IDs of the spans of the batch, in the order they first appear.
+	TraceIDs []jaegerpb.TraceID
+	// Offset and Length locate the encoded Batch message in the payload: payload[Offset:Offset+Length] can be
+	// unmarshaled into a jaegerpb.Batch or forwarded without decoding it.
+	Offset int
+	Length int
+}
+
+// Inspect scans an uncompressed protobuf PostSpansRequest and summarizes its content. Only the fields needed for the
+// summary are decoded, no span is allocated, which makes it several times faster than unmarshaling the request.
+// Inspect does not validate the fields it skips: a payload it accepts may still fail to unmarshal.
+func Inspect(payload []byte) (*RequestSummary, error) {
+	s := &RequestSummary{}
+	seen := map[jaegerpb.TraceID]struct{}{}
+	err := walkFields(payload, func(fieldNumber, wireType uint64, value []byte, offset int) error {
+		if fieldNumber != batchesFieldNumber || wireType != wireLengthDelimited {
+			return nil
+		}
+		bs := BatchSummary{Offset: offset, Length: len(value)}
+		clear(seen)
+		if err := inspectBatch(value, &bs, seen); err != nil {
+			return fmt.Errorf("invalid batch %d: %w", len(s.Batches), err)
+		}
+		s.Spans += bs.Spans
+		s.Batches = append(s.Batches, bs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func inspectBatch(b []byte, bs *BatchSummary, seen map[jaegerpb.TraceID]struct{}) error {
+	return walkFields(b, func(fieldNumber, wireType uint64, value []byte, _ int) error {
+		if wireType != wireLengthDelimited {
+			return nil
+		}
+		switch fieldNumber {
+		case batchSpansFieldNumber:
+			bs.Spans++
+			traceID, ok, err := spanTraceID(value)
+			if err != nil || !ok {
+				return err
+			}
+			if _, dup := seen[traceID]; !dup {
+				seen[traceID] = struct{}{}
+				bs.TraceIDs = append(bs.TraceIDs, traceID)
+			}
+		case batchProcessFieldNumber:
+			return walkFields(value, func(fieldNumber, wireType uint64, value []byte, _ int) error {
+				if fieldNumber == processServiceNameFieldNumber && wireType == wireLengthDelimited {
+					bs.ServiceName = string(value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// spanTraceID returns the trace ID of an encoded span, ok is false if the span has none.
+func spanTraceID(b []byte) (traceID jaegerpb.TraceID, ok bool, err error) {
+	err = walkFields(b, func(fieldNumber, wireType uint64, value []byte, _ int) error {
+		if fieldNumber != spanTraceIDFieldNumber || wireType != wireLengthDelimited {
+			return nil
+		}
+		var idErr error
+		traceID, idErr = jaegerpb.TraceIDFromBytes(value)
+		ok = idErr == nil
+		return idErr
+	})
+	return traceID, ok, err
+}
+
+// walkFields calls fn for every field of an encoded message. value holds the content of length-delimited fields
+// and is nil for the other wire types, offset is the position of value in b.
+func walkFields(b []byte, fn func(fieldNumber, wireType uint64, value []byte, offset int) error) error {
+	pos := 0
+	for pos < len(b) {
+		key, n := binary.Uvarint(b[pos:])
+		if n <= 0 {
+			return errTruncated
+		}
+		pos += n
+		fieldNumber, wireType := key>>3, key&7
+		if fieldNumber == 0 {
+			return errors.New("invalid field number 0")
+		}
+
+		var value []byte
+		offset := pos
+		switch wireType {
+		case wireVarint:
+			if _, n = binary.Uvarint(b[pos:]); n <= 0 {
+				return errTruncated
+			}
+			pos += n
+		case wireFixed64:
+			pos += 8
+		case wireFixed32:
+			pos += 4
+		case wireLengthDelimited:
+			length, n := binary.Uvarint(b[pos:])
+			if n <= 0 || length > uint64(len(b)-pos-n) {
+				return errTruncated
+			}
+			offset = pos + n
+			pos = offset + int(length)
+			value = b[offset:pos]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		if pos > len(b) {
+			return errTruncated
+		}
+		if err := fn(fieldNumber, wireType, value, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/testhelpers"
+)
+
+func TestInspect(t *testing.T) {
+	traceA, traceB := model.NewTraceID(1, 2), model.NewTraceID(0, 3)
+	psr := &splunksapm.PostSpansRequest{Batches: []*model.Batch{
+		{
+			Process: &model.Process{ServiceName: "frontend", Tags: []model.KeyValue{model.String("host", "a")}},
+			Spans: []*model.Span{
+				{TraceID: traceA, SpanID: 1, OperationName: "get", Tags: []model.KeyValue{model.Int64("status", 200)}},
+				{TraceID: traceB, SpanID: 2, Duration: 5},
+				{TraceID: traceA, SpanID: 3, References: []model.SpanRef{{TraceID: traceB, SpanID: 2}}},
+			},
+		},
+		{},
+		{Process: &model.Process{ServiceName: "backend"}, Spans: []*model.Span{{TraceID: traceB, SpanID: 4}}},
+	}}
+	payload, err := psr.Marshal()
+	require.NoError(t, err)
+
+	s, err := Inspect(payload)
+	require.NoError(t, err)
+	assert.Equal(t, 4, s.Spans)
+	require.Len(t, s.Batches, 3)
+
+	want := []BatchSummary{
+		{ServiceName: "frontend", Spans: 3, TraceIDs: []model.TraceID{traceA, traceB}},
+		{},
+		{ServiceName: "backend", Spans: 1, TraceIDs: []model.TraceID{traceB}},
+	}
+	for i, bs := range s.Batches {
+		assert.Equal(t, want[i].ServiceName, bs.ServiceName)
+		assert.Equal(t, want[i].Spans, bs.Spans)
+		assert.Equal(t, want[i].TraceIDs, bs.TraceIDs)
+
+		// The byte range holds the batch.
+		batch := &model.Batch{}
+		require.NoError(t, batch.Unmarshal(payload[bs.Offset:bs.Offset+bs.Length]))
+		assert.Equal(t, psr.Batches[i], batch)
+	}
+
+	empty, err := Inspect(nil)
+	require.NoError(t, err)
+	assert.Equal(t, &RequestSummary{}, empty)
+}
+
+func TestInspectErrors(t *testing.T) {
+	payload, err := testhelpers.CreateSapmData(3).Marshal()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "truncated", payload: payload[:len(payload)-1]},
+		{name: "truncated key", payload: []byte{0x80}},
+		{name: "truncated varint", payload: []byte{2 << 3, 0x80}},
+		{name: "truncated fixed", payload: []byte{3<<3 | wireFixed64, 1, 2}},
+		{name: "field zero", payload: []byte{0, 1}},
+		{name: "group", payload: []byte{2<<3 | 3}},
+		{name: "invalid trace id", payload: []byte{1<<3 | 2, 5, 1<<3 | 2, 3, 1<<3 | 2, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Inspect(tt.payload)
+			assert.Error(t, err)
+			assert.Nil(t, s)
+		})
+	}
+}
+
+func BenchmarkInspect(b *testing.B) {
+	psr := &splunksapm.PostSpansRequest{}
+	for i := 0; i < 100; i++ {
+		psr.Batches = append(psr.Batches, testhelpers.CreateSapmData(10).Batches...)
+	}
+	payload, err := psr.Marshal()
+	require.NoError(b, err)
+
+	b.Run("inspect", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := Inspect(payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := (&splunksapm.PostSpansRequest{}).Unmarshal(payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,196 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+
+	"github.com/signalfx/sapm-proto/internal/pool"
+)
+
+const (
+	// batchesFieldNumber is the field number of PostSpansRequest.batches.
+	batchesFieldNumber = 1
+
+	// Protobuf wire types.
+	wireVarint          = 0
+	wireFixed64         = 1
+	wireLengthDelimited = 2
+	wireFixed32         = 5
+
+	// maxInitialBatchBuffer caps the memory allocated for a batch before its bytes are actually read, so that a
+	// bogus length cannot allocate more than the request holds.
+	maxInitialBatchBuffer = 1 << 20
+)
+
+// BatchIterator decodes the batches of a protobuf SAPM request one at a time, while the body is read. Only the
+// batch being decoded is held in memory, so receivers can forward or reject batches incrementally.
+//
+//	it, err := NewBatchIterator(req)
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		batch := it.Batch()
+//		...
+//	}
+//	return it.Err()
+type BatchIterator struct {
+	r       *bufio.Reader
+	release func()
+	buf     bytes.Buffer
+	batch   *jaegerpb.Batch
+	limit   int64
+	err     error
+	closed  bool
+}
+
+// NewBatchIterator returns an iterator over the batches of a SAPM request. The request is decompressed and checked
+// against the parse options like ParseSapmRequest does. Only protobuf requests can be iterated: ErrBadContentType is
+// returned for JSON requests. The iterator must be closed if it is not consumed until Next returns false.
+func NewBatchIterator(req *http.Request, opts ...ParseOption) (*BatchIterator, error) {
+	mediaType, err := parseContentType(req.Header.Get(ContentTypeHeaderName))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != ContentTypeHeaderValue {
+		return nil, ErrBadContentType
+	}
+	body, release, err := newBodyReader(req, opts)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &BatchIterator{r: bufio.NewReader(body), release: release, limit: body.limit}, nil
+}
+
+// Next decodes the next batch, returning false at the end of the request or on error.
+func (it *BatchIterator) Next() bool {
+	it.batch = nil
+	if it.closed {
+		return false
+	}
+	for {
+		key, err := binary.ReadUvarint(it.r)
+		if err == io.EOF {
+			// The request ends on a field boundary.
+			it.Close()
+			return false
+		}
+		if err != nil {
+			return it.fail(err)
+		}
+		fieldNumber, wireType := key>>3, key&7
+		if fieldNumber != batchesFieldNumber || wireType != wireLengthDelimited {
+			if err = it.skip(wireType); err != nil {
+				return it.fail(err)
+			}
+			continue
+		}
+
+		n, err := it.readLength()
+		if err != nil {
+			return it.fail(err)
+		}
+		it.buf.Reset()
+		it.buf.Grow(int(min(n, maxInitialBatchBuffer)))
+		if _, err = io.CopyN(&it.buf, it.r, n); err != nil {
+			return it.fail(err)
+		}
+		batch := &jaegerpb.Batch{}
+		if err = batch.Unmarshal(it.buf.Bytes()); err != nil {
+			return it.fail(fmt.Errorf("invalid batch: %w", err))
+		}
+		it.batch = batch
+		return true
+	}
+}
+
+// Batch returns the batch decoded by the last call to Next. The batch is not reused by the iterator.
+func (it *BatchIterator) Batch() *jaegerpb.Batch {
+	return it.batch
+}
+
+// Err returns the error that stopped the iteration, nil if the whole request was decoded.
+func (it *BatchIterator) Err() error {
+	return it.err
+}
+
+// Close releases the decompressors of the iterator. It is called by Next at the end of the request, calling it
+// again is a no-op.
+func (it *BatchIterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.release()
+	if it.buf.Cap() > pool.MaxBufferSize {
+		it.buf = bytes.Buffer{}
+	}
+}
+
+func (it *BatchIterator) fail(err error) bool {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	it.err = err
+	it.Close()
+	return false
+}
+
+// readLength reads the length of a length-delimited field.
+func (it *BatchIterator) readLength() (int64, error) {
+	n, err := binary.ReadUvarint(it.r)
+	if err != nil {
+		return 0, err
+	}
+	if it.limit > 0 && n > uint64(it.limit) {
+		return 0, &DecompressedSizeError{Limit: it.limit}
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid field length %d", n)
+	}
+	return int64(n), nil
+}
+
+// skip discards a field that is not a batch, so that fields added to PostSpansRequest later are ignored.
+func (it *BatchIterator) skip(wireType uint64) error {
+	var err error
+	switch wireType {
+	case wireVarint:
+		_, err = binary.ReadUvarint(it.r)
+	case wireFixed64:
+		_, err = it.r.Discard(8)
+	case wireFixed32:
+		_, err = it.r.Discard(4)
+	case wireLengthDelimited:
+		var n int64
+		if n, err = it.readLength(); err == nil {
+			_, err = it.r.Discard(int(n))
+		}
+	default:
+		err = fmt.Errorf("unsupported wire type %d", wireType)
+	}
+	return err
+}
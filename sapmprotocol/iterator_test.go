@@ -0,0 +1,201 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/testhelpers"
+)
+
+func TestBatchIterator(t *testing.T) {
+	psr := testhelpers.CreateSapmData(5)
+	psr.Batches = append(psr.Batches,
+		&model.Batch{Process: &model.Process{ServiceName: "other"}, Spans: psr.Batches[0].Spans[:2]},
+		&model.Batch{},
+	)
+	payload, err := psr.Marshal()
+	require.NoError(t, err)
+
+	// Fields unknown to this version are skipped: a varint, a fixed64, a fixed32 and a length-delimited field.
+	unknown := []byte{2<<3 | wireVarint, 0x96, 0x01}
+	unknown = append(unknown, 3<<3|wireFixed64, 1, 2, 3, 4, 5, 6, 7, 8)
+	unknown = append(unknown, 4<<3|wireFixed32, 1, 2, 3, 4)
+	unknown = append(unknown, 5<<3|wireLengthDelimited, 3, 'a', 'b', 'c')
+	withUnknown := append(append(append([]byte{}, unknown...), payload...), unknown...)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		opts     []ParseOption
+		want     []*model.Batch
+		wantErr  error
+	}{
+		{name: "uncompressed", body: payload, want: psr.Batches},
+		{name: "gzip", encoding: GZipEncodingHeaderValue, body: gzipBytes(payload), want: psr.Batches},
+		{name: "zstd", encoding: ZStdEncodingHeaderValue, body: zstdBytes(payload), want: psr.Batches},
+		{name: "empty", body: nil},
+		{name: "unknown fields", body: withUnknown, want: psr.Batches},
+		{
+			name:    "truncated",
+			body:    payload[:len(payload)-1],
+			want:    psr.Batches[:2],
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{name: "truncated key", body: []byte{0x80}, wantErr: io.ErrUnexpectedEOF},
+		{name: "group", body: []byte{6<<3 | 3}, wantErr: assert.AnError},
+		{name: "invalid batch", body: []byte{1<<3 | wireLengthDelimited, 1, 0xff}, wantErr: assert.AnError},
+		{
+			name:    "decompressed size",
+			body:    payload,
+			opts:    []ParseOption{WithMaxDecompressedSize(int64(len(payload) - 3))},
+			want:    psr.Batches[:2],
+			wantErr: ErrTooLarge,
+		},
+		{
+			name:    "bogus length",
+			body:    []byte{1<<3 | wireLengthDelimited, 0xff, 0xff, 0xff, 0x7f},
+			opts:    []ParseOption{WithMaxDecompressedSize(1 << 20)},
+			wantErr: ErrTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(tt.body))
+			req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+			if tt.encoding != "" {
+				req.Header.Set(ContentEncodingHeaderName, tt.encoding)
+			}
+			it, err := NewBatchIterator(req, tt.opts...)
+			require.NoError(t, err)
+			defer it.Close()
+
+			var got []*model.Batch
+			for it.Next() {
+				got = append(got, it.Batch())
+			}
+			assert.Nil(t, it.Batch())
+			assert.False(t, it.Next())
+			switch tt.wantErr {
+			case nil:
+				require.NoError(t, it.Err())
+			case assert.AnError:
+				require.Error(t, it.Err())
+			default:
+				require.ErrorIs(t, it.Err(), tt.wantErr)
+			}
+			require.Len(t, got, len(tt.want))
+			for i := range got {
+				assert.Equal(t, tt.want[i], got[i])
+			}
+		})
+	}
+}
+
+func TestBatchIteratorClose(t *testing.T) {
+	psr := testhelpers.CreateSapmData(3)
+	psr.Batches = append(psr.Batches, psr.Batches[0])
+	payload, err := psr.Marshal()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(gzipBytes(payload)))
+	req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+	req.Header.Set(ContentEncodingHeaderName, GZipEncodingHeaderValue)
+	it, err := NewBatchIterator(req)
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	it.Close()
+	it.Close()
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+}
+
+func TestBatchIteratorErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		opts        []ParseOption
+		wantErr     error
+	}{
+		{name: "json", contentType: ContentTypeJSONHeaderValue, wantErr: ErrBadContentType},
+		{name: "unsupported", contentType: "text/plain", wantErr: ErrBadContentType},
+		{
+			name:        "encoding",
+			contentType: ContentTypeHeaderValue,
+			encoding:    "compress",
+			wantErr:     &ErrUnsupportedEncoding{Encoding: "compress"},
+		},
+		{
+			name:        "compressed size",
+			contentType: ContentTypeHeaderValue,
+			opts:        []ParseOption{WithMaxCompressedSize(1)},
+			wantErr:     ErrTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader([]byte("{}")))
+			req.Header.Set(ContentTypeHeaderName, tt.contentType)
+			if tt.encoding != "" {
+				req.Header.Set(ContentEncodingHeaderName, tt.encoding)
+			}
+			it, err := NewBatchIterator(req, tt.opts...)
+			assert.Nil(t, it)
+			if encodingErr, ok := tt.wantErr.(*ErrUnsupportedEncoding); ok {
+				assert.Equal(t, encodingErr, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func BenchmarkBatchIterator(b *testing.B) {
+	psr := &splunksapm.PostSpansRequest{}
+	for i := 0; i < 100; i++ {
+		psr.Batches = append(psr.Batches, testhelpers.CreateSapmData(10).Batches...)
+	}
+	payload, err := psr.Marshal()
+	require.NoError(b, err)
+	body := gzipBytes(payload)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(body))
+		req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+		req.Header.Set(ContentEncodingHeaderName, GZipEncodingHeaderValue)
+		it, err := NewBatchIterator(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for it.Next() {
+		}
+		if it.Err() != nil {
+			b.Fatal(it.Err())
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"context"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/jaegertracing/jaeger-idl/proto-gen/api_v2"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+)
+
+// JaegerPostSpansMethod is the full name of the Jaeger api_v2 CollectorService.PostSpans gRPC method.
+const JaegerPostSpansMethod = "/jaeger.api_v2.CollectorService/PostSpans"
+
+// NewJaegerCollectorServer returns a Jaeger api_v2 CollectorService implementation passing the requests to consumer,
+// to be registered with api_v2.RegisterCollectorServiceServer. Jaeger agents and clients can then send spans to a
+// SAPM receiver unchanged. Each Jaeger request carries a single batch, it is passed to consumer as a PostSpansRequest
+// holding that batch. Consumer errors are answered like NewGRPCServer does. The Jaeger response cannot report rejected
+// spans: a *PartialSuccessError is answered with an empty response, like a success. Retried requests are deduplicated
+// by IdempotencyCache.UnaryServerInterceptor, like those of NewGRPCServer.
+func NewJaegerCollectorServer(consumer ConsumerFunc) api_v2.CollectorServiceServer {
+	return &jaegerCollectorServer{consumer: consumer}
+}
+
+type jaegerCollectorServer struct {
+	consumer ConsumerFunc
+}
+
+func (s *jaegerCollectorServer) PostSpans(ctx context.Context, req *api_v2.PostSpansRequest) (*api_v2.PostSpansResponse, error) {
+	psr := &splunksapm.PostSpansRequest{Batches: []*jaegerpb.Batch{&req.Batch}}
+	spans := countSpans(psr)
+	if _, err := newPostSpansResponse(spans, s.consumer(ctx, psr, tokenFromIncomingContext(ctx))); err != nil {
+		return nil, grpcError(err)
+	}
+	return &api_v2.PostSpansResponse{}, nil
+}
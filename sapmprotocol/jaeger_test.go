@@ -0,0 +1,79 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/jaegertracing/jaeger-idl/proto-gen/api_v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/testhelpers"
+)
+
+func TestJaegerCollectorServer(t *testing.T) {
+	var received *splunksapm.PostSpansRequest
+	var token string
+	var consumerErr error
+	conn := serveGRPC(t, func(s *grpc.Server) {
+		api_v2.RegisterCollectorServiceServer(s, NewJaegerCollectorServer(
+			func(_ context.Context, psr *splunksapm.PostSpansRequest, tok string) error {
+				received, token = psr, tok
+				return consumerErr
+			},
+		))
+	})
+	client := api_v2.NewCollectorServiceClient(conn)
+	batch := testhelpers.CreateSapmData(5).Batches[0]
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), TokenMetadataKey, "token")
+	resp, err := client.PostSpans(ctx, &api_v2.PostSpansRequest{Batch: *batch}, grpc.UseCompressor(GZipEncodingHeaderValue))
+	require.NoError(t, err)
+	assert.Equal(t, &api_v2.PostSpansResponse{}, resp)
+	assert.Equal(t, []*model.Batch{batch}, received.Batches)
+	assert.Equal(t, "token", token)
+
+	_, err = client.PostSpans(context.Background(), &api_v2.PostSpansRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []*model.Batch{{}}, received.Batches)
+	assert.Empty(t, token)
+
+	consumerErr = ThrottledError(errors.New("slow down"), time.Second)
+	_, err = client.PostSpans(context.Background(), &api_v2.PostSpansRequest{Batch: *batch})
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Equal(t, time.Second, GRPCRetryDelay(st))
+}
+
+func TestJaegerRequestWireCompatibility(t *testing.T) {
+	// A PostSpansRequest holding a single batch is encoded like the Jaeger request holding that batch.
+	batch := testhelpers.CreateSapmData(3).Batches[0]
+	sapm, err := (&splunksapm.PostSpansRequest{Batches: []*model.Batch{batch}}).Marshal()
+	require.NoError(t, err)
+	jaeger, err := (&api_v2.PostSpansRequest{Batch: *batch}).Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, jaeger, sapm)
+}
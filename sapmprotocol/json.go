@@ -0,0 +1,58 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"io"
+	"mime"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+)
+
+var (
+	jsonMarshaler = &jsonpb.Marshaler{}
+	// Unknown fields are ignored, as they are when decoding protobuf, so that older receivers accept newer clients.
+	jsonUnmarshaler = &jsonpb.Unmarshaler{AllowUnknownFields: true}
+)
+
+// MarshalJSON writes the JSON encoding of a SAPM message, such as a PostSpansRequest, to w. It follows the protobuf
+// JSON mapping: field names are camel cased, trace and span IDs are base64 encoded and timestamps use RFC 3339.
+func MarshalJSON(w io.Writer, m proto.Message) error {
+	return jsonMarshaler.Marshal(w, m)
+}
+
+// UnmarshalJSON decodes the JSON encoding of a SAPM message written by MarshalJSON.
+func UnmarshalJSON(b []byte, into proto.Message) error {
+	return jsonUnmarshaler.Unmarshal(bytes.NewReader(b), into)
+}
+
+// parseContentType returns the media type of a Content-Type header value, normalized to ContentTypeHeaderValue for
+// protobuf and ContentTypeJSONHeaderValue for JSON. Parameters such as charset are ignored. ErrBadContentType is
+// returned for any other media type.
+func parseContentType(header string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", ErrBadContentType
+	}
+	switch mediaType {
+	case ContentTypeHeaderValue, ContentTypeProtobufHeaderValue:
+		return ContentTypeHeaderValue, nil
+	case ContentTypeJSONHeaderValue:
+		return ContentTypeJSONHeaderValue, nil
+	}
+	return "", ErrBadContentType
+}
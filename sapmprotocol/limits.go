@@ -0,0 +1,165 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/signalfx/sapm-proto/internal/pool"
+)
+
+const (
+	// minRatioCheckSize is the decompressed size below which the decompression ratio is not checked, since tiny
+	// payloads routinely have high ratios.
+	minRatioCheckSize = 64 << 10
+)
+
+// ErrTooLarge is matched by errors.Is for every error returned when a request exceeds one of the parse limits.
+var ErrTooLarge = errors.New("request too large")
+
+// CompressedSizeError is returned when the request body, as sent on the wire, exceeds the maximum size.
+type CompressedSizeError struct {
+	Limit int64
+}
+
+func (e *CompressedSizeError) Error() string {
+	return fmt.Sprintf("request body exceeds %d bytes", e.Limit)
+}
+
+// Is returns true for ErrTooLarge.
+func (e *CompressedSizeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// DecompressedSizeError is returned when the decompressed request exceeds the maximum size.
+type DecompressedSizeError struct {
+	Limit int64
+}
+
+func (e *DecompressedSizeError) Error() string {
+	return fmt.Sprintf("decompressed request exceeds %d bytes", e.Limit)
+}
+
+// Is returns true for ErrTooLarge.
+func (e *DecompressedSizeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// DecompressionRatioError is returned when the request decompresses to more than the maximum ratio of its
+// compressed size, which is typical of decompression bombs.
+type DecompressionRatioError struct {
+	Limit float64
+}
+
+func (e *DecompressionRatioError) Error() string {
+	return fmt.Sprintf("request decompression ratio exceeds %v", e.Limit)
+}
+
+// Is returns true for ErrTooLarge.
+func (e *DecompressionRatioError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// ParseOption configures the limits enforced by ParseSapmRequest. There are no limits by default.
+type ParseOption func(*parseLimits)
+
+type parseLimits struct {
+	maxCompressedSize     int64
+	maxDecompressedSize   int64
+	maxDecompressionRatio float64
+}
+
+// WithMaxCompressedSize limits the size of the request body as sent on the wire. Larger requests fail with a
+// CompressedSizeError.
+func WithMaxCompressedSize(n int64) ParseOption {
+	return func(l *parseLimits) {
+		l.maxCompressedSize = n
+	}
+}
+
+// WithMaxDecompressedSize limits the size of the request once decompressed. Larger requests fail with a
+// DecompressedSizeError. For requests that are not compressed, it limits the size of the body.
+func WithMaxDecompressedSize(n int64) ParseOption {
+	return func(l *parseLimits) {
+		l.maxDecompressedSize = n
+	}
+}
+
+// WithMaxDecompressionRatio limits the ratio of the decompressed size to the compressed size of the requests.
+// Requests exceeding it fail with a DecompressionRatioError. The ratio is only checked once more than 64KiB have
+// been decompressed.
+func WithMaxDecompressionRatio(ratio float64) ParseOption {
+	return func(l *parseLimits) {
+		l.maxDecompressionRatio = ratio
+	}
+}
+
+// compressedReader counts the bytes read from the request body and enforces the compressed size limit.
+type compressedReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (c *compressedReader) Read(p []byte) (int, error) {
+	n, err := readLimited(c.r, p, c.n, c.limit)
+	c.n += int64(n)
+	if c.limit > 0 && c.n > c.limit {
+		return n, &CompressedSizeError{Limit: c.limit}
+	}
+	return n, err
+}
+
+// decompressedReader enforces the decompressed size and ratio limits.
+type decompressedReader struct {
+	r          io.Reader
+	compressed *compressedReader
+	n          int64
+	limit      int64
+	ratio      float64
+}
+
+func (d *decompressedReader) Read(p []byte) (int, error) {
+	n, err := readLimited(d.r, p, d.n, d.limit)
+	d.n += int64(n)
+	if d.limit > 0 && d.n > d.limit {
+		return n, &DecompressedSizeError{Limit: d.limit}
+	}
+	if d.ratio > 0 && d.n > minRatioCheckSize && float64(d.n) > d.ratio*float64(d.compressed.n) {
+		return n, &DecompressionRatioError{Limit: d.ratio}
+	}
+	return n, err
+}
+
+// readLimited reads at most one byte more than the limit, so that exceeding it is detected without reading the
+// rest of the input.
+func readLimited(r io.Reader, p []byte, read, limit int64) (int, error) {
+	if limit > 0 && int64(len(p)) > limit-read+1 {
+		p = p[:limit-read+1]
+	}
+	return r.Read(p)
+}
+
+// putBuffer resets the buffer of a pool object before it goes back to the pool, dropping it if it grew too large.
+func (p *poolObj) putBuffer() {
+	if p.tempBuf.Cap() > pool.MaxBufferSize {
+		p.tempBuf = &bytes.Buffer{}
+		return
+	}
+	p.tempBuf.Reset()
+}
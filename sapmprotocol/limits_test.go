@@ -0,0 +1,142 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/pool"
+)
+
+func TestParseLimits(t *testing.T) {
+	batch := &model.Batch{Process: &model.Process{ServiceName: "svc"}}
+	for i := 0; i < 2000; i++ {
+		batch.Spans = append(batch.Spans, &model.Span{
+			TraceID:       model.NewTraceID(uint64(i), uint64(i)*7919),
+			SpanID:        model.NewSpanID(uint64(i) * 104729),
+			OperationName: "operation " + strconv.Itoa(i),
+		})
+	}
+	payload, err := (&splunksapm.PostSpansRequest{Batches: []*model.Batch{batch}}).Marshal()
+	require.NoError(t, err)
+	gzipped := gzipBytes(payload)
+	zstded := zstdBytes(payload)
+
+	// A bomb made of a valid message followed by a huge run of zeros, which compresses extremely well.
+	bomb := zstdBytes(append(append([]byte{}, payload...), make([]byte, 64<<20)...))
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		opts     []ParseOption
+		wantErr  error
+	}{
+		{name: "no limits", encoding: GZipEncodingHeaderValue, body: gzipped},
+		{
+			name:     "within limits",
+			encoding: ZStdEncodingHeaderValue,
+			body:     zstded,
+			opts: []ParseOption{
+				WithMaxCompressedSize(int64(len(zstded))),
+				WithMaxDecompressedSize(int64(len(payload))),
+				WithMaxDecompressionRatio(100),
+			},
+		},
+		{
+			name:     "compressed size",
+			encoding: GZipEncodingHeaderValue,
+			body:     gzipped,
+			opts:     []ParseOption{WithMaxCompressedSize(int64(len(gzipped) - 1))},
+			wantErr:  &CompressedSizeError{Limit: int64(len(gzipped) - 1)},
+		},
+		{
+			name:    "uncompressed size",
+			body:    payload,
+			opts:    []ParseOption{WithMaxDecompressedSize(100)},
+			wantErr: &DecompressedSizeError{Limit: 100},
+		},
+		{
+			name:     "decompressed size",
+			encoding: ZStdEncodingHeaderValue,
+			body:     bomb,
+			opts:     []ParseOption{WithMaxDecompressedSize(1 << 20)},
+			wantErr:  &DecompressedSizeError{Limit: 1 << 20},
+		},
+		{
+			name:     "decompression ratio",
+			encoding: ZStdEncodingHeaderValue,
+			body:     bomb,
+			opts:     []ParseOption{WithMaxDecompressionRatio(100)},
+			wantErr:  &DecompressionRatioError{Limit: 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(tt.body))
+			req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+			req.Header.Set(ContentEncodingHeaderName, tt.encoding)
+			// Hide the content length so that the limits are enforced while reading.
+			req.ContentLength = -1
+
+			psr, err := ParseTraceV2Request(req, tt.opts...)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+				assert.Len(t, psr.Batches[0].Spans, 2000)
+				return
+			}
+			assert.Equal(t, tt.wantErr, err)
+			assert.ErrorIs(t, err, ErrTooLarge)
+		})
+	}
+}
+
+func TestParseLimitsContentLength(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(make([]byte, 100)))
+	req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+	// The body is not read when the announced size is too large.
+	req.Body = io.NopCloser(errReader{})
+
+	_, err := ParseTraceV2Request(req, WithMaxCompressedSize(10))
+	assert.Equal(t, &CompressedSizeError{Limit: 10}, err)
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	panic("body must not be read")
+}
+
+func TestPooledBufferCap(t *testing.T) {
+	obj := newPoolObj()
+	obj.tempBuf.Grow(pool.MaxBufferSize + 1)
+	obj.putBuffer()
+	assert.Zero(t, obj.tempBuf.Cap())
+
+	obj.tempBuf.WriteString("hello")
+	obj.putBuffer()
+	assert.Zero(t, obj.tempBuf.Len())
+	assert.NotZero(t, obj.tempBuf.Cap())
+}
@@ -16,14 +16,12 @@ package sapmprotocol
 
 import (
 	"bytes"
-	"compress/gzip"
 	"errors"
 	"io"
 	"net/http"
 	"sync"
 
 	"github.com/gogo/protobuf/proto"
-	"github.com/klauspost/compress/zstd"
 
 	splunksapm "github.com/signalfx/sapm-proto/gen"
 )
@@ -34,64 +32,17 @@ type poolObj struct {
 	tempBuf *bytes.Buffer
 }
 
-type gzipPoolObj struct {
-	poolObj
-	gzipReader *gzip.Reader
-}
-
-type zstdPoolObj struct {
-	poolObj
-	zstdReader *zstd.Decoder
-}
-
 var (
 	// ErrBadContentType indicates an incompatible content type was received
 	ErrBadContentType = errors.New("bad content type")
 
-	// Pool of buffers for copying non-compressed payloads.
+	// Pool of buffers holding the decompressed payloads.
 	bufPool = &sync.Pool{
 		New: func() interface{} {
 			obj := newPoolObj()
 			return &obj
 		},
 	}
-
-	// Pool of gzip readers.
-	gzipPool = &sync.Pool{
-		New: func() interface{} {
-			// create a new gzip gzipReader with a bytes gzipReader and array of bytes containing only the gzip header
-			reader, _ := gzip.NewReader(
-				bytes.NewReader(
-					[]byte{
-						31, 139, 8, 0, 0, 0, 0, 0, 0, 255, 0, 0, 0, 255, 255, 1, 0, 0, 255, 255, 0, 0, 0, 0, 0, 0, 0, 0,
-					},
-				),
-			)
-			return &gzipPoolObj{
-				gzipReader: reader,
-				poolObj:    newPoolObj(),
-			}
-		},
-	}
-
-	// Pool of zstd readers.
-	zstdPool = &sync.Pool{
-		New: func() interface{} {
-			reader, _ := zstd.NewReader(
-				bytes.NewReader(
-					[]byte{},
-				),
-				// Enable sync mode to avoid concurrency overheads. With http requests
-				// we don't need any concurrent decompression for individual request
-				// payload, it is pointless.
-				zstd.WithDecoderConcurrency(1),
-			)
-			return &zstdPoolObj{
-				zstdReader: reader,
-				poolObj:    newPoolObj(),
-			}
-		},
-	}
 )
 
 func newPoolObj() poolObj {
@@ -101,64 +52,81 @@ func newPoolObj() poolObj {
 }
 
 // ParseTraceV2Request processes an http request request into SAPM
-func ParseTraceV2Request(req *http.Request) (*splunksapm.PostSpansRequest, error) {
+func ParseTraceV2Request(req *http.Request, opts ...ParseOption) (*splunksapm.PostSpansRequest, error) {
 	var sapm = &splunksapm.PostSpansRequest{}
-	if err := ParseSapmRequest(req, sapm); err != nil {
+	if err := ParseSapmRequest(req, sapm, opts...); err != nil {
 		return nil, err
 	}
 	return sapm, nil
 }
 
 // ParseSapmRequest parses an http request request into an SAPM compatible proto definition.
-func ParseSapmRequest(req *http.Request, into proto.Unmarshaler) error {
-	// content type MUST be application/x-protobuf
-	if req.Header.Get(ContentTypeHeaderName) != ContentTypeHeaderValue {
-		return ErrBadContentType
+// The request may be encoded with protobuf (application/x-protobuf or application/protobuf) or with JSON
+// (application/json), in which case into must also be a proto.Message.
+// The options limit the resources a request may use, an error matching ErrTooLarge is returned when a limit is hit.
+func ParseSapmRequest(req *http.Request, into proto.Unmarshaler, opts ...ParseOption) error {
+	mediaType, err := parseContentType(req.Header.Get(ContentTypeHeaderName))
+	if err != nil {
+		return err
+	}
+	var intoMessage proto.Message
+	if mediaType == ContentTypeJSONHeaderValue {
+		var ok bool
+		if intoMessage, ok = into.(proto.Message); !ok {
+			return ErrBadContentType
+		}
 	}
 
-	var reader io.Reader
+	reader, release, err := newBodyReader(req, opts)
+	defer release()
+	if err != nil {
+		return err
+	}
 
 	// Temporary buffer to store the message in so that we can unmarshal it.
-	var tempBuf *bytes.Buffer
-
-	// Obtain the correct object from one of the pools based on the content encoding.
-	switch req.Header.Get(ContentEncodingHeaderName) {
-	case GZipEncodingHeaderValue:
-		obj := gzipPool.Get().(*gzipPoolObj)
-		defer gzipPool.Put(obj)
-		tempBuf = obj.tempBuf
-		// get the gzip reader
-		// reset the reader with the request body
-		if err := obj.gzipReader.Reset(req.Body); err != nil {
-			return err
-		}
-		reader = obj.gzipReader
-
-	case ZStdEncodingHeaderValue:
-		obj := zstdPool.Get().(*zstdPoolObj)
-		defer zstdPool.Put(obj)
-		tempBuf = obj.tempBuf
-		// get the zstd reader
-		// reset the reader with the request body
-		if err := obj.zstdReader.Reset(req.Body); err != nil {
-			return err
-		}
-		reader = obj.zstdReader
-
-	case "":
-		// Not compressed. Just need a temporary buffer to read the entire Body into.
-		obj := bufPool.Get().(*poolObj)
-		defer bufPool.Put(obj)
-		tempBuf = obj.tempBuf
-		reader = req.Body
-	}
+	obj := bufPool.Get().(*poolObj)
+	defer bufPool.Put(obj)
+	defer obj.putBuffer()
+	tempBuf := obj.tempBuf
 
-	// Read ProtoBuf message bytes from the Reader into a temporary buffer.
+	// Read the message bytes from the Reader into a temporary buffer.
 	tempBuf.Reset()
-	if _, err := io.Copy(tempBuf, reader); err != nil {
+	if _, err = io.Copy(tempBuf, reader); err != nil {
 		return err
 	}
 
 	// Unmarshal the message from the buffer.
+	if intoMessage != nil {
+		return UnmarshalJSON(tempBuf.Bytes(), intoMessage)
+	}
 	return into.Unmarshal(tempBuf.Bytes())
 }
+
+// newBodyReader returns a reader of the decompressed request body, enforcing the parse limits. The decompressors
+// are pooled: release must be called once the reader is not used anymore, even if an error is returned.
+func newBodyReader(req *http.Request, opts []ParseOption) (*decompressedReader, func(), error) {
+	limits := parseLimits{}
+	for _, opt := range opts {
+		opt(&limits)
+	}
+	if limits.maxCompressedSize > 0 && req.ContentLength > limits.maxCompressedSize {
+		return nil, func() {}, &CompressedSizeError{Limit: limits.maxCompressedSize}
+	}
+	body := &compressedReader{r: req.Body, limit: limits.maxCompressedSize}
+
+	// Stacked encodings are listed in the order they were applied.
+	stack, err := ParseContentEncoding(req.Header.Get(ContentEncodingHeaderName))
+	if err != nil {
+		return nil, func() {}, err
+	}
+	decoded, release, err := NewDecodingReader(body, stack)
+	if err != nil {
+		return nil, release, err
+	}
+	return &decompressedReader{
+		r:          decoded,
+		compressed: body,
+		limit:      limits.maxDecompressedSize,
+		ratio:      limits.maxDecompressionRatio,
+	}, release, nil
+}
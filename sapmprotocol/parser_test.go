@@ -87,7 +87,7 @@ func TestNewV2TraceHandler(t *testing.T) {
 	badContentTypeReq := httptest.NewRequest(
 		http.MethodPost, path.Join("http://localhost", TraceEndpointV2), bytes.NewReader([]byte{}),
 	)
-	badContentTypeReq.Header.Set(ContentTypeHeaderName, "application/json")
+	badContentTypeReq.Header.Set(ContentTypeHeaderName, "text/plain")
 
 	errReader := iotest.TimeoutReader(bytes.NewReader([]byte{}))
 	errReader.Read([]byte{}) // read once so that subsequent reads return an error
@@ -242,6 +242,80 @@ func TestNewV2TraceHandler(t *testing.T) {
 	}
 }
 
+func TestParseMediaTypes(t *testing.T) {
+	psr := testhelpers.CreateSapmData(3)
+	protoBody, err := psr.Marshal()
+	require.NoError(t, err)
+	jsonBody := &bytes.Buffer{}
+	require.NoError(t, MarshalJSON(jsonBody, psr))
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantErr     error
+	}{
+		{name: "protobuf", contentType: "application/x-protobuf", body: protoBody},
+		{name: "protobuf with parameters", contentType: "application/x-protobuf; charset=binary", body: protoBody},
+		{name: "protobuf alias", contentType: "application/protobuf", body: protoBody},
+		{name: "case insensitive", contentType: "Application/X-Protobuf", body: protoBody},
+		{name: "json", contentType: "application/json", body: jsonBody.Bytes()},
+		{name: "json with charset", contentType: "application/json; charset=utf-8", body: jsonBody.Bytes()},
+		{name: "missing", contentType: "", body: protoBody, wantErr: ErrBadContentType},
+		{name: "malformed", contentType: "application/x-protobuf; =", body: protoBody, wantErr: ErrBadContentType},
+		{name: "unsupported", contentType: "text/plain", body: protoBody, wantErr: ErrBadContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(tt.body))
+			req.Header.Set(ContentTypeHeaderName, tt.contentType)
+			got, err := ParseTraceV2Request(req)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, psr, got)
+		})
+	}
+}
+
+func TestParseJSONRequest(t *testing.T) {
+	psr := testhelpers.CreateSapmData(2)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	require.NoError(t, MarshalJSON(gz, psr))
+	require.NoError(t, gz.Close())
+
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, &buf)
+	req.Header.Set(ContentTypeHeaderName, ContentTypeJSONHeaderValue)
+	req.Header.Set(ContentEncodingHeaderName, GZipEncodingHeaderValue)
+	got, err := ParseTraceV2Request(req)
+	require.NoError(t, err)
+	assert.Equal(t, psr, got)
+
+	req = httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader([]byte(`{"batches":[{"unknownField":1}]}`)))
+	req.Header.Set(ContentTypeHeaderName, ContentTypeJSONHeaderValue)
+	_, err = ParseTraceV2Request(req)
+	assert.NoError(t, err, "unknown fields are ignored")
+
+	req = httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader([]byte(`{"batches":`)))
+	req.Header.Set(ContentTypeHeaderName, ContentTypeJSONHeaderValue)
+	_, err = ParseTraceV2Request(req)
+	assert.Error(t, err)
+
+	// JSON can only be decoded into proto messages.
+	req = httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader([]byte(`{}`)))
+	req.Header.Set(ContentTypeHeaderName, ContentTypeJSONHeaderValue)
+	assert.ErrorIs(t, ParseSapmRequest(req, unmarshalerFunc(func([]byte) error { return nil })), ErrBadContentType)
+}
+
+type unmarshalerFunc func([]byte) error
+
+func (f unmarshalerFunc) Unmarshal(b []byte) error {
+	return f(b)
+}
+
 func BenchmarkDecode(b *testing.B) {
 	batch := &model.Batch{
 		Process: &model.Process{ServiceName: "spring"},
@@ -0,0 +1,158 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	jaegerpb "github.com/jaegertracing/jaeger-idl/model/v1"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+)
+
+// maxPooledSpans is the number of spans above which a pooled request is dropped instead of going back to the pool,
+// for the same reason as the buffers larger than MaxBufferSize in internal/pool.
+const maxPooledSpans = 1 << 16
+
+// PooledRequest is a PostSpansRequest decoded into pooled memory by ParsePooledTraceV2Request. The batches, spans,
+// processes and their tag, log and reference slices are reused by later decodes once Release is called.
+type PooledRequest struct {
+	*splunksapm.PostSpansRequest
+
+	batches   freeList[jaegerpb.Batch]
+	spans     freeList[jaegerpb.Span]
+	processes freeList[jaegerpb.Process]
+}
+
+var pooledRequests = sync.Pool{
+	New: func() interface{} {
+		return &PooledRequest{PostSpansRequest: &splunksapm.PostSpansRequest{}}
+	},
+}
+
+// ParsePooledTraceV2Request does what ParseTraceV2Request does but decodes the request into memory taken from a
+// pool. Release must be called once the request is not used anymore: the request, and everything it references
+// including the batches and spans, must not be used after that. JSON requests are decoded without pooling.
+func ParsePooledTraceV2Request(req *http.Request, opts ...ParseOption) (*PooledRequest, error) {
+	p := pooledRequests.Get().(*PooledRequest)
+	p.reset()
+	var into interface{ Unmarshal([]byte) error } = pooledUnmarshaler{p}
+	if mediaType, _ := parseContentType(req.Header.Get(ContentTypeHeaderName)); mediaType == ContentTypeJSONHeaderValue {
+		into = p.PostSpansRequest
+	}
+	if err := ParseSapmRequest(req, into, opts...); err != nil {
+		p.Release()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Release returns the request to the pool.
+func (p *PooledRequest) Release() {
+	if p.spans.len() > maxPooledSpans {
+		return
+	}
+	p.reset()
+	pooledRequests.Put(p)
+}
+
+func (p *PooledRequest) reset() {
+	p.PostSpansRequest.Batches = p.PostSpansRequest.Batches[:0]
+	p.batches.reset()
+	p.spans.reset()
+	p.processes.reset()
+}
+
+// pooledUnmarshaler decodes a PostSpansRequest like its generated Unmarshal method, except that the messages come
+// from the free lists of the pooled request.
+type pooledUnmarshaler struct {
+	p *PooledRequest
+}
+
+func (u pooledUnmarshaler) Unmarshal(b []byte) error {
+	p := u.p
+	return walkFields(b, func(fieldNumber, wireType uint64, value []byte, _ int) error {
+		if fieldNumber != batchesFieldNumber {
+			return nil
+		}
+		if wireType != wireLengthDelimited {
+			return fmt.Errorf("proto: wrong wireType = %d for field Batches", wireType)
+		}
+		batch := p.batches.get()
+		*batch = jaegerpb.Batch{Spans: batch.Spans[:0]}
+		if err := u.unmarshalBatch(batch, value); err != nil {
+			return err
+		}
+		p.Batches = append(p.Batches, batch)
+		return nil
+	})
+}
+
+func (u pooledUnmarshaler) unmarshalBatch(batch *jaegerpb.Batch, b []byte) error {
+	p := u.p
+	return walkFields(b, func(fieldNumber, wireType uint64, value []byte, _ int) error {
+		if fieldNumber != batchSpansFieldNumber && fieldNumber != batchProcessFieldNumber {
+			return nil
+		}
+		if wireType != wireLengthDelimited {
+			return fmt.Errorf("proto: wrong wireType = %d for field %d of Batch", wireType, fieldNumber)
+		}
+		if fieldNumber == batchSpansFieldNumber {
+			span := p.spans.get()
+			// The generated Unmarshal appends to the slices, reusing their backing arrays.
+			*span = jaegerpb.Span{
+				References: span.References[:0],
+				Tags:       span.Tags[:0],
+				Logs:       span.Logs[:0],
+				Warnings:   span.Warnings[:0],
+			}
+			if err := span.Unmarshal(value); err != nil {
+				return err
+			}
+			batch.Spans = append(batch.Spans, span)
+			return nil
+		}
+		if batch.Process == nil {
+			batch.Process = p.processes.get()
+			*batch.Process = jaegerpb.Process{Tags: batch.Process.Tags[:0]}
+		}
+		return batch.Process.Unmarshal(value)
+	})
+}
+
+// freeList hands out the messages it allocated, in order, until it is reset.
+type freeList[T any] struct {
+	items []*T
+	used  int
+}
+
+func (f *freeList[T]) get() *T {
+	if f.used == len(f.items) {
+		f.items = append(f.items, new(T))
+	}
+	item := f.items[f.used]
+	f.used++
+	return item
+}
+
+func (f *freeList[T]) len() int {
+	return len(f.items)
+}
+
+func (f *freeList[T]) reset() {
+	f.used = 0
+}
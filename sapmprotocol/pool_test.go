@@ -0,0 +1,136 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger-idl/model/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/signalfx/sapm-proto/internal/testhelpers"
+)
+
+func TestParsePooledTraceV2Request(t *testing.T) {
+	large := testhelpers.CreateSapmData(20)
+	large.Batches = append(large.Batches, &model.Batch{
+		Process: &model.Process{ServiceName: "other", Tags: []model.KeyValue{model.String("host", "h")}},
+		Spans: []*model.Span{{
+			TraceID:    model.NewTraceID(1, 2),
+			SpanID:     3,
+			StartTime:  time.Unix(10, 0).UTC(),
+			Tags:       []model.KeyValue{model.Binary("payload", []byte("abc")), model.Bool("error", true)},
+			Logs:       []model.Log{{Timestamp: time.Unix(11, 0).UTC(), Fields: []model.KeyValue{model.String("event", "x")}}},
+			References: []model.SpanRef{{TraceID: model.NewTraceID(1, 2), SpanID: 4}},
+			Warnings:   []string{"clock skew"},
+			Process:    &model.Process{ServiceName: "inline"},
+		}},
+	})
+	small := &splunksapm.PostSpansRequest{Batches: []*model.Batch{
+		{Spans: []*model.Span{{OperationName: "no tags"}}},
+	}}
+
+	// Decoding requests of different shapes with the same pooled memory never leaks data between them.
+	for i, want := range []*splunksapm.PostSpansRequest{large, small, large, small, {}} {
+		payload, err := want.Marshal()
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(gzipBytes(payload)))
+		req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+		req.Header.Set(ContentEncodingHeaderName, GZipEncodingHeaderValue)
+
+		got, err := ParsePooledTraceV2Request(req)
+		require.NoError(t, err, i)
+		// Reused slices are empty instead of nil, so the requests are compared on the wire.
+		gotPayload, err := got.Marshal()
+		require.NoError(t, err)
+		assert.Equal(t, payload, gotPayload, i)
+		got.Release()
+	}
+}
+
+func TestParsePooledTraceV2RequestJSON(t *testing.T) {
+	want := testhelpers.CreateSapmData(3)
+	var body bytes.Buffer
+	require.NoError(t, MarshalJSON(&body, want))
+	req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, &body)
+	req.Header.Set(ContentTypeHeaderName, ContentTypeJSONHeaderValue)
+
+	got, err := ParsePooledTraceV2Request(req)
+	require.NoError(t, err)
+	defer got.Release()
+	assert.Equal(t, want, got.PostSpansRequest)
+}
+
+func TestParsePooledTraceV2RequestErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{name: "content type", contentType: "text/plain"},
+		{name: "invalid", contentType: ContentTypeHeaderValue, body: []byte("hello world")},
+		{name: "wrong wire type", contentType: ContentTypeHeaderValue, body: []byte{1 << 3, 1}},
+		{name: "wrong batch wire type", contentType: ContentTypeHeaderValue, body: []byte{1<<3 | 2, 2, 1 << 3, 1}},
+		{name: "invalid span", contentType: ContentTypeHeaderValue, body: []byte{1<<3 | 2, 3, 1<<3 | 2, 1, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(tt.body))
+			req.Header.Set(ContentTypeHeaderName, tt.contentType)
+			got, err := ParsePooledTraceV2Request(req)
+			assert.Error(t, err)
+			assert.Nil(t, got)
+		})
+	}
+}
+
+func BenchmarkParsePooledTraceV2Request(b *testing.B) {
+	psr := &splunksapm.PostSpansRequest{}
+	for i := 0; i < 100; i++ {
+		psr.Batches = append(psr.Batches, testhelpers.CreateSapmData(10).Batches...)
+	}
+	payload, err := psr.Marshal()
+	require.NoError(b, err)
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, TraceEndpointV2, bytes.NewReader(payload))
+		req.Header.Set(ContentTypeHeaderName, ContentTypeHeaderValue)
+		return req
+	}
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			got, err := ParsePooledTraceV2Request(newRequest())
+			if err != nil {
+				b.Fatal(err)
+			}
+			got.Release()
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ParseTraceV2Request(newRequest()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,74 @@
+// Copyright Splunk, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sapmprotocol
+
+import (
+	"errors"
+
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+)
+
+// PartialSuccessError is returned by a consumer that accepted only some of the spans of a request. The request is
+// answered successfully, with a PostSpansResponse reporting the rejected spans, so that clients do not retry it.
+type PartialSuccessError struct {
+	// Message explains why the spans were rejected, it is sent as the error message of the response.
+	Message string
+	// RejectedSpans is the number of rejected spans. If it is 0, it is the sum of the spans rejected in
+	// RejectedBatches.
+	RejectedSpans int64
+	// RejectedBatches optionally reports the rejected spans of each batch of the request.
+	RejectedBatches []*splunksapm.BatchRejection
+}
+
+func (e *PartialSuccessError) Error() string {
+	if e.Message == "" {
+		return "spans were rejected"
+	}
+	return e.Message
+}
+
+// newPostSpansResponse returns the response to a request holding spans spans, given the error returned by its
+// consumer. Errors other than a PartialSuccessError are returned unchanged, with a nil response.
+func newPostSpansResponse(spans int64, err error) (*splunksapm.PostSpansResponse, error) {
+	if err == nil {
+		return &splunksapm.PostSpansResponse{AcceptedSpans: spans}, nil
+	}
+	var partial *PartialSuccessError
+	if !errors.As(err, &partial) {
+		return nil, err
+	}
+	rejected := partial.RejectedSpans
+	if rejected == 0 {
+		for _, batch := range partial.RejectedBatches {
+			rejected += batch.RejectedSpans
+		}
+	}
+	return &splunksapm.PostSpansResponse{
+		AcceptedSpans:   max(spans-rejected, 0),
+		RejectedSpans:   rejected,
+		ErrorMessage:    partial.Message,
+		RejectedBatches: partial.RejectedBatches,
+	}, nil
+}
+
+// countSpans returns the number of spans of a request. It is computed before passing the request to the consumer,
+// which may modify it.
+func countSpans(psr *splunksapm.PostSpansRequest) int64 {
+	var spans int64
+	for _, batch := range psr.Batches {
+		spans += int64(len(batch.Spans))
+	}
+	return spans
+}